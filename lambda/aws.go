@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// Default AWS configuration and DynamoDB client, loaded once per process and
+// reused across invocations and HTTP requests, like the IoT clients
+var (
+	awsConfigMu sync.Mutex
+	awsConfig   *aws.Config
+
+	dynamoDBClientMu sync.Mutex
+	dynamoDBClient   *dynamodb.Client
+)
+
+func loadAWSConfig(ctx context.Context) (aws.Config, error) {
+	awsConfigMu.Lock()
+	defer awsConfigMu.Unlock()
+
+	if awsConfig != nil {
+		return *awsConfig, nil
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return aws.Config{}, err
+	}
+
+	awsConfig = &cfg
+	return cfg, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Battery state-of-charge endpoint response, with the SOC in percent
+type BatterySOCResponse struct {
+	SOC *float64 `json:"soc"`
+}
+
+func fetchBatterySOC(ctx context.Context, client *http.Client, url string, retry RetryPolicy) (float64, error) {
+	newRequest := func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
+	}
+
+	var response BatterySOCResponse
+
+	decode := func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&response)
+	}
+
+	err := doRequest(ctx, client, retry, "query battery state of charge", "json", newRequest, decode)
+	if err != nil {
+		return 0, err
+	}
+
+	if response.SOC == nil {
+		return 0, fmt.Errorf("battery response has no soc field")
+	}
+
+	if *response.SOC < 0 || *response.SOC > 100 {
+		return 0, fmt.Errorf("battery state of charge %.1f%% is out of range", *response.SOC)
+	}
+
+	return *response.SOC, nil
+}
+
+// Only disable solar once the battery can't absorb the surplus anymore
+func applyBatteryGate(shouldDisable bool, soc float64, threshold float64) bool {
+	return shouldDisable && soc >= threshold
+}
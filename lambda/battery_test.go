@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyBatteryGate(t *testing.T) {
+	tests := []struct {
+		name          string
+		shouldDisable bool
+		soc           float64
+		want          bool
+	}{
+		{"negative price, battery full", true, 100, true},
+		{"negative price, battery at threshold", true, 95, true},
+		{"negative price, battery charging", true, 60, false},
+		{"positive price, battery full", false, 100, false},
+		{"positive price, battery charging", false, 60, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := applyBatteryGate(tt.shouldDisable, tt.soc, 95); got != tt.want {
+				t.Errorf("applyBatteryGate(%t, %g, 95) = %t, want %t", tt.shouldDisable, tt.soc, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchBatterySOC(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    float64
+		wantErr string
+	}{
+		{"state of charge", `{"soc": 87.5}`, 87.5, ""},
+		{"missing soc", `{"charge": 87.5}`, 0, "no soc field"},
+		{"out of range", `{"soc": 120}`, 0, "out of range"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newJSONServer(t, http.StatusOK, tt.body)
+
+			soc, err := fetchBatterySOC(context.Background(), server.Client(), server.URL, testRetry)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchBatterySOC: %v", err)
+			}
+
+			if soc != tt.want {
+				t.Errorf("soc = %g, want %g", soc, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunBatteryGate(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name        string
+		marketPrice float64
+		soc         string
+		wantDisable bool
+		wantSOC     bool
+	}{
+		{"negative price, battery full", -0.05, `{"soc": 98}`, true, true},
+		{"negative price, battery charging", -0.05, `{"soc": 40}`, false, true},
+		{"positive price skips the battery", 0.05, `{"soc": 98}`, false, false},
+		{"battery without soc decides on price", -0.05, `{}`, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isolateAWS(t)
+
+			prices := marketPricesBody(t, dayPrices(t, now, tt.marketPrice))
+
+			// The https-only URLs share one trusted server
+			mux := http.NewServeMux()
+			mux.HandleFunc("/soc", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tt.soc))
+			})
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(prices))
+			})
+			server := newTLSServer(t, mux)
+
+			iot := newFakeIoT()
+			cfg := runConfig(t, iot, nil, now, map[string]string{
+				"FRANK_ENERGIE_URL": server.URL,
+				"BATTERY_SOC_URL":   server.URL + "/soc",
+				"CA_BUNDLE_PATH":    os.Getenv("CA_BUNDLE_PATH"),
+			})
+
+			result, err := Run(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			if result.ShouldDisableSolar != tt.wantDisable {
+				t.Errorf("ShouldDisableSolar = %t, want %t", result.ShouldDisableSolar, tt.wantDisable)
+			}
+			if (result.BatterySOC != nil) != tt.wantSOC {
+				t.Errorf("BatterySOC = %v, want it reported: %t", result.BatterySOC, tt.wantSOC)
+			}
+		})
+	}
+}
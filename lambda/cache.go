@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Price provider backed by a DynamoDB cache keyed by provider and date
+type CachingProvider struct {
+	Provider  PriceProvider
+	Name      string
+	TableName string
+	Location  *time.Location
+	Now       func() time.Time
+}
+
+func (p *CachingProvider) FetchPrices(ctx context.Context, date string) ([]ElectricityPrice, error) {
+	key := fmt.Sprintf("%s#%s", p.Name, date)
+
+	client, err := newDynamoDBClient(ctx)
+	if err != nil {
+		slog.Warn("Price cache unavailable, fetching directly", "error", err)
+		return p.Provider.FetchPrices(ctx, date)
+	}
+
+	// Serve from the cache when possible
+	prices, found, err := readCachedPrices(ctx, client, p.TableName, key, p.Now())
+	if err != nil {
+		slog.Error("Error reading price cache", "error", err)
+	} else if found && len(prices) == 0 {
+		// Empty days are never written, so the entry is corrupt and would
+		// otherwise hide the day's prices until it expires
+		slog.Warn("Invalidating empty cached prices", "key", key)
+
+		err = deleteCachedPrices(ctx, client, p.TableName, key)
+		if err != nil {
+			slog.Error("Error invalidating price cache", "error", err)
+		}
+	} else if found {
+		slog.Info("Using cached prices", "key", key)
+		return prices, nil
+	}
+
+	prices, err = p.Provider.FetchPrices(ctx, date)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't cache empty days, the prices may simply not be published yet
+	if len(prices) == 0 {
+		return prices, nil
+	}
+
+	// Cache writes must not block the decision
+	err = writeCachedPrices(ctx, client, p.TableName, key, date, prices, p.Location)
+	if err != nil {
+		slog.Error("Error writing price cache", "error", err)
+	}
+
+	return prices, nil
+}
+
+// Cached prices and fresh ones from the provider, leaving the cache untouched
+// so the next run still sees the revision
+func (p *CachingProvider) Compare(ctx context.Context, date string) ([]ElectricityPrice, []ElectricityPrice, error) {
+	client, err := newDynamoDBClient(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cached, _, err := readCachedPrices(ctx, client, p.TableName, fmt.Sprintf("%s#%s", p.Name, date), p.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	prices, err := p.Provider.FetchPrices(ctx, date)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return prices, cached, nil
+}
+
+// Fetch fresh prices regardless of the cache and return them together with
+// the cached ones, so retroactive revisions can be detected
+func (p *CachingProvider) Revalidate(ctx context.Context, date string) ([]ElectricityPrice, []ElectricityPrice, error) {
+	key := fmt.Sprintf("%s#%s", p.Name, date)
+
+	client, err := newDynamoDBClient(ctx)
+	if err != nil {
+		slog.Warn("Price cache unavailable, fetching directly", "error", err)
+		prices, err := p.Provider.FetchPrices(ctx, date)
+		return prices, nil, err
+	}
+
+	cached, _, err := readCachedPrices(ctx, client, p.TableName, key, p.Now())
+	if err != nil {
+		slog.Error("Error reading price cache", "error", err)
+	}
+
+	prices, err := p.Provider.FetchPrices(ctx, date)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(prices) == 0 {
+		return prices, cached, nil
+	}
+
+	// Replace the cached prices with the revised ones
+	err = writeCachedPrices(ctx, client, p.TableName, key, date, prices, p.Location)
+	if err != nil {
+		slog.Error("Error writing price cache", "error", err)
+	}
+
+	return prices, cached, nil
+}
+
+func readCachedPrices(ctx context.Context, client *dynamodb.Client, tableName string, key string, now time.Time) ([]ElectricityPrice, bool, error) {
+	output, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("error reading prices from DynamoDB: %w", err)
+	}
+
+	if output.Item == nil {
+		return nil, false, nil
+	}
+
+	// DynamoDB deletes expired items lazily, so check the TTL ourselves
+	if value, ok := output.Item["expires_at"].(*types.AttributeValueMemberN); ok {
+		expiresAt, err := strconv.ParseInt(value.Value, 10, 64)
+		if err == nil && now.Unix() >= expiresAt {
+			return nil, false, nil
+		}
+	}
+
+	value, ok := output.Item["prices"].(*types.AttributeValueMemberS)
+	if !ok {
+		return nil, false, fmt.Errorf("cached item %s has no prices", key)
+	}
+
+	var prices []ElectricityPrice
+
+	err = json.Unmarshal([]byte(value.Value), &prices)
+	if err != nil {
+		return nil, false, fmt.Errorf("error decoding cached prices: %w", err)
+	}
+
+	return prices, true, nil
+}
+
+func deleteCachedPrices(ctx context.Context, client *dynamodb.Client, tableName string, key string) error {
+	_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting prices from DynamoDB: %w", err)
+	}
+
+	return nil
+}
+
+func writeCachedPrices(ctx context.Context, client *dynamodb.Client, tableName string, key string, date string, prices []ElectricityPrice, location *time.Location) error {
+	// Expire the entry at the end of the price day
+	day, err := time.ParseInLocation("2006-01-02", date, location)
+	if err != nil {
+		return fmt.Errorf("error parsing date %q: %w", date, err)
+	}
+
+	expiresAt := day.AddDate(0, 0, 1)
+
+	data, err := json.Marshal(prices)
+	if err != nil {
+		return fmt.Errorf("error marshaling prices: %w", err)
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]types.AttributeValue{
+			"id":         &types.AttributeValueMemberS{Value: key},
+			"prices":     &types.AttributeValueMemberS{Value: string(data)},
+			"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error writing prices to DynamoDB: %w", err)
+	}
+
+	return nil
+}
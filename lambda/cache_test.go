@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Attribute values as the DynamoDB JSON protocol encodes them, e.g. {"S": "x"}
+type fakeItem map[string]map[string]any
+
+// DynamoDB stand-in holding items by id, speaking the JSON protocol the SDK
+// uses, reached through AWS_ENDPOINT_URL
+type fakeDynamoDB struct {
+	mu         sync.Mutex
+	items      map[string]fakeItem
+	operations []string
+}
+
+func newFakeDynamoDB(t *testing.T) *fakeDynamoDB {
+	t.Helper()
+
+	isolateAWS(t)
+
+	fake := &fakeDynamoDB{items: map[string]fakeItem{}}
+	server := httptest.NewServer(http.HandlerFunc(fake.serve))
+	t.Cleanup(server.Close)
+	t.Setenv("AWS_ENDPOINT_URL", server.URL)
+	resetAWSClients(t)
+
+	return fake
+}
+
+func (f *fakeDynamoDB) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	f.operations = append(f.operations, operation)
+
+	var request struct {
+		Key                       fakeItem
+		Item                      fakeItem
+		ConditionExpression       string
+		ExpressionAttributeValues fakeItem
+	}
+	json.NewDecoder(r.Body).Decode(&request)
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	response := map[string]any{}
+
+	switch operation {
+	case "GetItem":
+		if item, ok := f.items[request.Key.id()]; ok {
+			response["Item"] = item
+		}
+	case "PutItem":
+		// The only condition used is attribute_not_exists(id)
+		if _, ok := f.items[request.Item.id()]; ok && request.ConditionExpression != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"__type":  "com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException",
+				"message": "The conditional request failed",
+			})
+			return
+		}
+		f.items[request.Item.id()] = request.Item
+	case "DeleteItem":
+		delete(f.items, request.Key.id())
+	case "UpdateItem":
+		// The only update used is ADD #sequence :one
+		item, ok := f.items[request.Key.id()]
+		if !ok {
+			item = fakeItem{"id": {"S": request.Key.id()}}
+			f.items[request.Key.id()] = item
+		}
+		sequence, _ := strconv.Atoi(item.number("sequence"))
+		step, _ := strconv.Atoi(request.ExpressionAttributeValues.number(":one"))
+		item["sequence"] = map[string]any{"N": strconv.Itoa(sequence + step)}
+		response["Attributes"] = fakeItem{"sequence": item["sequence"]}
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+// Store prices under the cache key like writeCachedPrices does
+func (f *fakeDynamoDB) putPrices(t *testing.T, key string, prices []ElectricityPrice) {
+	t.Helper()
+
+	data, err := json.Marshal(prices)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.items[key] = fakeItem{"id": {"S": key}, "prices": {"S": string(data)}}
+}
+
+// Store an item as is, for attributes the code under test only reads
+func (f *fakeDynamoDB) putItem(item fakeItem) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.items[item.id()] = item
+}
+
+func (item fakeItem) id() string {
+	value, _ := item["id"]["S"].(string)
+	return value
+}
+
+func (item fakeItem) number(name string) string {
+	value, _ := item[name]["N"].(string)
+	return value
+}
+
+func (f *fakeDynamoDB) calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.operations...)
+}
+
+func TestCachingProviderInvalidatesEmptyEntry(t *testing.T) {
+	dynamo := newFakeDynamoDB(t)
+	dynamo.putPrices(t, "frankenergie#2024-01-02", []ElectricityPrice{})
+
+	location, err := time.LoadLocation(PRICE_TIMEZONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+	fresh := dayPrices(t, now, -0.05)
+	upstream := &fakeProvider{prices: map[string][]ElectricityPrice{"2024-01-02": fresh}}
+	provider := &CachingProvider{Provider: upstream, Name: "frankenergie", TableName: "prices", Location: location, Now: func() time.Time { return now }}
+
+	prices, err := provider.FetchPrices(context.Background(), "2024-01-02")
+	if err != nil {
+		t.Fatalf("FetchPrices: %v", err)
+	}
+
+	if len(prices) != len(fresh) {
+		t.Fatalf("got %d prices, want the %d fresh ones", len(prices), len(fresh))
+	}
+
+	if got := strings.Join(dynamo.calls(), ","); got != "GetItem,DeleteItem,PutItem" {
+		t.Errorf("DynamoDB calls = %s, want the empty entry read, deleted and replaced", got)
+	}
+
+	// The next fetch is served from the repaired cache
+	if _, err := provider.FetchPrices(context.Background(), "2024-01-02"); err != nil {
+		t.Fatalf("second FetchPrices: %v", err)
+	}
+	if len(upstream.requested) != 1 {
+		t.Errorf("upstream fetched %d times, want once", len(upstream.requested))
+	}
+}
+
+func TestGetCurrentPriceEmptyList(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+
+	for _, prices := range [][]ElectricityPrice{nil, {}} {
+		_, err := getCurrentPrice(prices, now)
+		if err == nil || !strings.Contains(err.Error(), "price list is empty") {
+			t.Errorf("getCurrentPrice(%#v) error = %v, want the empty list reported", prices, err)
+		}
+	}
+
+	// A missing period is reported differently from an empty list
+	_, err := getCurrentPrice(hourlyPrices(now.Add(2*time.Hour), 0.01), now)
+	if err == nil || strings.Contains(err.Error(), "price list is empty") {
+		t.Errorf("getCurrentPrice error = %v, want the missing period reported", err)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// Run the decision pipeline from the command line and print the result
+func runCLI(args []string) int {
+	flags := flag.NewFlagSet("solar-controller", flag.ContinueOnError)
+	date := flags.String("date", "", "price date to evaluate (YYYY-MM-DD), at the current time of day")
+	provider := flags.String("provider", "", "price provider, overrides PRICE_PROVIDER")
+	dryRun := flags.Bool("dry-run", false, "log the command instead of publishing it")
+	asOf := flags.String("as-of", "", "evaluate at this RFC3339 timestamp, overrides AS_OF")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	if *date != "" {
+		if _, err := time.Parse("2006-01-02", *date); err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --date %q, expected YYYY-MM-DD\n", *date)
+			return 2
+		}
+	}
+
+	var clock func() time.Time
+
+	if *asOf != "" {
+		var err error
+
+		clock, err = fixedClock(*asOf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid --as-of %q, expected RFC3339 such as 2024-01-02T13:00:00+01:00\n", *asOf)
+			return 2
+		}
+	}
+
+	// Environment variables provide the defaults, flags override them
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("Error loading configuration", "error", err)
+		return 1
+	}
+
+	cfg.Date = *date
+	if clock != nil {
+		cfg.Now = clock
+	}
+	cfg.DryRun = cfg.DryRun || *dryRun || clock != nil
+	if *provider != "" {
+		cfg.PriceProvider = *provider
+	}
+
+	result, err := Run(context.Background(), cfg)
+	if err != nil {
+		slog.Error("Run failed", "error", err)
+		return 1
+	}
+
+	output, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		slog.Error("Error marshaling result", "error", err)
+		return 1
+	}
+
+	fmt.Println(string(output))
+	return 0
+}
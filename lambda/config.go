@@ -0,0 +1,1062 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Named part of the total fee, e.g. ENERGY_TAX
+type FeeComponent struct {
+	Name  string
+	Value float64
+}
+
+// Local hours [Start, End) during which control is active, wrapping past
+// midnight when End is before Start
+type HourRange struct {
+	Start int
+	End   int
+}
+
+func (r HourRange) Contains(hour int) bool {
+	if r.Start <= r.End {
+		return hour >= r.Start && hour < r.End
+	}
+
+	return hour >= r.Start || hour < r.End
+}
+
+func (r HourRange) String() string {
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// Parse an hour range such as "8-20"
+func parseHourRange(value string) (HourRange, error) {
+	start, end, found := strings.Cut(value, "-")
+	if !found {
+		return HourRange{}, fmt.Errorf("expected START-END")
+	}
+
+	var r HourRange
+	var err error
+
+	r.Start, err = strconv.Atoi(strings.TrimSpace(start))
+	if err != nil {
+		return HourRange{}, err
+	}
+
+	r.End, err = strconv.Atoi(strings.TrimSpace(end))
+	if err != nil {
+		return HourRange{}, err
+	}
+
+	if r.Start < 0 || r.Start > 23 || r.End < 0 || r.End > 24 || r.Start == r.End {
+		return HourRange{}, fmt.Errorf("hours must be distinct, from 0 to 23 and 24 at most")
+	}
+
+	return r, nil
+}
+
+// Per-device overrides of the global threshold and polarity
+type DeviceConfig struct {
+	Threshold *float64 `json:"threshold"`
+	Invert    *bool    `json:"invert"`
+}
+
+// Runtime configuration, read from environment variables
+type Config struct {
+	FeedInFee            float64
+	FeeComponents        []FeeComponent
+	Currency             string
+	DisableThreshold     float64
+	WeekdayThreshold     float64
+	WeekendThreshold     float64
+	ThresholdMode        ThresholdMode
+	Strategy             string
+	CheapestN            int
+	RelativePercent      float64
+	SwitchHysteresis     float64
+	StateTable           string
+	StateStoreKind       string
+	StateStore           StateStore
+	ShellyClientIds      []string
+	GasClientIds         []string
+	GasThreshold         float64
+	Devices              map[string]DeviceConfig
+	FetchRetry           RetryPolicy
+	HTTPTimeout          time.Duration
+	CABundlePath         string
+	RootCAs              *x509.CertPool
+	PublishRetry         RetryPolicy
+	PublishJitter        time.Duration
+	DryRun               bool
+	PriceProvider        string
+	BackupPriceProviders []string
+	PriceValidation      string
+	FreshnessTolerance   time.Duration
+	FrankEnergieURL      string
+	TibberToken          string
+	TibberHomeId         string
+	EntsoeToken          string
+	EntsoeBiddingZone    string
+	NordPoolArea         string
+	NordPoolCurrency     string
+	PriceCacheTable      string
+	RevalidatePrices     bool
+	MetricsNamespace     string
+	ConfirmTimeout       time.Duration
+	LegacyPayload        bool
+	InvertCommand        bool
+	MqttQos              int32
+	MqttRetain           bool
+	TelegramBotToken     string
+	TelegramChatId       string
+	WebhookURL           string
+	WebhookSecret        string
+	DefaultOnMissing     string
+	SafeState            string
+	MinStateDuration     time.Duration
+	SkipUnchanged        bool
+	IdempotencyTTL       time.Duration
+	TopicTemplate        string
+	GroupTopic           string
+	PublishStatus        bool
+	PublishErrors        bool
+	DecisionTopicArn     string
+	DecisionLogBucket    string
+	ObjectStore          ObjectStore
+	TransitionEventBus   string
+	EventPutter          EventPutter
+	SwitchChannel        int
+	DecisionWindow       int
+	PreWindow            time.Duration
+	Date                 string
+	BreakerThreshold     int
+	BreakerCooldown      time.Duration
+	BatterySOCURL        string
+	BatterySOCThreshold  float64
+	ForecastURL          string
+	ForecastProbability  float64
+	ForecastMargin       float64
+	InverterKw           float64
+	Transport            string
+	ControlMode          string
+	ShadowName           string
+	ControlType          string
+	CurtailTopic         string
+	CurtailSpan          float64
+	IotEndpoint          string
+	IotTargets           []IoTTarget
+	IoTClients           func(ctx context.Context, target IoTTarget) (IoTClient, error)
+	ShellyCloudURL       string
+	ShellyCloudAuthKey   string
+	Location             string
+	ControlHours         *HourRange
+	Now                  func() time.Time
+	Reconcile            bool
+}
+
+func loadConfig() (Config, error) {
+	var cfg Config
+	var err error
+
+	// Label for the price currency, only used in logs and messages
+	cfg.Currency = getEnvString("CURRENCY", DEFAULT_CURRENCY)
+
+	// Fee components per kWh in the price currency, summed into the fee added
+	// to the market price; the feed-in fee falls back to the contract default
+	for _, component := range []struct {
+		name         string
+		defaultValue float64
+	}{
+		{"FEED_IN_FEE", DEFAULT_FEED_IN_FEE},
+		{"ENERGY_TAX", 0},
+		{"ODE", 0},
+		{"SUPPLIER_MARKUP", 0},
+	} {
+		value, err := getEnvFloat(component.name, component.defaultValue)
+		if err != nil {
+			return cfg, err
+		}
+
+		cfg.FeeComponents = append(cfg.FeeComponents, FeeComponent{Name: component.name, Value: value})
+		cfg.FeedInFee += value
+	}
+
+	// Disable solar when the effective price drops below this value
+	cfg.DisableThreshold, err = getEnvFloat("DISABLE_THRESHOLD", 0)
+	if err != nil {
+		return cfg, err
+	}
+
+	if math.IsNaN(cfg.DisableThreshold) || math.IsInf(cfg.DisableThreshold, 0) {
+		return cfg, fmt.Errorf("DISABLE_THRESHOLD must be a finite number, got %v", cfg.DisableThreshold)
+	}
+
+	// Separate thresholds for Monday to Friday and the weekend, each falling
+	// back to DISABLE_THRESHOLD
+	cfg.WeekdayThreshold, err = getEnvFloat("WEEKDAY_THRESHOLD", cfg.DisableThreshold)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.WeekendThreshold, err = getEnvFloat("WEEKEND_THRESHOLD", cfg.DisableThreshold)
+	if err != nil {
+		return cfg, err
+	}
+
+	for name, value := range map[string]float64{"WEEKDAY_THRESHOLD": cfg.WeekdayThreshold, "WEEKEND_THRESHOLD": cfg.WeekendThreshold} {
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return cfg, fmt.Errorf("%s must be a finite number, got %v", name, value)
+		}
+	}
+
+	// Also disable solar when the effective price equals the threshold
+	cfg.ThresholdMode.Inclusive, err = getEnvBool("THRESHOLD_INCLUSIVE", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Tolerance within which a price counts as equal to the threshold
+	cfg.ThresholdMode.Epsilon, err = getEnvFloat("THRESHOLD_EPSILON", DEFAULT_THRESHOLD_EPSILON)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.ThresholdMode.Epsilon < 0 || math.IsNaN(cfg.ThresholdMode.Epsilon) {
+		return cfg, fmt.Errorf("THRESHOLD_EPSILON must not be negative, got %v", cfg.ThresholdMode.Epsilon)
+	}
+
+	// Treat a negative-price window as started this many minutes ahead of it
+	preWindowMinutes, err := getEnvInt("PRE_WINDOW_MINUTES", 0)
+	if err != nil {
+		return cfg, err
+	}
+
+	if preWindowMinutes < 0 {
+		return cfg, fmt.Errorf("PRE_WINDOW_MINUTES must not be negative, got %d", preWindowMinutes)
+	}
+
+	cfg.PreWindow = time.Duration(preWindowMinutes) * time.Minute
+
+	// Decision strategy: a price threshold, the day's cheapest N periods, or a
+	// percentage of the day's median price
+	cfg.Strategy = getEnvString("STRATEGY", "threshold")
+
+	switch cfg.Strategy {
+	case "threshold":
+	case "cheapest-n":
+		cfg.CheapestN, err = getEnvInt("CHEAPEST_N", 0)
+		if err != nil {
+			return cfg, err
+		}
+
+		if cfg.CheapestN < 1 {
+			return cfg, fmt.Errorf("STRATEGY=cheapest-n requires CHEAPEST_N of at least 1, got %d", cfg.CheapestN)
+		}
+	case "relative":
+		cfg.RelativePercent, err = getEnvFloat("RELATIVE_THRESHOLD_PERCENT", 0)
+		if err != nil {
+			return cfg, err
+		}
+
+		if cfg.RelativePercent <= 0 {
+			return cfg, fmt.Errorf("STRATEGY=relative requires a positive RELATIVE_THRESHOLD_PERCENT, got %g", cfg.RelativePercent)
+		}
+	default:
+		return cfg, fmt.Errorf("STRATEGY must be threshold, cheapest-n or relative, got %q", cfg.Strategy)
+	}
+
+	// Number of periods, starting at the current one, averaged for the decision
+	cfg.DecisionWindow, err = getEnvInt("DECISION_WINDOW", 1)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.DecisionWindow < 1 {
+		return cfg, fmt.Errorf("DECISION_WINDOW must be at least 1, got %d", cfg.DecisionWindow)
+	}
+
+	// Dead-band around the threshold to avoid rapid switching
+	cfg.SwitchHysteresis, err = getEnvFloat("SWITCH_HYSTERESIS", 0)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.SwitchHysteresis < 0 {
+		return cfg, fmt.Errorf("SWITCH_HYSTERESIS must not be negative, got %v", cfg.SwitchHysteresis)
+	}
+
+	// DynamoDB table holding the last command state
+	cfg.StateTable = os.Getenv("STATE_TABLE")
+
+	// Where state is kept: the table when set, nowhere otherwise, or in the
+	// process for long-lived deployments
+	defaultStateStore := "none"
+	if cfg.StateTable != "" {
+		defaultStateStore = "dynamodb"
+	}
+
+	cfg.StateStoreKind = getEnvString("STATE_STORE", defaultStateStore)
+
+	switch cfg.StateStoreKind {
+	case "none", "memory":
+	case "dynamodb":
+		if cfg.StateTable == "" {
+			return cfg, fmt.Errorf("STATE_STORE=dynamodb requires STATE_TABLE")
+		}
+	default:
+		return cfg, fmt.Errorf("STATE_STORE must be dynamodb, memory or none, got %q", cfg.StateStoreKind)
+	}
+
+	// Shelly devices to control, falling back to the single-device variable
+	cfg.ShellyClientIds = getEnvList("SHELLY_CLIENT_IDS")
+	if len(cfg.ShellyClientIds) == 0 {
+		cfg.ShellyClientIds = getEnvList("SHELLY_CLIENT_ID")
+	}
+
+	// Devices behind further IoT Core endpoints, e.g. in other accounts,
+	// controlled with the same decision as SHELLY_CLIENT_IDS
+	iotTargets := os.Getenv("IOT_TARGETS")
+	if iotTargets != "" {
+		decoder := json.NewDecoder(strings.NewReader(iotTargets))
+		decoder.DisallowUnknownFields()
+
+		err = decoder.Decode(&cfg.IotTargets)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid value for IOT_TARGETS: %w", err)
+		}
+
+		var targetClientIds []string
+
+		for i, target := range cfg.IotTargets {
+			if target.Endpoint == "" {
+				return cfg, fmt.Errorf("IOT_TARGETS entry %d has no endpoint", i)
+			}
+			if len(target.ClientIds) == 0 {
+				return cfg, fmt.Errorf("IOT_TARGETS entry %d for %s has no clientIds", i, target.Endpoint)
+			}
+
+			for _, clientId := range target.ClientIds {
+				if slices.Contains(targetClientIds, clientId) {
+					return cfg, fmt.Errorf("IOT_TARGETS lists device %q more than once", clientId)
+				}
+				targetClientIds = append(targetClientIds, clientId)
+
+				if !slices.Contains(cfg.ShellyClientIds, clientId) {
+					cfg.ShellyClientIds = append(cfg.ShellyClientIds, clientId)
+				}
+			}
+		}
+	}
+
+	// Devices switched on Frank Energie's gas price, gas control is off without them
+	cfg.GasClientIds = getEnvList("GAS_CLIENT_IDS")
+
+	// Switch the gas devices on while the gas price is below this value per m3
+	cfg.GasThreshold, err = getEnvFloat("GAS_THRESHOLD", 0)
+	if err != nil {
+		return cfg, err
+	}
+
+	for _, clientId := range cfg.GasClientIds {
+		if slices.Contains(cfg.ShellyClientIds, clientId) {
+			return cfg, fmt.Errorf("GAS_CLIENT_IDS entry %q is also in SHELLY_CLIENT_IDS", clientId)
+		}
+	}
+
+	// Retry behaviour for the price API
+	cfg.FetchRetry.MaxAttempts, err = getEnvInt("FETCH_MAX_ATTEMPTS", 3)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.FetchRetry.MaxAttempts < 1 {
+		return cfg, fmt.Errorf("FETCH_MAX_ATTEMPTS must be at least 1, got %d", cfg.FetchRetry.MaxAttempts)
+	}
+
+	cfg.FetchRetry.BaseDelay, err = getEnvDuration("FETCH_RETRY_DELAY", time.Second)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Timeout of every outbound HTTP request, each retry attempt separately
+	cfg.HTTPTimeout, err = getEnvDuration("HTTP_TIMEOUT", HTTP_CLIENT_TIMEOUT)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.HTTPTimeout <= 0 {
+		return cfg, fmt.Errorf("HTTP_TIMEOUT must be positive, got %s", cfg.HTTPTimeout)
+	}
+
+	// Extra roots for TLS-intercepting proxies; the proxy itself comes from
+	// HTTPS_PROXY, HTTP_PROXY and NO_PROXY
+	cfg.CABundlePath = os.Getenv("CA_BUNDLE_PATH")
+
+	if cfg.CABundlePath != "" {
+		cfg.RootCAs, err = loadCABundle(cfg.CABundlePath)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid value %q for CA_BUNDLE_PATH: %w", cfg.CABundlePath, err)
+		}
+	}
+
+	// Retry behaviour for publishing commands to IoT Core
+	cfg.PublishRetry.MaxAttempts, err = getEnvInt("PUBLISH_MAX_ATTEMPTS", 3)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.PublishRetry.MaxAttempts < 1 {
+		return cfg, fmt.Errorf("PUBLISH_MAX_ATTEMPTS must be at least 1, got %d", cfg.PublishRetry.MaxAttempts)
+	}
+
+	cfg.PublishRetry.BaseDelay, err = getEnvDuration("PUBLISH_RETRY_DELAY", time.Second)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Spread the publishes of a fleet of controllers over up to this many milliseconds
+	publishJitterMs, err := getEnvInt("PUBLISH_JITTER_MS", 0)
+	if err != nil {
+		return cfg, err
+	}
+
+	cfg.PublishJitter = time.Duration(publishJitterMs) * time.Millisecond
+	if cfg.PublishJitter < 0 || cfg.PublishJitter > MAX_PUBLISH_JITTER {
+		return cfg, fmt.Errorf("PUBLISH_JITTER_MS must be between 0 and %d, got %d", MAX_PUBLISH_JITTER.Milliseconds(), publishJitterMs)
+	}
+
+	// Price source and its credentials
+	cfg.PriceProvider = getEnvString("PRICE_PROVIDER", "frankenergie")
+
+	// Providers tried in order when PRICE_PROVIDER fails after its retries
+	cfg.BackupPriceProviders = getEnvList("BACKUP_PRICE_PROVIDERS")
+
+	// How to treat unsorted, overlapping or non-contiguous price periods
+	cfg.PriceValidation = getEnvString("PRICE_VALIDATION", "warn")
+
+	switch cfg.PriceValidation {
+	case "warn", "error":
+	default:
+		return cfg, fmt.Errorf("PRICE_VALIDATION must be warn or error, got %q", cfg.PriceValidation)
+	}
+
+	// How far past the end of the latest period its price may still be used
+	cfg.FreshnessTolerance, err = getEnvDuration("PRICE_FRESHNESS_TOLERANCE", 0)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.FreshnessTolerance < 0 || cfg.FreshnessTolerance > time.Hour {
+		return cfg, fmt.Errorf("PRICE_FRESHNESS_TOLERANCE must be between 0 and 1h, got %s", cfg.FreshnessTolerance)
+	}
+
+	cfg.FrankEnergieURL = getEnvString("FRANK_ENERGIE_URL", FRANK_ENERGIE_API_URL)
+
+	parsedURL, err := url.Parse(cfg.FrankEnergieURL)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid FRANK_ENERGIE_URL %q: %w", cfg.FrankEnergieURL, err)
+	}
+
+	if parsedURL.Scheme != "https" || parsedURL.Host == "" {
+		return cfg, fmt.Errorf("FRANK_ENERGIE_URL must be an absolute https URL, got %q", cfg.FrankEnergieURL)
+	}
+
+	cfg.TibberToken = os.Getenv("TIBBER_TOKEN")
+	cfg.TibberHomeId = os.Getenv("TIBBER_HOME_ID")
+	cfg.EntsoeToken = os.Getenv("ENTSOE_TOKEN")
+	cfg.EntsoeBiddingZone = getEnvString("ENTSOE_BIDDING_ZONE", ENTSOE_DEFAULT_ZONE)
+	cfg.NordPoolArea = os.Getenv("NORDPOOL_AREA")
+	cfg.NordPoolCurrency = getEnvString("NORDPOOL_CURRENCY", cfg.Currency)
+
+	// The fee and threshold are in CURRENCY, so the prices must be as well
+	if slices.Contains(append([]string{cfg.PriceProvider}, cfg.BackupPriceProviders...), "nordpool") && cfg.NordPoolCurrency != cfg.Currency {
+		return cfg, fmt.Errorf("NORDPOOL_CURRENCY %q must match CURRENCY %q", cfg.NordPoolCurrency, cfg.Currency)
+	}
+
+	// Time zone defining the price day, independent of the runtime's TZ
+	cfg.Location = getEnvString("LOCATION", PRICE_TIMEZONE)
+
+	_, err = time.LoadLocation(cfg.Location)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid value %q for LOCATION: %w", cfg.Location, err)
+	}
+
+	// Local hours in LOCATION during which the relay is controlled, always when unset
+	if value := os.Getenv("CONTROL_HOURS"); value != "" {
+		controlHours, err := parseHourRange(value)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid value %q for CONTROL_HOURS: %w", value, err)
+		}
+		cfg.ControlHours = &controlHours
+	}
+
+	// Clock used for the decision, pinned by AS_OF to replay a past moment
+	cfg.Now = time.Now
+
+	if asOf := os.Getenv("AS_OF"); asOf != "" {
+		cfg.Now, err = fixedClock(asOf)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid value %q for AS_OF, expected RFC3339 such as 2024-01-02T13:00:00+01:00: %w", asOf, err)
+		}
+	}
+
+	// Delivery mechanism for commands: IoT Core MQTT or Shelly Cloud
+	cfg.Transport = getEnvString("TRANSPORT", "iot")
+
+	// Per-device threshold and polarity overrides, keyed by client ID
+	deviceConfig := os.Getenv("DEVICE_CONFIG")
+	if deviceConfig != "" {
+		// Reject unknown keys, a typo would otherwise silently fall back to the defaults
+		decoder := json.NewDecoder(strings.NewReader(deviceConfig))
+		decoder.DisallowUnknownFields()
+
+		err = decoder.Decode(&cfg.Devices)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid DEVICE_CONFIG: %w", err)
+		}
+
+		for clientId := range cfg.Devices {
+			if !slices.Contains(cfg.ShellyClientIds, clientId) {
+				return cfg, fmt.Errorf("DEVICE_CONFIG entry %q is not in SHELLY_CLIENT_IDS", clientId)
+			}
+		}
+	}
+
+	// Single topic all devices subscribe to, replacing the per-device topics
+	cfg.GroupTopic = os.Getenv("GROUP_TOPIC")
+	cfg.IotEndpoint = os.Getenv("IOT_ENDPOINT")
+	cfg.ShellyCloudURL = os.Getenv("SHELLY_CLOUD_URL")
+	cfg.ShellyCloudAuthKey = os.Getenv("SHELLY_CLOUD_AUTH_KEY")
+
+	switch cfg.Transport {
+	case "iot", "shellycloud":
+	default:
+		return cfg, fmt.Errorf("TRANSPORT must be iot or shellycloud, got %q", cfg.Transport)
+	}
+
+	// Publish a status message to {clientId}/status/controller after every run
+	cfg.PublishStatus, err = getEnvBool("PUBLISH_STATUS", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.PublishStatus && cfg.Transport != "iot" {
+		return cfg, fmt.Errorf("PUBLISH_STATUS requires TRANSPORT=iot, got %q", cfg.Transport)
+	}
+
+	// Publish an error notice to {clientId}/status/error when a run fails
+	cfg.PublishErrors, err = getEnvBool("PUBLISH_ERRORS", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.PublishErrors && cfg.Transport != "iot" {
+		return cfg, fmt.Errorf("PUBLISH_ERRORS requires TRANSPORT=iot, got %q", cfg.Transport)
+	}
+
+	if cfg.GroupTopic != "" && cfg.Transport != "iot" {
+		return cfg, fmt.Errorf("GROUP_TOPIC requires TRANSPORT=iot, got %q", cfg.Transport)
+	}
+
+	if cfg.GroupTopic != "" && len(cfg.Devices) > 0 {
+		return cfg, fmt.Errorf("GROUP_TOPIC publishes one command to every device and can't be combined with DEVICE_CONFIG")
+	}
+
+	if len(cfg.IotTargets) > 0 && cfg.Transport != "iot" {
+		return cfg, fmt.Errorf("IOT_TARGETS requires TRANSPORT=iot, got %q", cfg.Transport)
+	}
+
+	if len(cfg.IotTargets) > 0 && cfg.GroupTopic != "" {
+		return cfg, fmt.Errorf("GROUP_TOPIC publishes to a single endpoint and can't be combined with IOT_TARGETS")
+	}
+
+	// How IoT Core reaches the devices: a command topic or the desired shadow state
+	cfg.ControlMode = getEnvString("CONTROL_MODE", "topic")
+	cfg.ShadowName = os.Getenv("SHADOW_NAME")
+
+	switch cfg.ControlMode {
+	case "topic":
+	case "shadow":
+		if cfg.Transport != "iot" {
+			return cfg, fmt.Errorf("CONTROL_MODE=shadow requires TRANSPORT=iot, got %q", cfg.Transport)
+		}
+		if cfg.GroupTopic != "" {
+			return cfg, fmt.Errorf("CONTROL_MODE=shadow updates each device's shadow and can't be combined with GROUP_TOPIC")
+		}
+		if len(cfg.IotTargets) > 0 {
+			return cfg, fmt.Errorf("CONTROL_MODE=shadow can't be combined with IOT_TARGETS")
+		}
+	default:
+		return cfg, fmt.Errorf("CONTROL_MODE must be topic or shadow, got %q", cfg.ControlMode)
+	}
+
+	// DynamoDB table caching a day's prices
+	cfg.PriceCacheTable = os.Getenv("PRICE_CACHE_TABLE")
+
+	// Always re-fetch and compare against the cache to catch revised prices
+	cfg.RevalidatePrices, err = getEnvBool("REVALIDATE_PRICES", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.RevalidatePrices && cfg.PriceCacheTable == "" {
+		return cfg, fmt.Errorf("REVALIDATE_PRICES requires PRICE_CACHE_TABLE to compare against")
+	}
+
+	// CloudWatch namespace for the decision metrics
+	cfg.MetricsNamespace = getEnvString("METRICS_NAMESPACE", "SolarController")
+
+	// Publish the bare "on"/"off" string instead of a JSON IoTCommand
+	cfg.LegacyPayload, err = getEnvBool("LEGACY_PAYLOAD", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Flip the on/off mapping for relays wired normally-closed
+	cfg.InvertCommand, err = getEnvBool("INVERT_COMMAND", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	// MQTT QoS for commands, the Data Plane API only supports 0 and 1
+	qos, err := getEnvInt("MQTT_QOS", 1)
+	if err != nil {
+		return cfg, err
+	}
+
+	if qos != 0 && qos != 1 {
+		return cfg, fmt.Errorf("MQTT_QOS must be 0 or 1, got %d", qos)
+	}
+
+	cfg.MqttQos = int32(qos)
+
+	// Retain the last command so devices get it on reconnect
+	cfg.MqttRetain, err = getEnvBool("MQTT_RETAIN", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Minimum time between state changes, 0 disables the check
+	cfg.MinStateDuration, err = getEnvDuration("MIN_STATE_DURATION", 0)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Skip the publish when the decision matches the last published state
+	cfg.SkipUnchanged, err = getEnvBool("SKIP_UNCHANGED", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.SkipUnchanged && cfg.StateStoreKind == "none" {
+		return cfg, fmt.Errorf("SKIP_UNCHANGED requires STATE_TABLE or STATE_STORE to know the last published state")
+	}
+
+	// Lifetime of the per-period idempotency keys, 0 disables the guard
+	cfg.IdempotencyTTL, err = getEnvDuration("IDEMPOTENCY_TTL", 0)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.IdempotencyTTL > 0 && cfg.StateStoreKind == "none" {
+		return cfg, fmt.Errorf("IDEMPOTENCY_TTL requires STATE_TABLE or STATE_STORE to store the keys")
+	}
+
+	// Switch the relay, or publish a percentage output limit for inverters
+	// that support curtailment
+	cfg.ControlType = getEnvString("CONTROL_TYPE", "relay")
+
+	switch cfg.ControlType {
+	case "relay":
+	case "curtail":
+		cfg.CurtailTopic = os.Getenv("CURTAIL_TOPIC")
+		if !strings.Contains(cfg.CurtailTopic, CLIENT_ID_PLACEHOLDER) {
+			return cfg, fmt.Errorf("CONTROL_TYPE=curtail requires CURTAIL_TOPIC with the %s placeholder, got %q", CLIENT_ID_PLACEHOLDER, cfg.CurtailTopic)
+		}
+
+		// Distance below the threshold at which the output reaches 0%
+		cfg.CurtailSpan, err = getEnvFloat("CURTAIL_SPAN", 0.05)
+		if err != nil {
+			return cfg, err
+		}
+
+		if !(cfg.CurtailSpan > 0) || math.IsInf(cfg.CurtailSpan, 0) {
+			return cfg, fmt.Errorf("CURTAIL_SPAN must be a positive number, got %v", cfg.CurtailSpan)
+		}
+
+		if cfg.Transport != "iot" || cfg.ControlMode != "topic" {
+			return cfg, fmt.Errorf("CONTROL_TYPE=curtail requires TRANSPORT=iot and CONTROL_MODE=topic")
+		}
+
+		// These decide per device or on the binary state alone
+		if cfg.GroupTopic != "" || len(cfg.Devices) > 0 || cfg.SkipUnchanged {
+			return cfg, fmt.Errorf("CONTROL_TYPE=curtail can't be combined with GROUP_TOPIC, DEVICE_CONFIG or SKIP_UNCHANGED")
+		}
+	default:
+		return cfg, fmt.Errorf("CONTROL_TYPE must be relay or curtail, got %q", cfg.ControlType)
+	}
+
+	// Skip fetching for a cooldown after this many consecutive failures, 0 disables
+	cfg.BreakerThreshold, err = getEnvInt("BREAKER_THRESHOLD", 0)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.BreakerThreshold < 0 {
+		return cfg, fmt.Errorf("BREAKER_THRESHOLD must not be negative, got %d", cfg.BreakerThreshold)
+	}
+
+	if cfg.BreakerThreshold > 0 && cfg.StateStoreKind == "none" {
+		return cfg, fmt.Errorf("BREAKER_THRESHOLD requires STATE_TABLE or STATE_STORE to persist failures")
+	}
+
+	cfg.BreakerCooldown, err = getEnvDuration("BREAKER_COOLDOWN", time.Hour)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Battery state-of-charge endpoint, solar is only disabled once the battery is full
+	cfg.BatterySOCURL = os.Getenv("BATTERY_SOC_URL")
+
+	cfg.BatterySOCThreshold, err = getEnvFloat("BATTERY_SOC_THRESHOLD", 95)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.BatterySOCThreshold < 0 || cfg.BatterySOCThreshold > 100 {
+		return cfg, fmt.Errorf("BATTERY_SOC_THRESHOLD must be between 0 and 100, got %g", cfg.BatterySOCThreshold)
+	}
+
+	// Forecast of negative prices in the next hour, disabling solar ahead
+	// of them while the current price is already close to the threshold
+	cfg.ForecastURL = os.Getenv("FORECAST_URL")
+
+	if cfg.ForecastURL != "" {
+		parsedURL, err := url.Parse(cfg.ForecastURL)
+		if err != nil || (parsedURL.Scheme != "https" && parsedURL.Scheme != "http") || parsedURL.Host == "" {
+			return cfg, fmt.Errorf("FORECAST_URL must be an http or https URL")
+		}
+	}
+
+	cfg.ForecastProbability, err = getEnvFloat("FORECAST_PROBABILITY_THRESHOLD", 0.8)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.ForecastProbability <= 0 || cfg.ForecastProbability > 1 {
+		return cfg, fmt.Errorf("FORECAST_PROBABILITY_THRESHOLD must be above 0 and at most 1, got %g", cfg.ForecastProbability)
+	}
+
+	cfg.ForecastMargin, err = getEnvFloat("FORECAST_PRICE_MARGIN", 0.02)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.ForecastMargin < 0 {
+		return cfg, fmt.Errorf("FORECAST_PRICE_MARGIN must not be negative, got %g", cfg.ForecastMargin)
+	}
+
+	// Assumed inverter output for the savings estimate, 0 disables it
+	cfg.InverterKw, err = getEnvFloat("INVERTER_KW", 0)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.InverterKw < 0 {
+		return cfg, fmt.Errorf("INVERTER_KW must not be negative, got %g", cfg.InverterKw)
+	}
+
+	// Behaviour when no price covers the current period
+	cfg.DefaultOnMissing = getEnvString("DEFAULT_ON_MISSING", "error")
+
+	switch cfg.DefaultOnMissing {
+	case "error", "keep", "enable":
+	default:
+		return cfg, fmt.Errorf("DEFAULT_ON_MISSING must be error, keep or enable, got %q", cfg.DefaultOnMissing)
+	}
+
+	// Relay state published when no decision can be made at all, empty to just fail
+	cfg.SafeState = os.Getenv("SAFE_STATE")
+	if cfg.SafeState != "" && cfg.SafeState != "on" && cfg.SafeState != "off" {
+		return cfg, fmt.Errorf("SAFE_STATE must be on or off, got %q", cfg.SafeState)
+	}
+
+	// Telegram notifications on state transitions, enabled when both are set
+	cfg.TelegramBotToken = os.Getenv("TELEGRAM_BOT_TOKEN")
+	cfg.TelegramChatId = os.Getenv("TELEGRAM_CHAT_ID")
+
+	// Webhook receiving the result after every publish, e.g. Home Assistant,
+	// often on the local network, so plain http is allowed
+	cfg.WebhookURL = os.Getenv("WEBHOOK_URL")
+	cfg.WebhookSecret = os.Getenv("WEBHOOK_SECRET")
+
+	if cfg.WebhookURL != "" {
+		parsedURL, err := url.Parse(cfg.WebhookURL)
+		if err != nil || (parsedURL.Scheme != "https" && parsedURL.Scheme != "http") || parsedURL.Host == "" {
+			return cfg, fmt.Errorf("WEBHOOK_URL must be an http or https URL")
+		}
+	}
+
+	// Relay channel on the device, substituted for {channel} in the topic
+	cfg.SwitchChannel, err = getEnvInt("SWITCH_CHANNEL", 0)
+	if err != nil {
+		return cfg, err
+	}
+
+	if cfg.SwitchChannel < 0 {
+		return cfg, fmt.Errorf("SWITCH_CHANNEL must not be negative, got %d", cfg.SwitchChannel)
+	}
+
+	// MQTT command topic, {clientId} is replaced by each device's client ID
+	cfg.TopicTemplate = getEnvString("TOPIC_TEMPLATE", DEFAULT_TOPIC_TEMPLATE)
+
+	if !strings.Contains(cfg.TopicTemplate, CLIENT_ID_PLACEHOLDER) {
+		return cfg, fmt.Errorf("TOPIC_TEMPLATE must contain the %s placeholder, got %q", CLIENT_ID_PLACEHOLDER, cfg.TopicTemplate)
+	}
+
+	// Catch unknown placeholders and wildcards before the first publish
+	err = validateTopic(buildTopic(cfg.TopicTemplate, "client", cfg.SwitchChannel))
+	if err != nil {
+		return cfg, fmt.Errorf("invalid value %q for TOPIC_TEMPLATE: %w", cfg.TopicTemplate, err)
+	}
+
+	if cfg.ControlType == "curtail" {
+		err = validateTopic(buildTopic(cfg.CurtailTopic, "client", cfg.SwitchChannel))
+		if err != nil {
+			return cfg, fmt.Errorf("invalid value %q for CURTAIL_TOPIC: %w", cfg.CurtailTopic, err)
+		}
+	}
+
+	// SNS topic receiving every decision
+	cfg.DecisionTopicArn = os.Getenv("DECISION_SNS_TOPIC_ARN")
+
+	// S3 bucket receiving a JSON line per decision in a daily object
+	cfg.DecisionLogBucket = os.Getenv("DECISION_LOG_BUCKET")
+
+	// EventBridge bus, by name or ARN, receiving an event on every state change
+	cfg.TransitionEventBus = os.Getenv("TRANSITION_EVENT_BUS")
+
+	// Log the command instead of publishing it
+	cfg.DryRun, err = getEnvBool("DRY_RUN", false)
+	if err != nil {
+		return cfg, err
+	}
+
+	// A replayed moment must not switch devices or overwrite the stored state
+	if os.Getenv("AS_OF") != "" {
+		cfg.DryRun = true
+	}
+
+	// Wait this long for the device shadow to confirm the command, 0 disables
+	cfg.ConfirmTimeout, err = getEnvDuration("CONFIRM_TIMEOUT", 0)
+	if err != nil {
+		return cfg, err
+	}
+
+	return cfg, nil
+}
+
+// WEEKEND_THRESHOLD on Saturday and Sunday and WEEKDAY_THRESHOLD otherwise,
+// by the calendar day of local
+func dayThreshold(cfg Config, local time.Time) float64 {
+	switch local.Weekday() {
+	case time.Saturday, time.Sunday:
+		return cfg.WeekendThreshold
+	default:
+		return cfg.WeekdayThreshold
+	}
+}
+
+func getEnvString(name string, fallback string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
+
+func getEnvFloat(name string, fallback float64) (float64, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+	}
+
+	return parsed, nil
+}
+
+func getEnvList(name string) []string {
+	var values []string
+
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		value = strings.TrimSpace(value)
+		if value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+func getEnvBool(name string, fallback bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+	}
+
+	return parsed, nil
+}
+
+func getEnvInt(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+	}
+
+	return parsed, nil
+}
+
+func getEnvDuration(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for %s: %w", value, name, err)
+	}
+
+	return parsed, nil
+}
+
+// Check that everything the selected provider and transport need is set,
+// reporting all missing variables at once before any API is called
+func validateConfig(cfg Config) error {
+	var missing []string
+
+	if len(cfg.ShellyClientIds) == 0 {
+		missing = append(missing, "SHELLY_CLIENT_IDS (or SHELLY_CLIENT_ID)")
+	}
+
+	// Backups are checked too, they must work once the primary fails
+	for _, provider := range append([]string{cfg.PriceProvider}, cfg.BackupPriceProviders...) {
+		switch provider {
+		case "tibber":
+			if cfg.TibberToken == "" {
+				missing = append(missing, "TIBBER_TOKEN")
+			}
+		case "entsoe":
+			if cfg.EntsoeToken == "" {
+				missing = append(missing, "ENTSOE_TOKEN")
+			}
+		case "nordpool":
+			if cfg.NordPoolArea == "" {
+				missing = append(missing, "NORDPOOL_AREA")
+			}
+		}
+	}
+
+	// Dry runs never reach the transport
+	if !cfg.DryRun {
+		switch cfg.Transport {
+		case "iot":
+			if cfg.IotEndpoint == "" && hasDefaultEndpointDevices(cfg) {
+				missing = append(missing, "IOT_ENDPOINT")
+			}
+		case "shellycloud":
+			if cfg.ShellyCloudURL == "" {
+				missing = append(missing, "SHELLY_CLOUD_URL")
+			}
+			if cfg.ShellyCloudAuthKey == "" {
+				missing = append(missing, "SHELLY_CLOUD_AUTH_KEY")
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required environment variables: %s", strings.Join(missing, ", "))
+	}
+
+	// Only Frank Energie publishes gas prices
+	if len(cfg.GasClientIds) > 0 && cfg.PriceProvider != "frankenergie" {
+		return fmt.Errorf("GAS_CLIENT_IDS requires PRICE_PROVIDER=frankenergie, got %q", cfg.PriceProvider)
+	}
+
+	return nil
+}
+
+// Clock that always returns the given RFC3339 timestamp
+func fixedClock(timestamp string) (func() time.Time, error) {
+	instant, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() time.Time { return instant }, nil
+}
+
+// Clock of the run, time.Now unless pinned by AS_OF or a test
+func configClock(cfg Config) func() time.Time {
+	if cfg.Now == nil {
+		return time.Now
+	}
+
+	return cfg.Now
+}
+
+// Time zone of the price day, LOCATION or Europe/Amsterdam when unset
+func priceLocation(cfg Config) (*time.Location, error) {
+	timeZone := cfg.Location
+	if timeZone == "" {
+		timeZone = PRICE_TIMEZONE
+	}
+
+	location, err := time.LoadLocation(timeZone)
+	if err != nil {
+		return nil, fmt.Errorf("error loading time zone %s: %w", timeZone, err)
+	}
+
+	return location, nil
+}
+
+// Whether any device is reached through IOT_ENDPOINT rather than IOT_TARGETS
+func hasDefaultEndpointDevices(cfg Config) bool {
+	if len(cfg.IotTargets) == 0 || len(cfg.GasClientIds) > 0 {
+		return true
+	}
+
+	for _, clientId := range cfg.ShellyClientIds {
+		if _, ok := findIoTTarget(cfg.IotTargets, clientId); !ok {
+			return true
+		}
+	}
+
+	return false
+}
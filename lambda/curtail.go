@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Curtailment command: the inverter's output limit in percent of its rating
+type CurtailCommand struct {
+	Limit     int    `json:"limit"`
+	Timestamp string `json:"timestamp"`
+	Reason    string `json:"reason"`
+	Source    string `json:"source"`
+	Sequence  int64  `json:"sequence,omitempty"`
+}
+
+// Output limit for a price: 100 unless it is below the threshold in the
+// given mode, then falling linearly to 0 at span below it, rounded to whole
+// percent and kept under 100 so a price below the threshold always curtails
+func curtailPercent(price float64, threshold float64, span float64, mode ThresholdMode) int {
+	if !belowThreshold(price, threshold, mode) {
+		return 100
+	}
+
+	below := threshold - price
+	if below >= span {
+		return 0
+	}
+
+	return min(99, int(math.Round(100*(1-below/span))))
+}
+
+// Curtailment to publish for a decision: ramped on the decision price when
+// the price drives it, fully curtailed for overrides, fallbacks,
+// PRE_WINDOW_MINUTES, forecasts and decisions the price alone wouldn't make
+// (hysteresis holds, cheapest-n and relative strategies), and unrestricted
+// whenever solar stays enabled
+func resolveCurtailment(cfg Config, shouldDisable bool, decisionPrice *float64, preWindow bool) int {
+	if !shouldDisable {
+		return 100
+	}
+
+	if decisionPrice == nil || preWindow || !belowThreshold(*decisionPrice, cfg.DisableThreshold, cfg.ThresholdMode) {
+		return 0
+	}
+
+	return curtailPercent(*decisionPrice, cfg.DisableThreshold, cfg.CurtailSpan, cfg.ThresholdMode)
+}
+
+// Publish the output limit to every device's CURTAIL_TOPIC
+func sendCurtailment(ctx context.Context, cfg Config, limit int, meta CommandMeta) error {
+	if len(cfg.ShellyClientIds) == 0 {
+		return fmt.Errorf("SHELLY_CLIENT_IDS (or SHELLY_CLIENT_ID) environment variable must be set")
+	}
+
+	if cfg.DryRun {
+		for _, clientId := range cfg.ShellyClientIds {
+			slog.Info("Dry run: would send curtailment", "limit", limit, "client_id", clientId,
+				"topic", buildTopic(cfg.CurtailTopic, clientId, cfg.SwitchChannel))
+		}
+		return nil
+	}
+
+	// Don't let every controller hit the broker at the top of the hour
+	err := sleepJitter(ctx, cfg.PublishJitter)
+	if err != nil {
+		return fmt.Errorf("error waiting for publish jitter: %w", err)
+	}
+
+	iotClient, err := defaultIoTClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	payload, err := buildCurtailPayload(limit, meta.Reason, meta.Sequence, configClock(cfg)(), cfg.LegacyPayload)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, clientId := range cfg.ShellyClientIds {
+		topic := buildTopic(cfg.CurtailTopic, clientId, cfg.SwitchChannel)
+
+		err = validateTopic(topic)
+		if err == nil {
+			var client IoTClient
+			client, err = deviceIoTClient(ctx, cfg, iotClient, clientId)
+			if err == nil {
+				err = publishPayload(ctx, client, cfg, topic, payload)
+			}
+		}
+		if err != nil {
+			slog.Error("Failed to send curtailment", "limit", limit, "client_id", clientId, "error", err)
+			errs = append(errs, fmt.Errorf("error sending curtailment to device %s: %w", clientId, err))
+			continue
+		}
+
+		slog.Info("Successfully sent curtailment", "limit", limit, "client_id", clientId, "topic", topic, "payload", string(payload))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Marshal the limit as a CurtailCommand, or the bare number in legacy mode
+func buildCurtailPayload(limit int, reason string, sequence int64, now time.Time, legacy bool) ([]byte, error) {
+	if limit < 0 || limit > 100 {
+		return nil, fmt.Errorf("%w: curtailment limit must be between 0 and 100, got %d", ErrInvalidCommand, limit)
+	}
+
+	if legacy {
+		return []byte(strconv.Itoa(limit)), nil
+	}
+
+	payload, err := json.Marshal(CurtailCommand{
+		Limit:     limit,
+		Timestamp: now.UTC().Format(time.RFC3339),
+		Reason:    reason,
+		Source:    COMMAND_SOURCE,
+		Sequence:  sequence,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling curtailment command: %w", err)
+	}
+
+	return payload, nil
+}
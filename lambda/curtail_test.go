@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCurtailPercent(t *testing.T) {
+	strict := ThresholdMode{}
+	inclusive := ThresholdMode{Inclusive: true}
+
+	tests := []struct {
+		name  string
+		price float64
+		mode  ThresholdMode
+		want  int
+	}{
+		{"above threshold", 0.01, strict, 100},
+		{"strict at threshold", 0, strict, 100},
+		{"inclusive at threshold", 0, inclusive, 99},
+		{"inclusive within epsilon", 1e-9, ThresholdMode{Inclusive: true, Epsilon: 1e-6}, 99},
+		{"strict within epsilon below", -1e-9, ThresholdMode{Epsilon: 1e-6}, 100},
+		{"just below threshold", -0.0001, strict, 99},
+		{"inside the span", -0.02, strict, 60},
+		{"at the span", -0.05, strict, 0},
+		{"past the span", -0.2, strict, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := curtailPercent(tt.price, 0, 0.05, tt.mode); got != tt.want {
+				t.Errorf("curtailPercent(%g, 0, 0.05, %+v) = %d, want %d", tt.price, tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCurtailment(t *testing.T) {
+	price := func(value float64) *float64 { return &value }
+	cfg := Config{DisableThreshold: 0, CurtailSpan: 0.05, ThresholdMode: ThresholdMode{Inclusive: true}}
+
+	tests := []struct {
+		name          string
+		shouldDisable bool
+		decisionPrice *float64
+		preWindow     bool
+		want          int
+	}{
+		{"enabled", false, price(-0.02), false, 100},
+		{"disabled on price", true, price(-0.02), false, 60},
+		{"disabled at the inclusive threshold", true, price(0), false, 99},
+		{"hysteresis hold above the threshold", true, price(0.005), false, 0},
+		{"override or fallback", true, nil, false, 0},
+		{"pre-window or forecast", true, price(-0.02), true, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveCurtailment(cfg, tt.shouldDisable, tt.decisionPrice, tt.preWindow); got != tt.want {
+				t.Errorf("resolveCurtailment = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSendCurtailment(t *testing.T) {
+	iot := newFakeIoT()
+	cfg := fakeIoTConfig(iot, "shelly-a", "shelly-b")
+
+	err := sendCurtailment(context.Background(), cfg, 60, CommandMeta{Reason: "test", Sequence: 3})
+	if err != nil {
+		t.Fatalf("sendCurtailment: %v", err)
+	}
+
+	messages := iot.messages()
+	if len(messages) != 2 {
+		t.Fatalf("published %d messages, want 2", len(messages))
+	}
+
+	for _, message := range messages {
+		var command CurtailCommand
+		if err := json.Unmarshal(message.Payload, &command); err != nil {
+			t.Fatalf("payload %q is not a CurtailCommand: %v", message.Payload, err)
+		}
+
+		if command.Limit != 60 || command.Sequence != 3 || command.Source != COMMAND_SOURCE {
+			t.Errorf("topic %s got %+v, want limit 60 with sequence 3", message.Topic, command)
+		}
+	}
+
+	if messages[0].Topic != "shelly-a/command/curtail" || messages[1].Topic != "shelly-b/command/curtail" {
+		t.Errorf("published to %s and %s, want each device's CURTAIL_TOPIC", messages[0].Topic, messages[1].Topic)
+	}
+}
+
+func TestLoadConfigCurtailTopic(t *testing.T) {
+	tests := []struct {
+		name    string
+		topic   string
+		channel string
+		wantErr string
+	}{
+		{name: "channel placeholder", topic: "{clientId}/curtail/{channel}", channel: "2"},
+		{name: "wildcard", topic: "{clientId}/+/curtail", channel: "2", wantErr: "CURTAIL_TOPIC"},
+		{name: "unknown placeholder", topic: "{clientId}/{limit}", channel: "2", wantErr: "CURTAIL_TOPIC"},
+		{name: "negative channel", topic: "{clientId}/curtail/{channel}", channel: "-1", wantErr: "SWITCH_CHANNEL"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SHELLY_CLIENT_IDS", "shelly-a")
+			t.Setenv("IOT_ENDPOINT", "default.iot.test")
+			t.Setenv("CONTROL_TYPE", "curtail")
+			t.Setenv("CURTAIL_TOPIC", tt.topic)
+			t.Setenv("SWITCH_CHANNEL", tt.channel)
+
+			cfg, err := loadConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+
+			// The topic is checked with the parsed channel, as it is published
+			if topic := buildTopic(cfg.CurtailTopic, "shelly-a", cfg.SwitchChannel); topic != "shelly-a/curtail/2" {
+				t.Errorf("curtail topic = %q, want shelly-a/curtail/2", topic)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Everything a price decision depends on, so decide needs no IO
+type DecisionConfig struct {
+	FeedInFee       float64
+	Threshold       float64
+	Hysteresis      float64
+	Mode            ThresholdMode
+	Strategy        string
+	CheapestN       int
+	RelativePercent float64
+	DecisionWindow  int
+	Currency        string
+
+	// The day's prices for DECISION_WINDOW and the day-relative strategies,
+	// the time decided for and the previous state for hysteresis
+	Prices             []ElectricityPrice
+	Now                time.Time
+	PreviouslyDisabled bool
+}
+
+// Outcome of a price decision, before overrides, PRE_WINDOW_MINUTES, the
+// forecast, the battery gate and MIN_STATE_DURATION are applied
+type Decision struct {
+	ShouldDisable  bool
+	EffectivePrice float64
+	DecisionPrice  float64
+	Reason         string
+}
+
+func newDecisionConfig(cfg Config, prices []ElectricityPrice, now time.Time, previouslyDisabled bool) DecisionConfig {
+	return DecisionConfig{
+		FeedInFee:          cfg.FeedInFee,
+		Threshold:          cfg.DisableThreshold,
+		Hysteresis:         cfg.SwitchHysteresis,
+		Mode:               cfg.ThresholdMode,
+		Strategy:           cfg.Strategy,
+		CheapestN:          cfg.CheapestN,
+		RelativePercent:    cfg.RelativePercent,
+		DecisionWindow:     cfg.DecisionWindow,
+		Currency:           cfg.Currency,
+		Prices:             prices,
+		Now:                now,
+		PreviouslyDisabled: previouslyDisabled,
+	}
+}
+
+// Decide on the matched price period: the threshold with hysteresis on the
+// DECISION_WINDOW mean, or the period's place in the day's strategy schedule
+func decide(price ElectricityPrice, cfg DecisionConfig) Decision {
+	prices := cfg.Prices
+	if len(prices) == 0 {
+		prices = []ElectricityPrice{price}
+	}
+
+	effectivePrice := NetExportRevenue(price.MarketPrice, cfg.FeedInFee)
+
+	// Smooth the decision over the current and following periods
+	window := cfg.DecisionWindow
+	if window < 1 {
+		window = 1
+	}
+
+	decisionPrice := averageEffectivePrice(computeSchedule(prices, cfg.FeedInFee, cfg.Threshold, cfg.Mode), cfg.Now, window)
+
+	schedule := decisionSchedule(prices, cfg)
+
+	var shouldDisable bool
+
+	switch cfg.Strategy {
+	case "cheapest-n", "relative":
+		shouldDisable = scheduledDecision(schedule, cfg.Now)
+	default:
+		shouldDisable = applyHysteresis(decisionPrice, cfg.Threshold, cfg.Hysteresis, cfg.Mode, cfg.PreviouslyDisabled)
+	}
+
+	reason := fmt.Sprintf("effective price %s (market %s + fee %s), mean over %d periods %s, threshold %s",
+		formatPrice(effectivePrice, cfg.Currency), formatPrice(price.MarketPrice, cfg.Currency), formatPrice(cfg.FeedInFee, cfg.Currency),
+		window, formatPrice(decisionPrice, cfg.Currency), formatPrice(cfg.Threshold, cfg.Currency))
+
+	switch cfg.Strategy {
+	case "cheapest-n":
+		reason += fmt.Sprintf(", strategy: cheapest %d periods of the day", cfg.CheapestN)
+	case "relative":
+		reason += fmt.Sprintf(", strategy: below %g%% of the day's median, %s",
+			cfg.RelativePercent, formatPrice(relativeThreshold(schedule, cfg.RelativePercent), cfg.Currency))
+	}
+
+	return Decision{
+		ShouldDisable:  shouldDisable,
+		EffectivePrice: effectivePrice,
+		DecisionPrice:  decisionPrice,
+		Reason:         reason,
+	}
+}
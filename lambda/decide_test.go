@@ -0,0 +1,200 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecide(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	// The third period, 02:00-03:00
+	now := start.Add(2*time.Hour + 30*time.Minute)
+
+	tests := []struct {
+		name          string
+		marketPrices  []float64
+		cfg           DecisionConfig
+		wantDisable   bool
+		wantEffective float64
+		wantDecision  float64
+		wantReason    string
+	}{
+		{
+			name:          "threshold below",
+			marketPrices:  []float64{0.01, 0.01, -0.01, 0.01},
+			cfg:           DecisionConfig{Strategy: "threshold"},
+			wantDisable:   true,
+			wantEffective: -0.01,
+			wantDecision:  -0.01,
+		},
+		{
+			name:          "threshold above",
+			marketPrices:  []float64{-0.01, -0.01, 0.01, -0.01},
+			cfg:           DecisionConfig{Strategy: "threshold"},
+			wantDisable:   false,
+			wantEffective: 0.01,
+			wantDecision:  0.01,
+		},
+		{
+			name:          "fee makes a positive market price negative",
+			marketPrices:  []float64{0.01, 0.01, 0.005, 0.01},
+			cfg:           DecisionConfig{Strategy: "threshold", FeedInFee: -0.01},
+			wantDisable:   true,
+			wantEffective: -0.005,
+			wantDecision:  -0.005,
+			wantReason:    "fee -0.01000",
+		},
+		{
+			name:          "strict at threshold",
+			marketPrices:  []float64{0, 0, 0, 0},
+			cfg:           DecisionConfig{Strategy: "threshold"},
+			wantDisable:   false,
+			wantEffective: 0,
+			wantDecision:  0,
+		},
+		{
+			name:          "inclusive at threshold",
+			marketPrices:  []float64{0, 0, 0, 0},
+			cfg:           DecisionConfig{Strategy: "threshold", Mode: ThresholdMode{Inclusive: true}},
+			wantDisable:   true,
+			wantEffective: 0,
+			wantDecision:  0,
+		},
+		{
+			name:          "within epsilon counts as at threshold",
+			marketPrices:  []float64{0, 0, 1e-9, 0},
+			cfg:           DecisionConfig{Strategy: "threshold", Mode: ThresholdMode{Inclusive: true, Epsilon: 1e-6}},
+			wantDisable:   true,
+			wantEffective: 1e-9,
+			wantDecision:  1e-9,
+		},
+		{
+			name:          "outside epsilon",
+			marketPrices:  []float64{0, 0, 1e-3, 0},
+			cfg:           DecisionConfig{Strategy: "threshold", Mode: ThresholdMode{Inclusive: true, Epsilon: 1e-6}},
+			wantDisable:   false,
+			wantEffective: 1e-3,
+			wantDecision:  1e-3,
+		},
+		{
+			name:          "window mean stays above threshold",
+			marketPrices:  []float64{0, 0, -0.03, 0.02, 0.02, 0},
+			cfg:           DecisionConfig{Strategy: "threshold", DecisionWindow: 3},
+			wantDisable:   false,
+			wantEffective: -0.03,
+			wantDecision:  0.01 / 3,
+			wantReason:    "mean over 3 periods",
+		},
+		{
+			name:          "window mean drops below threshold",
+			marketPrices:  []float64{0, 0, 0.01, -0.02, -0.02, 0},
+			cfg:           DecisionConfig{Strategy: "threshold", DecisionWindow: 3},
+			wantDisable:   true,
+			wantEffective: 0.01,
+			wantDecision:  -0.01,
+		},
+		{
+			name:          "hysteresis keeps disabled inside the band",
+			marketPrices:  []float64{0, 0, 0.005, 0},
+			cfg:           DecisionConfig{Strategy: "threshold", Hysteresis: 0.01, PreviouslyDisabled: true},
+			wantDisable:   true,
+			wantEffective: 0.005,
+			wantDecision:  0.005,
+		},
+		{
+			name:          "hysteresis keeps enabled inside the band",
+			marketPrices:  []float64{0, 0, -0.005, 0},
+			cfg:           DecisionConfig{Strategy: "threshold", Hysteresis: 0.01},
+			wantDisable:   false,
+			wantEffective: -0.005,
+			wantDecision:  -0.005,
+		},
+		{
+			name:          "hysteresis enables above the band",
+			marketPrices:  []float64{0, 0, 0.02, 0},
+			cfg:           DecisionConfig{Strategy: "threshold", Hysteresis: 0.01, PreviouslyDisabled: true},
+			wantDisable:   false,
+			wantEffective: 0.02,
+			wantDecision:  0.02,
+		},
+		{
+			name:          "cheapest-n outside the cheapest periods",
+			marketPrices:  []float64{0.05, 0.04, 0.03, 0.02, 0.01, 0.06},
+			cfg:           DecisionConfig{Strategy: "cheapest-n", CheapestN: 2},
+			wantDisable:   false,
+			wantEffective: 0.03,
+			wantDecision:  0.03,
+			wantReason:    "strategy: cheapest 2 periods of the day",
+		},
+		{
+			name:          "cheapest-n within the cheapest periods, above the threshold",
+			marketPrices:  []float64{0.05, 0.04, 0.01, 0.02, 0.03, 0.06},
+			cfg:           DecisionConfig{Strategy: "cheapest-n", CheapestN: 2},
+			wantDisable:   true,
+			wantEffective: 0.01,
+			wantDecision:  0.01,
+		},
+		{
+			name:          "cheapest-n ignores hysteresis",
+			marketPrices:  []float64{0.05, 0.04, 0.03, 0.02, 0.01, 0.06},
+			cfg:           DecisionConfig{Strategy: "cheapest-n", CheapestN: 2, Hysteresis: 0.1, PreviouslyDisabled: true},
+			wantDisable:   false,
+			wantEffective: 0.03,
+			wantDecision:  0.03,
+		},
+		{
+			name:          "relative below the median share",
+			marketPrices:  []float64{0.10, 0.10, 0.02, 0.10, 0.10},
+			cfg:           DecisionConfig{Strategy: "relative", RelativePercent: 50},
+			wantDisable:   true,
+			wantEffective: 0.02,
+			wantDecision:  0.02,
+			wantReason:    "strategy: below 50% of the day's median, 0.05000",
+		},
+		{
+			name:          "relative above the median share",
+			marketPrices:  []float64{0.10, 0.10, 0.08, 0.10, 0.10},
+			cfg:           DecisionConfig{Strategy: "relative", RelativePercent: 50},
+			wantDisable:   false,
+			wantEffective: 0.08,
+			wantDecision:  0.08,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prices := hourlyPrices(start, tt.marketPrices...)
+			cfg := tt.cfg
+			cfg.Prices = prices
+			cfg.Now = now
+			cfg.Currency = "EUR"
+
+			decision := decide(prices[2], cfg)
+
+			if decision.ShouldDisable != tt.wantDisable {
+				t.Errorf("ShouldDisable = %t, want %t (%s)", decision.ShouldDisable, tt.wantDisable, decision.Reason)
+			}
+			if math.Abs(decision.EffectivePrice-tt.wantEffective) > 1e-12 {
+				t.Errorf("EffectivePrice = %g, want %g", decision.EffectivePrice, tt.wantEffective)
+			}
+			if math.Abs(decision.DecisionPrice-tt.wantDecision) > 1e-12 {
+				t.Errorf("DecisionPrice = %g, want %g", decision.DecisionPrice, tt.wantDecision)
+			}
+			if !strings.Contains(decision.Reason, tt.wantReason) {
+				t.Errorf("Reason = %q, want it to contain %q", decision.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestDecideWithoutDayPrices(t *testing.T) {
+	price := ElectricityPrice{From: "2024-01-02T12:00:00Z", Till: "2024-01-02T13:00:00Z", MarketPrice: -0.02}
+
+	decision := decide(price, DecisionConfig{Strategy: "threshold", Now: time.Date(2024, 1, 2, 12, 15, 0, 0, time.UTC)})
+
+	if !decision.ShouldDisable || decision.DecisionPrice != -0.02 {
+		t.Errorf("decision = %+v, want the matched price alone to disable", decision)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// Prefix of the daily decision log objects
+const DECISION_LOG_PREFIX = "decisions/"
+
+// Attempts to append before giving up on concurrent writers
+const DECISION_LOG_MAX_ATTEMPTS = 5
+
+// Subset of the S3 client used to read and conditionally rewrite the log
+type ObjectStore interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+}
+
+func newS3Client(ctx context.Context) (*s3.Client, error) {
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS config: %w", err)
+	}
+
+	return s3.NewFromConfig(cfg), nil
+}
+
+// Object holding the decisions of the day the timestamp falls on
+func decisionLogKey(timestamp time.Time, location *time.Location) string {
+	return DECISION_LOG_PREFIX + timestamp.In(location).Format("2006-01-02") + ".jsonl"
+}
+
+// Append the result as a JSON line to the day's object. S3 has no append, so
+// the object is rewritten with a conditional put on the ETag that was read and
+// the append is retried when another invocation wrote in between
+func appendDecisionLog(ctx context.Context, client ObjectStore, bucket string, location *time.Location, result HandlerResult) error {
+	line, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("error marshaling decision: %w", err)
+	}
+
+	key := decisionLogKey(result.Timestamp, location)
+
+	for attempt := 1; attempt <= DECISION_LOG_MAX_ATTEMPTS; attempt++ {
+		body, etag, err := readDecisionLog(ctx, client, bucket, key)
+		if err != nil {
+			return err
+		}
+
+		input := &s3.PutObjectInput{
+			Bucket:      aws.String(bucket),
+			Key:         aws.String(key),
+			Body:        bytes.NewReader(append(append(body, line...), '\n')),
+			ContentType: aws.String("application/x-ndjson"),
+		}
+
+		// Only create the object if it still doesn't exist, otherwise only
+		// replace the version that was read
+		if etag == nil {
+			input.IfNoneMatch = aws.String("*")
+		} else {
+			input.IfMatch = etag
+		}
+
+		_, err = client.PutObject(ctx, input)
+		if err == nil {
+			return nil
+		}
+
+		var apiErr smithy.APIError
+		if !errors.As(err, &apiErr) || (apiErr.ErrorCode() != "PreconditionFailed" && apiErr.ErrorCode() != "ConditionalRequestConflict") {
+			return fmt.Errorf("error writing decision log %s: %w", key, err)
+		}
+	}
+
+	return fmt.Errorf("error writing decision log %s: still conflicting after %d attempts", key, DECISION_LOG_MAX_ATTEMPTS)
+}
+
+// Current contents and ETag of a decision log, a nil ETag if it doesn't exist yet
+func readDecisionLog(ctx context.Context, client ObjectStore, bucket string, key string) ([]byte, *string, error) {
+	output, err := client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var notFound *types.NoSuchKey
+		if errors.As(err, &notFound) {
+			return nil, nil, nil
+		}
+
+		return nil, nil, fmt.Errorf("error reading decision log %s: %w", key, err)
+	}
+	defer output.Body.Close()
+
+	body, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading decision log %s: %w", key, err)
+	}
+
+	return body, output.ETag, nil
+}
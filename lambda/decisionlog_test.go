@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// In-memory bucket honouring IfMatch and IfNoneMatch. The first conflicts
+// puts lose to a concurrent writer appending its own line, and putErr fails
+// every put
+type fakeObjectStore struct {
+	objects   map[string][]byte
+	etags     map[string]string
+	versions  int
+	conflicts int
+	putErr    error
+	puts      []*s3.PutObjectInput
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{objects: map[string][]byte{}, etags: map[string]string{}}
+}
+
+func (f *fakeObjectStore) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	key := aws.ToString(params.Key)
+
+	body, ok := f.objects[key]
+	if !ok {
+		return nil, &types.NoSuchKey{}
+	}
+
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(body)), ETag: aws.String(f.etags[key])}, nil
+}
+
+func (f *fakeObjectStore) PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	f.puts = append(f.puts, params)
+	key := aws.ToString(params.Key)
+
+	if f.putErr != nil {
+		return nil, f.putErr
+	}
+
+	if f.conflicts > 0 {
+		f.conflicts--
+		f.write(key, append(f.objects[key], "{\"concurrent\":true}\n"...))
+	}
+
+	_, exists := f.objects[key]
+	if (aws.ToString(params.IfNoneMatch) == "*" && exists) || (params.IfMatch != nil && aws.ToString(params.IfMatch) != f.etags[key]) {
+		return nil, &smithy.GenericAPIError{Code: "PreconditionFailed", Message: "At least one of the pre-conditions you specified did not hold"}
+	}
+
+	body, err := io.ReadAll(params.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.write(key, body)
+
+	return &s3.PutObjectOutput{ETag: aws.String(f.etags[key])}, nil
+}
+
+func (f *fakeObjectStore) write(key string, body []byte) {
+	f.versions++
+	f.objects[key] = body
+	f.etags[key] = fmt.Sprintf(`"%d"`, f.versions)
+}
+
+// Lines of an object
+func (f *fakeObjectStore) lines(key string) []string {
+	return strings.Split(strings.TrimSuffix(string(f.objects[key]), "\n"), "\n")
+}
+
+func TestDecisionLogKey(t *testing.T) {
+	location, err := time.LoadLocation(PRICE_TIMEZONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Already the next day in Amsterdam
+	timestamp := time.Date(2024, 1, 1, 23, 30, 0, 0, time.UTC)
+
+	if key := decisionLogKey(timestamp, location); key != "decisions/2024-01-02.jsonl" {
+		t.Errorf("decisionLogKey = %q, want the local day's object", key)
+	}
+}
+
+func TestAppendDecisionLog(t *testing.T) {
+	const key = "decisions/2024-01-02.jsonl"
+
+	location, err := time.LoadLocation(PRICE_TIMEZONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := HandlerResult{ShouldDisableSolar: true, Timestamp: time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)}
+
+	tests := []struct {
+		name      string
+		existing  string
+		conflicts int
+		putErr    error
+		wantPuts  int
+		wantLines int
+		wantErr   string
+	}{
+		{name: "creates the day's object", wantPuts: 1, wantLines: 1},
+		{name: "appends to the day's object", existing: "{\"earlier\":true}\n", wantPuts: 1, wantLines: 2},
+		{name: "retries after a concurrent write", conflicts: 1, wantPuts: 2, wantLines: 2},
+		{name: "gives up while conflicting", conflicts: DECISION_LOG_MAX_ATTEMPTS, wantPuts: DECISION_LOG_MAX_ATTEMPTS, wantErr: "still conflicting"},
+		{name: "other errors are final", putErr: &smithy.GenericAPIError{Code: "AccessDenied"}, wantPuts: 1, wantErr: "AccessDenied"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newFakeObjectStore()
+			store.conflicts = tt.conflicts
+			store.putErr = tt.putErr
+			if tt.existing != "" {
+				store.write(key, []byte(tt.existing))
+			}
+
+			err := appendDecisionLog(context.Background(), store, "decisions-bucket", location, result)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("appendDecisionLog: %v", err)
+			}
+
+			if len(store.puts) != tt.wantPuts {
+				t.Fatalf("made %d puts, want %d", len(store.puts), tt.wantPuts)
+			}
+			if aws.ToString(store.puts[0].Bucket) != "decisions-bucket" || aws.ToString(store.puts[0].ContentType) != "application/x-ndjson" {
+				t.Errorf("put to %q as %q, want the bucket as JSON lines", aws.ToString(store.puts[0].Bucket), aws.ToString(store.puts[0].ContentType))
+			}
+			if tt.wantErr != "" {
+				return
+			}
+
+			// Earlier lines are kept and the decision comes last
+			lines := store.lines(key)
+			if len(lines) != tt.wantLines {
+				t.Fatalf("log has lines %q, want %d", lines, tt.wantLines)
+			}
+
+			var logged HandlerResult
+			if err := json.Unmarshal([]byte(lines[len(lines)-1]), &logged); err != nil || !logged.ShouldDisableSolar {
+				t.Errorf("last line %q = %+v, %v, want the decision", lines[len(lines)-1], logged, err)
+			}
+		})
+	}
+}
+
+func TestRunDecisionLog(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dry run %t", dryRun), func(t *testing.T) {
+			store := newFakeObjectStore()
+			cfg := runConfig(t, newFakeIoT(), dayPrices(t, now, -0.05), now, map[string]string{"DECISION_LOG_BUCKET": "decisions-bucket"})
+			cfg.ObjectStore = store
+			cfg.DryRun = dryRun
+
+			if _, err := Run(context.Background(), cfg); err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			if dryRun {
+				if len(store.puts) != 0 {
+					t.Errorf("made %d puts, want dry runs kept out of the log", len(store.puts))
+				}
+				return
+			}
+
+			lines := store.lines("decisions/2024-01-02.jsonl")
+			if len(lines) != 1 || !strings.Contains(lines[0], `"shouldDisableSolar":true`) {
+				t.Errorf("log = %q, want the run's decision", lines)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ENTSOE_API_URL         = "https://web-api.tp.entsoe.eu/api"
+	ENTSOE_DEFAULT_ZONE    = "10YNL----------L"
+	ENTSOE_PERIOD_LAYOUT   = "200601021504"
+	ENTSOE_INTERVAL_LAYOUT = "2006-01-02T15:04Z"
+)
+
+// ENTSO-E Transparency Platform day-ahead prices for a bidding zone
+type EntsoeProvider struct {
+	URL         string
+	Client      *http.Client
+	Token       string
+	BiddingZone string
+	Location    *time.Location
+	Retry       RetryPolicy
+}
+
+// Response structures
+type EntsoeMarketDocument struct {
+	TimeSeries []struct {
+		Currency    string `xml:"currency_Unit.name"`
+		MeasureUnit string `xml:"price_Measure_Unit.name"`
+		Period      []struct {
+			TimeInterval struct {
+				Start string `xml:"start"`
+				End   string `xml:"end"`
+			} `xml:"timeInterval"`
+			Resolution string `xml:"resolution"`
+			Points     []struct {
+				Position int     `xml:"position"`
+				Price    float64 `xml:"price.amount"`
+			} `xml:"Point"`
+		} `xml:"Period"`
+	} `xml:"TimeSeries"`
+}
+
+func (p *EntsoeProvider) FetchPrices(ctx context.Context, date string) ([]ElectricityPrice, error) {
+	// Request the local day, expressed in UTC as the API expects
+	dayStart, err := time.ParseInLocation("2006-01-02", date, p.Location)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing date %q: %w", date, err)
+	}
+
+	dayEnd := dayStart.AddDate(0, 0, 1)
+
+	query := url.Values{}
+	query.Set("securityToken", p.Token)
+	query.Set("documentType", "A44")
+	query.Set("in_Domain", p.BiddingZone)
+	query.Set("out_Domain", p.BiddingZone)
+	query.Set("periodStart", dayStart.UTC().Format(ENTSOE_PERIOD_LAYOUT))
+	query.Set("periodEnd", dayEnd.UTC().Format(ENTSOE_PERIOD_LAYOUT))
+
+	requestURL := p.URL + "?" + query.Encode()
+
+	newRequest := func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+	}
+
+	var document EntsoeMarketDocument
+
+	decode := func(body io.Reader) error {
+		return xml.NewDecoder(body).Decode(&document)
+	}
+
+	err = doRequest(ctx, p.Client, p.Retry, "query ENTSO-E day-ahead prices", "xml", newRequest, decode)
+	if err != nil {
+		return nil, err
+	}
+
+	prices, err := mapEntsoePrices(document)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only keep periods that start within the requested day
+	var dayPrices []ElectricityPrice
+
+	for _, price := range prices {
+		from, _ := time.Parse(time.RFC3339, price.From)
+		if !from.Before(dayStart) && from.Before(dayEnd) {
+			dayPrices = append(dayPrices, price)
+		}
+	}
+
+	return dayPrices, nil
+}
+
+// Expand the ENTSO-E points into periods, normalizing per-MWh prices to per-kWh
+func mapEntsoePrices(document EntsoeMarketDocument) ([]ElectricityPrice, error) {
+	var prices []ElectricityPrice
+
+	for _, series := range document.TimeSeries {
+		if !strings.EqualFold(series.MeasureUnit, "MWH") {
+			return nil, fmt.Errorf("unexpected ENTSO-E price unit %q, expected MWH", series.MeasureUnit)
+		}
+
+		for _, period := range series.Period {
+			start, err := time.Parse(ENTSOE_INTERVAL_LAYOUT, period.TimeInterval.Start)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing ENTSO-E interval start %q: %w", period.TimeInterval.Start, err)
+			}
+
+			end, err := time.Parse(ENTSOE_INTERVAL_LAYOUT, period.TimeInterval.End)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing ENTSO-E interval end %q: %w", period.TimeInterval.End, err)
+			}
+
+			resolution, err := parseEntsoeResolution(period.Resolution)
+			if err != nil {
+				return nil, err
+			}
+
+			points := period.Points
+			sort.Slice(points, func(i, j int) bool {
+				return points[i].Position < points[j].Position
+			})
+
+			// Positions without a point repeat the previous price (curve type A03)
+			count := int(end.Sub(start) / resolution)
+			next := 0
+			var price float64
+
+			for position := 1; position <= count; position++ {
+				for next < len(points) && points[next].Position <= position {
+					price = points[next].Price
+					next++
+				}
+
+				if next == 0 {
+					continue
+				}
+
+				from := start.Add(time.Duration(position-1) * resolution)
+
+				prices = append(prices, ElectricityPrice{
+					From:        from.Format(time.RFC3339),
+					Till:        from.Add(resolution).Format(time.RFC3339),
+					MarketPrice: price / 1000,
+					PerUnit:     PRICE_UNIT,
+				})
+			}
+		}
+	}
+
+	return prices, nil
+}
+
+func parseEntsoeResolution(resolution string) (time.Duration, error) {
+	switch resolution {
+	case "PT15M":
+		return 15 * time.Minute, nil
+	case "PT30M":
+		return 30 * time.Minute, nil
+	case "PT60M", "PT1H":
+		return time.Hour, nil
+	default:
+		return 0, fmt.Errorf("unsupported ENTSO-E resolution %q", resolution)
+	}
+}
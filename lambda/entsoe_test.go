@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestEntsoeRequestsLocalDay(t *testing.T) {
+	tests := []struct {
+		location  string
+		wantStart string
+		wantEnd   string
+	}{
+		{"Europe/Amsterdam", "202401012300", "202401022300"},
+		{"Europe/London", "202401020000", "202401030000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			location, err := time.LoadLocation(tt.location)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var start, end string
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				start = r.URL.Query().Get("periodStart")
+				end = r.URL.Query().Get("periodEnd")
+				w.Header().Set("Content-Type", "application/xml")
+				w.Write([]byte(`<Publication_MarketDocument></Publication_MarketDocument>`))
+			}))
+			defer server.Close()
+
+			provider := &EntsoeProvider{URL: server.URL, Client: server.Client(), Token: "test", BiddingZone: ENTSOE_DEFAULT_ZONE, Location: location, Retry: testRetry}
+
+			_, err = provider.FetchPrices(context.Background(), "2024-01-02")
+			if err != nil {
+				t.Fatalf("FetchPrices: %v", err)
+			}
+
+			if start != tt.wantStart || end != tt.wantEnd {
+				t.Errorf("requested %s to %s, want %s to %s", start, end, tt.wantStart, tt.wantEnd)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+)
+
+// Detail type of the events put on TRANSITION_EVENT_BUS
+const TRANSITION_DETAIL_TYPE = "Solar State Transition"
+
+// Subset of the EventBridge client used to put transition events
+type EventPutter interface {
+	PutEvents(ctx context.Context, params *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error)
+}
+
+// Detail of a transition event, for rules matching e.g. {"newState": ["disabled"]}
+type TransitionEvent struct {
+	PreviousState  string    `json:"previousState"`
+	NewState       string    `json:"newState"`
+	EffectivePrice float64   `json:"effectivePrice"`
+	Reason         string    `json:"reason"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// Name of a solar state in transition events
+func solarState(disabled bool) string {
+	if disabled {
+		return "disabled"
+	}
+
+	return "enabled"
+}
+
+func newEventBridgeClient(ctx context.Context) (*eventbridge.Client, error) {
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS config: %w", err)
+	}
+
+	return eventbridge.NewFromConfig(cfg), nil
+}
+
+// Put a transition event on the bus, which may be given by name or ARN
+func putTransitionEvent(ctx context.Context, client EventPutter, bus string, event TransitionEvent) error {
+	detail, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("error marshaling transition event: %w", err)
+	}
+
+	output, err := client.PutEvents(ctx, &eventbridge.PutEventsInput{
+		Entries: []types.PutEventsRequestEntry{
+			{
+				EventBusName: aws.String(bus),
+				Source:       aws.String(COMMAND_SOURCE),
+				DetailType:   aws.String(TRANSITION_DETAIL_TYPE),
+				Detail:       aws.String(string(detail)),
+				Time:         aws.Time(event.Timestamp),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error putting transition event: %w", err)
+	}
+
+	// PutEvents reports rejected entries in the response, not as an error
+	if output.FailedEntryCount > 0 && len(output.Entries) > 0 {
+		entry := output.Entries[0]
+		return fmt.Errorf("error putting transition event: %s: %s", aws.ToString(entry.ErrorCode), aws.ToString(entry.ErrorMessage))
+	}
+
+	return nil
+}
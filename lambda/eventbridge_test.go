@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge"
+	"github.com/aws/aws-sdk-go-v2/service/eventbridge/types"
+)
+
+// Records the entries put, failing with err or rejecting them with errorCode
+type fakeEventPutter struct {
+	entries   []types.PutEventsRequestEntry
+	err       error
+	errorCode string
+}
+
+func (f *fakeEventPutter) PutEvents(ctx context.Context, params *eventbridge.PutEventsInput, optFns ...func(*eventbridge.Options)) (*eventbridge.PutEventsOutput, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	f.entries = append(f.entries, params.Entries...)
+
+	if f.errorCode != "" {
+		return &eventbridge.PutEventsOutput{
+			FailedEntryCount: 1,
+			Entries:          []types.PutEventsResultEntry{{ErrorCode: aws.String(f.errorCode), ErrorMessage: aws.String("rejected")}},
+		}, nil
+	}
+
+	return &eventbridge.PutEventsOutput{Entries: []types.PutEventsResultEntry{{EventId: aws.String("event-1")}}}, nil
+}
+
+func TestPutTransitionEvent(t *testing.T) {
+	putter := &fakeEventPutter{}
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+
+	err := putTransitionEvent(context.Background(), putter, "solar", TransitionEvent{
+		PreviousState:  solarState(false),
+		NewState:       solarState(true),
+		EffectivePrice: -0.05,
+		Reason:         "test",
+		Timestamp:      now,
+	})
+	if err != nil {
+		t.Fatalf("putTransitionEvent: %v", err)
+	}
+
+	if len(putter.entries) != 1 {
+		t.Fatalf("put %d entries, want 1", len(putter.entries))
+	}
+
+	entry := putter.entries[0]
+	if aws.ToString(entry.EventBusName) != "solar" || aws.ToString(entry.Source) != COMMAND_SOURCE || aws.ToString(entry.DetailType) != TRANSITION_DETAIL_TYPE {
+		t.Errorf("entry = bus %q, source %q, detail type %q", aws.ToString(entry.EventBusName), aws.ToString(entry.Source), aws.ToString(entry.DetailType))
+	}
+
+	want := `{"previousState":"enabled","newState":"disabled","effectivePrice":-0.05,"reason":"test","timestamp":"2024-01-02T13:30:00Z"}`
+	if aws.ToString(entry.Detail) != want {
+		t.Errorf("Detail = %s, want %s", aws.ToString(entry.Detail), want)
+	}
+}
+
+func TestPutTransitionEventRejected(t *testing.T) {
+	putter := &fakeEventPutter{errorCode: "ThrottlingException"}
+
+	err := putTransitionEvent(context.Background(), putter, "solar", TransitionEvent{})
+	if err == nil || !strings.Contains(err.Error(), "ThrottlingException") {
+		t.Errorf("error = %v, want the rejected entry reported", err)
+	}
+}
+
+func TestRunTransitionEvent(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		stored     *ControllerState
+		putErr     error
+		wantEvents int
+	}{
+		{name: "state flips", stored: &ControllerState{SolarDisabled: false}, wantEvents: 1},
+		{name: "state unchanged", stored: &ControllerState{SolarDisabled: true}},
+		{name: "no prior state", stored: nil},
+		{name: "PutEvents fails", stored: &ControllerState{SolarDisabled: false}, putErr: errors.New("access denied")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			putter := &fakeEventPutter{err: tt.putErr}
+			cfg := runConfig(t, newFakeIoT(), dayPrices(t, now, -0.05), now, map[string]string{"TRANSITION_EVENT_BUS": "solar"})
+			cfg.EventPutter = putter
+
+			if tt.stored != nil {
+				if err := cfg.StateStore.PutState(context.Background(), *tt.stored); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := Run(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if !result.ShouldDisableSolar {
+				t.Fatalf("result = %+v, want solar disabled", result)
+			}
+
+			if len(putter.entries) != tt.wantEvents {
+				t.Fatalf("put %d events, want %d", len(putter.entries), tt.wantEvents)
+			}
+
+			if tt.wantEvents > 0 {
+				var detail TransitionEvent
+				if err := json.Unmarshal([]byte(aws.ToString(putter.entries[0].Detail)), &detail); err != nil {
+					t.Fatal(err)
+				}
+				if detail.PreviousState != "enabled" || detail.NewState != "disabled" || detail.EffectivePrice != result.EffectivePrice {
+					t.Errorf("detail = %+v, want enabled to disabled at %g", detail, result.EffectivePrice)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Price forecast endpoint response, with the chance of negative prices in
+// the next hour as a fraction between 0 and 1
+type ForecastResponse struct {
+	Probability *float64 `json:"probability"`
+}
+
+func fetchNegativeProbability(ctx context.Context, client *http.Client, url string, retry RetryPolicy) (float64, error) {
+	newRequest := func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
+	}
+
+	var response ForecastResponse
+
+	decode := func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&response)
+	}
+
+	err := doRequest(ctx, client, retry, "query price forecast", "json", newRequest, decode)
+	if err != nil {
+		return 0, err
+	}
+
+	if response.Probability == nil {
+		return 0, fmt.Errorf("forecast response has no probability field")
+	}
+
+	if *response.Probability < 0 || *response.Probability > 1 {
+		return 0, fmt.Errorf("forecast probability %g is out of range", *response.Probability)
+	}
+
+	return *response.Probability, nil
+}
+
+// Disable ahead of a likely negative price, but only while the current
+// effective price is within margin of the threshold, so acting early
+// gives up little revenue
+func applyForecast(shouldDisable bool, probability float64, probabilityThreshold float64, effectivePrice float64, threshold float64, margin float64, mode ThresholdMode) bool {
+	if shouldDisable {
+		return true
+	}
+
+	return probability >= probabilityThreshold && belowThreshold(effectivePrice, threshold+margin, mode)
+}
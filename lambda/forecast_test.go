@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestApplyForecast(t *testing.T) {
+	tests := []struct {
+		name           string
+		shouldDisable  bool
+		probability    float64
+		effectivePrice float64
+		want           bool
+	}{
+		{"likely negative, price within the margin", false, 0.9, 0.01, true},
+		{"likely negative, price at the threshold", false, 0.8, 0, true},
+		{"likely negative, price above the margin", false, 0.9, 0.03, false},
+		{"unlikely negative", false, 0.5, 0.01, false},
+		{"already disabled by price", true, 0, 0.5, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := applyForecast(tt.shouldDisable, tt.probability, 0.8, tt.effectivePrice, 0, 0.02, ThresholdMode{})
+			if got != tt.want {
+				t.Errorf("applyForecast = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchNegativeProbability(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    float64
+		wantErr string
+	}{
+		{name: "probability", status: http.StatusOK, body: `{"probability": 0.85}`, want: 0.85},
+		{name: "no probability", status: http.StatusOK, body: `{}`, wantErr: "no probability"},
+		{name: "out of range", status: http.StatusOK, body: `{"probability": 85}`, wantErr: "out of range"},
+		{name: "server error", status: http.StatusInternalServerError, body: `{}`, wantErr: "status code: 500"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newJSONServer(t, tt.status, tt.body)
+
+			probability, err := fetchNegativeProbability(context.Background(), server.Client(), server.URL, testRetry)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("fetchNegativeProbability: %v", err)
+			}
+
+			if probability != tt.want {
+				t.Errorf("probability = %g, want %g", probability, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunForecast(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+
+	// With the default fee, 0.02 nets about 0.007, within the 0.02 margin
+	tests := []struct {
+		name          string
+		marketPrice   float64
+		status        int
+		forecast      string
+		wantDisable   bool
+		wantForecast  bool
+		wantRequested bool
+	}{
+		{"pre-disables ahead of likely negative prices", 0.02, http.StatusOK, `{"probability": 0.9}`, true, true, true},
+		{"unlikely negative prices", 0.02, http.StatusOK, `{"probability": 0.5}`, false, false, true},
+		{"price above the margin", 0.05, http.StatusOK, `{"probability": 0.9}`, false, false, true},
+		{"forecast unavailable decides on price", 0.02, http.StatusInternalServerError, `{}`, false, false, true},
+		{"negative price skips the forecast", -0.05, http.StatusOK, `{"probability": 0.1}`, true, false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isolateAWS(t)
+
+			prices := marketPricesBody(t, dayPrices(t, now, tt.marketPrice))
+			var requested atomic.Bool
+
+			// The forecast and the prices share one trusted server
+			mux := http.NewServeMux()
+			mux.HandleFunc("/forecast", func(w http.ResponseWriter, r *http.Request) {
+				requested.Store(true)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.forecast))
+			})
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(prices))
+			})
+			server := newTLSServer(t, mux)
+
+			iot := newFakeIoT()
+			cfg := runConfig(t, iot, nil, now, map[string]string{
+				"FRANK_ENERGIE_URL": server.URL,
+				"FORECAST_URL":      server.URL + "/forecast",
+				"CA_BUNDLE_PATH":    os.Getenv("CA_BUNDLE_PATH"),
+			})
+
+			result, err := Run(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			if result.ShouldDisableSolar != tt.wantDisable || result.Forecast != tt.wantForecast {
+				t.Errorf("ShouldDisableSolar = %t, Forecast = %t, want %t and %t", result.ShouldDisableSolar, result.Forecast, tt.wantDisable, tt.wantForecast)
+			}
+			if requested.Load() != tt.wantRequested {
+				t.Errorf("forecast requested = %t, want %t", requested.Load(), tt.wantRequested)
+			}
+
+			if tt.wantForecast {
+				messages := iot.messages()
+				if len(messages) != 1 || !strings.Contains(decodeCommand(t, messages[0]).Reason, "forecast 90% chance") {
+					t.Errorf("published %+v, want the command to name the forecast", messages)
+				}
+			}
+		})
+	}
+}
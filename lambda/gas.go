@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Frank Energie publishes gas prices per cubic metre
+const GAS_PRICE_UNIT = "m3"
+
+// Fetch Frank Energie's gas prices for a day, in their own query so the
+// electricity query is unchanged for users without gas control
+func fetchGasPrices(ctx context.Context, client *http.Client, url string, date string, retry RetryPolicy) ([]ElectricityPrice, error) {
+	query := `query MarketPrices($date: String!) {
+		marketPrices(date: $date) {
+			gasPrices {
+				from
+				till
+				marketPrice
+				perUnit
+			}
+		}
+	}`
+
+	reqBody := GraphQLRequest{
+		Query: query,
+		Variables: map[string]interface{}{
+			"date": date,
+		},
+		OperationName: "MarketPrices",
+	}
+
+	var response MarketPricesResponse
+
+	err := postGraphQL(ctx, client, url, nil, reqBody, retry, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	err = graphQLError(response.Errors)
+	if err != nil {
+		return nil, err
+	}
+
+	return response.Data.MarketPrices.GasPrices, nil
+}
+
+// Switch the GAS_CLIENT_IDS devices on while the gas market price is below
+// GAS_THRESHOLD, independently of the electricity decision. Returns the
+// current gas price and whether the devices were switched on
+func controlGasDevices(ctx context.Context, cfg Config, date string, now time.Time) (float64, bool, error) {
+	prices, err := fetchGasPrices(ctx, newHTTPClient(cfg), cfg.FrankEnergieURL, date, cfg.FetchRetry)
+	if err != nil {
+		return 0, false, fmt.Errorf("error fetching gas prices: %w", err)
+	}
+
+	price, found := currentPeriod(prices, now)
+	if !found {
+		return 0, false, fmt.Errorf("%w for current gas period: %s", ErrNoPrice, now.UTC().Format(time.RFC3339))
+	}
+
+	if !strings.EqualFold(price.PerUnit, GAS_PRICE_UNIT) {
+		return 0, false, fmt.Errorf("unexpected gas price unit %q for period %s, expected %s", price.PerUnit, price.From, GAS_PRICE_UNIT)
+	}
+
+	on := price.MarketPrice < cfg.GasThreshold
+	command := relayCommand(on)
+
+	slog.Info("Gas decision", "gas_price", price.MarketPrice, "gas_threshold", cfg.GasThreshold, "command", command)
+
+	if cfg.DryRun {
+		for _, clientId := range cfg.GasClientIds {
+			slog.Info("Dry run: would send gas command", "command", command, "client_id", clientId, "transport", cfg.Transport)
+		}
+		return price.MarketPrice, on, nil
+	}
+
+	reason := fmt.Sprintf("Gas price %.5f %s/%s, threshold %.5f %s/%s",
+		price.MarketPrice, cfg.Currency, GAS_PRICE_UNIT, cfg.GasThreshold, cfg.Currency, GAS_PRICE_UNIT)
+
+	transport, err := newTransport(ctx, cfg, CommandMeta{Reason: reason})
+	if err != nil {
+		return 0, false, err
+	}
+
+	// Keep going past a failing device so one offline device doesn't leave
+	// the others in the wrong state
+	var errs []error
+
+	for _, clientId := range cfg.GasClientIds {
+		err = transport.Send(ctx, clientId, on)
+		if err != nil {
+			slog.Error("Failed to send gas command", "command", command, "client_id", clientId, "error", err)
+			errs = append(errs, fmt.Errorf("error sending gas command to device %s: %w", clientId, err))
+			continue
+		}
+
+		slog.Info("Successfully sent gas command", "command", command, "client_id", clientId)
+	}
+
+	return price.MarketPrice, on, errors.Join(errs...)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestControlGasDevicesContinuesPastFailures(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+
+	gasPrices := hourlyPrices(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), make([]float64, 24)...)
+	for i := range gasPrices {
+		gasPrices[i].MarketPrice = 0.30
+		gasPrices[i].PerUnit = "M3"
+	}
+
+	var response MarketPricesResponse
+	response.Data.MarketPrices.GasPrices = gasPrices
+	body, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newJSONServer(t, http.StatusOK, string(body))
+
+	iot := newFakeIoT()
+	iot.fail["gas-a/command/switch:0"] = errors.New("access denied")
+	iot.fail["gas-c/command/switch:0"] = errors.New("access denied")
+
+	cfg := fakeIoTConfig(iot)
+	cfg.FrankEnergieURL = server.URL
+	cfg.FetchRetry = testRetry
+	cfg.GasClientIds = []string{"gas-a", "gas-b", "gas-c"}
+	cfg.GasThreshold = 0.50
+
+	price, on, err := controlGasDevices(context.Background(), cfg, "2024-01-02", now)
+	if err == nil || !strings.Contains(err.Error(), "gas-a") || !strings.Contains(err.Error(), "gas-c") {
+		t.Fatalf("error = %v, want one naming gas-a and gas-c", err)
+	}
+
+	if price != 0.30 || !on {
+		t.Errorf("price = %g, on = %t, want 0.30 and on", price, on)
+	}
+
+	messages := iot.messages()
+	if len(messages) != 1 || messages[0].Topic != "gas-b/command/switch:0" || decodeCommand(t, messages[0]).Command != "on" {
+		t.Errorf("published %+v, want gas-b still switched on", messages)
+	}
+}
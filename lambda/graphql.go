@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Entry of the errors array, which may accompany a 200 response with null data
+type GraphQLError struct {
+	Message string `json:"message"`
+}
+
+// POST a GraphQL request and decode the JSON response into response
+func postGraphQL(ctx context.Context, client *http.Client, url string, headers map[string]string, reqBody GraphQLRequest, retry RetryPolicy, response interface{}) error {
+	jsonData, err := json.Marshal(reqBody)
+	if err != nil {
+		return fmt.Errorf("error marshaling request: %w", err)
+	}
+
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonData))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+
+		return req, nil
+	}
+
+	decode := func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(response)
+	}
+
+	return doRequest(ctx, client, retry, "query "+url, "json", newRequest, decode)
+}
+
+// Combine the messages of a GraphQL errors array into one error, nil when empty
+func graphQLError(graphQLErrors []GraphQLError) error {
+	if len(graphQLErrors) == 0 {
+		return nil
+	}
+
+	messages := make([]string, 0, len(graphQLErrors))
+	for _, graphQLErr := range graphQLErrors {
+		messages = append(messages, graphQLErr.Message)
+	}
+
+	return fmt.Errorf("GraphQL API returned errors: %s", strings.Join(messages, "; "))
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGraphQLError(t *testing.T) {
+	if err := graphQLError(nil); err != nil {
+		t.Errorf("graphQLError(nil) = %v, want nil", err)
+	}
+
+	err := graphQLError([]GraphQLError{{Message: "date out of range"}, {Message: "rate limited"}})
+	if err == nil || !strings.Contains(err.Error(), "date out of range; rate limited") {
+		t.Errorf("graphQLError = %v, want both messages", err)
+	}
+}
+
+func TestFetchMarketPricesGraphQLErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"null data", `{"data": null, "errors": [{"message": "Internal server error"}]}`},
+		{"partial data", `{"data": {"marketPrices": {"electricityPrices": [{"from": "2024-01-02T00:00:00Z", "till": "2024-01-02T01:00:00Z", "marketPrice": 0.1, "perUnit": "KWH"}]}}, "errors": [{"message": "Internal server error"}]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			prices, err := fetchMarketPrices(context.Background(), server.Client(), server.URL, "2024-01-02", testRetry)
+			if err == nil || !strings.Contains(err.Error(), "Internal server error") {
+				t.Fatalf("error = %v, want the GraphQL message", err)
+			}
+
+			if prices != nil {
+				t.Errorf("got %d prices alongside the error, want none", len(prices))
+			}
+
+			if requests.Load() != 1 {
+				t.Errorf("sent %d requests, want the errors returned without retrying", requests.Load())
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Upper bound for each reachability check
+const HEALTH_CHECK_TIMEOUT = 5 * time.Second
+
+// Body returned by /healthz
+type HealthStatus struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentHealth `json:"components"`
+}
+
+type ComponentHealth struct {
+	Status string `json:"status"`
+	URL    string `json:"url,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Check that the price provider and command endpoint are reachable, without
+// running a decision or publishing anything
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	health := HealthStatus{Status: "ok", Components: map[string]ComponentHealth{}}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		health.Status = "unhealthy"
+		health.Components["config"] = ComponentHealth{Status: "unhealthy", Error: err.Error()}
+		writeJSON(w, http.StatusServiceUnavailable, health)
+		return
+	}
+
+	health.Components["config"] = ComponentHealth{Status: "ok"}
+
+	// Through the configured proxy and CA bundle, with a shorter timeout
+	client := &http.Client{Timeout: HEALTH_CHECK_TIMEOUT, Transport: newHTTPClient(cfg).Transport}
+
+	targets := map[string]string{
+		"provider":  providerURL(cfg),
+		"transport": transportURL(cfg),
+	}
+
+	// Every IOT_TARGETS endpoint separately, IOT_ENDPOINT only when a device uses it
+	if cfg.Transport == "iot" {
+		for _, target := range cfg.IotTargets {
+			targets["transport:"+target.Endpoint] = "https://" + target.Endpoint
+		}
+
+		if !hasDefaultEndpointDevices(cfg) {
+			delete(targets, "transport")
+		}
+	}
+
+	for name, target := range targets {
+		component := ComponentHealth{Status: "ok", URL: target}
+
+		err := checkReachable(r.Context(), client, target)
+		if err != nil {
+			component.Status = "unhealthy"
+			component.Error = err.Error()
+			health.Status = "unhealthy"
+		}
+
+		health.Components[name] = component
+	}
+
+	status := http.StatusOK
+	if health.Status != "ok" {
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, health)
+}
+
+// Base URL of the configured price provider
+func providerURL(cfg Config) string {
+	switch cfg.PriceProvider {
+	case "frankenergie":
+		return cfg.FrankEnergieURL
+	case "tibber":
+		return TIBBER_API_URL
+	case "entsoe":
+		return ENTSOE_API_URL
+	case "nordpool":
+		return NORDPOOL_API_URL
+	default:
+		return ""
+	}
+}
+
+// Endpoint the configured transport delivers commands to
+func transportURL(cfg Config) string {
+	switch cfg.Transport {
+	case "iot":
+		if cfg.IotEndpoint == "" {
+			return ""
+		}
+		return "https://" + cfg.IotEndpoint
+	case "shellycloud":
+		return cfg.ShellyCloudURL
+	default:
+		return ""
+	}
+}
+
+// Any HTTP response counts as reachable, only connection failures don't
+func checkReachable(ctx context.Context, client *http.Client, target string) error {
+	if target == "" {
+		return fmt.Errorf("not configured")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "HEAD", target, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("unreachable: %w", err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	// Any response counts as reachable
+	server := newTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing listens here once the server is closed
+	closed := httptest.NewTLSServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name          string
+		env           map[string]string
+		want          int
+		wantUnhealthy []string
+		wantAbsent    []string
+	}{
+		{
+			name: "shelly cloud reachable",
+			env:  map[string]string{"TRANSPORT": "shellycloud", "SHELLY_CLOUD_URL": server.URL, "SHELLY_CLOUD_AUTH_KEY": "key"},
+			want: http.StatusOK,
+		},
+		{
+			name:          "provider unreachable",
+			env:           map[string]string{"TRANSPORT": "shellycloud", "SHELLY_CLOUD_URL": server.URL, "SHELLY_CLOUD_AUTH_KEY": "key", "FRANK_ENERGIE_URL": closed.URL},
+			want:          http.StatusServiceUnavailable,
+			wantUnhealthy: []string{"provider"},
+		},
+		{
+			name: "iot endpoint reachable",
+			env:  map[string]string{"IOT_ENDPOINT": serverURL.Host},
+			want: http.StatusOK,
+		},
+		{
+			name:       "every device behind IOT_TARGETS",
+			env:        map[string]string{"IOT_TARGETS": `[{"endpoint": "` + serverURL.Host + `", "clientIds": ["shelly-a"]}]`},
+			want:       http.StatusOK,
+			wantAbsent: []string{"transport"},
+		},
+		{
+			name:          "invalid configuration",
+			env:           map[string]string{"IOT_ENDPOINT": serverURL.Host, "SWITCH_CHANNEL": "-1"},
+			want:          http.StatusServiceUnavailable,
+			wantUnhealthy: []string{"config"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SHELLY_CLIENT_IDS", "shelly-a")
+			t.Setenv("FRANK_ENERGIE_URL", server.URL)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			recorder := httptest.NewRecorder()
+			newServeMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+
+			if recorder.Code != tt.want {
+				t.Fatalf("GET /healthz = %d, want %d: %s", recorder.Code, tt.want, recorder.Body)
+			}
+
+			var health HealthStatus
+			if err := json.Unmarshal(recorder.Body.Bytes(), &health); err != nil {
+				t.Fatalf("body %q is not a HealthStatus: %v", recorder.Body, err)
+			}
+
+			wantStatus := "ok"
+			if tt.want != http.StatusOK {
+				wantStatus = "unhealthy"
+			}
+			if health.Status != wantStatus {
+				t.Errorf("status = %q, want %q", health.Status, wantStatus)
+			}
+
+			for _, name := range tt.wantUnhealthy {
+				if component := health.Components[name]; component.Status != "unhealthy" || component.Error == "" {
+					t.Errorf("%s = %+v, want unhealthy with an error", name, component)
+				}
+			}
+			for _, name := range tt.wantAbsent {
+				if component, ok := health.Components[name]; ok {
+					t.Errorf("%s = %+v, want it left out", name, component)
+				}
+			}
+
+			for name, component := range health.Components {
+				if component.Status == "unhealthy" && !slices.Contains(tt.wantUnhealthy, name) {
+					t.Errorf("%s = %+v, want it healthy", name, component)
+				}
+			}
+		})
+	}
+}
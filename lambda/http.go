@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Time given to in-flight requests after SIGTERM, below the usual 30 second
+// grace period of container runtimes
+const HTTP_SHUTDOWN_TIMEOUT = 25 * time.Second
+
+// Error body returned by the HTTP handlers
+type HTTPError struct {
+	Error string `json:"error"`
+	Type  string `json:"type,omitempty"`
+}
+
+// Run the decision once per request and return the HandlerResult
+func httpHandler(w http.ResponseWriter, r *http.Request) {
+	result, err := handler(r.Context(), HandlerEvent{})
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Write a failed run: upstream price failures are a 502, anything else
+// including publish failures a 500, the type tells them apart
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.Is(err, ErrFetch) || errors.Is(err, ErrNoPrice) {
+		status = http.StatusBadGateway
+	}
+
+	writeJSON(w, status, HTTPError{Error: err.Error(), Type: errorType(err)})
+}
+
+// Reconcile the devices with the current period's decision after runs were
+// missed since ?since=RFC3339, e.g. after an outage or deploy. Past periods
+// are not replayed, the decision is made for now and sent unconditionally
+func backfillHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, HTTPError{Error: "backfill sends commands and requires POST"})
+		return
+	}
+
+	since, err := time.Parse(time.RFC3339, r.URL.Query().Get("since"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, HTTPError{Error: fmt.Sprintf("invalid since %q, expected RFC3339", r.URL.Query().Get("since"))})
+		return
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, HTTPError{Error: err.Error(), Type: errorType(ErrConfig)})
+		return
+	}
+
+	now := cfg.Now()
+	if !since.Before(now) {
+		writeJSON(w, http.StatusBadRequest, HTTPError{Error: fmt.Sprintf("since %s is not in the past", since.Format(time.RFC3339))})
+		return
+	}
+
+	slog.Info("Reconciling devices after missed runs", "since", since, "missed", now.Sub(since).Round(time.Second).String())
+
+	cfg.Reconcile = true
+
+	result, err := Run(r.Context(), cfg)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Preview the computed schedule for ?date=YYYY-MM-DD, tomorrow by default,
+// and the following ?days=N-1 days, without making a decision or sending any
+// command
+func scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, err := loadConfig()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, HTTPError{Error: err.Error()})
+		return
+	}
+
+	location, err := time.LoadLocation(cfg.Location)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, HTTPError{Error: err.Error()})
+		return
+	}
+
+	date := r.URL.Query().Get("date")
+	if date != "" {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			writeJSON(w, http.StatusBadRequest, HTTPError{Error: fmt.Sprintf("invalid date %q, expected YYYY-MM-DD", date)})
+			return
+		}
+	}
+
+	days := 1
+	if value := r.URL.Query().Get("days"); value != "" {
+		days, err = strconv.Atoi(value)
+		if err != nil || days < 1 || days > MAX_FETCH_DAYS {
+			writeJSON(w, http.StatusBadRequest, HTTPError{Error: fmt.Sprintf("invalid days %q, expected 1 to %d", value, MAX_FETCH_DAYS)})
+			return
+		}
+	}
+
+	provider, err := newPriceProvider(cfg)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, HTTPError{Error: err.Error()})
+		return
+	}
+
+	var prices []ElectricityPrice
+
+	if date == "" {
+		// Tomorrow by default, or today's remaining periods until tomorrow's
+		// prices are published
+		now := cfg.Now()
+
+		prices, err = fetchPricesWithFallback(r.Context(), provider, now, location)
+		if err == nil && days > 1 {
+			var later []ElectricityPrice
+			later, err = fetchPriceRange(r.Context(), provider, now.In(location).AddDate(0, 0, 2).Format("2006-01-02"), days-1)
+			prices = mergePrices(prices, later)
+		}
+	} else {
+		prices, err = fetchPriceRange(r.Context(), provider, date, days)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, HTTPError{Error: fmt.Sprintf("%s: %s", ErrFetch, err)})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, rangeSchedule(prices, cfg, location))
+}
+
+// List the periods of ?date=YYYY-MM-DD, today by default, whose decision
+// changed between the cached prices and a fresh fetch
+func scheduleDiffHandler(w http.ResponseWriter, r *http.Request) {
+	cfg, err := loadConfig()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, HTTPError{Error: err.Error()})
+		return
+	}
+
+	location, err := time.LoadLocation(cfg.Location)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, HTTPError{Error: err.Error()})
+		return
+	}
+
+	date := r.URL.Query().Get("date")
+	if date == "" {
+		date = cfg.Now().In(location).Format("2006-01-02")
+	} else if _, err := time.Parse("2006-01-02", date); err != nil {
+		writeJSON(w, http.StatusBadRequest, HTTPError{Error: fmt.Sprintf("invalid date %q, expected YYYY-MM-DD", date)})
+		return
+	}
+
+	day, _ := time.Parse("2006-01-02", date)
+	cfg.DisableThreshold = dayThreshold(cfg, day)
+
+	provider, err := newPriceProvider(cfg)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, HTTPError{Error: err.Error()})
+		return
+	}
+
+	caching, ok := provider.(*CachingProvider)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, HTTPError{Error: "schedule diff requires PRICE_CACHE_TABLE and no BACKUP_PRICE_PROVIDERS"})
+		return
+	}
+
+	fresh, cached, err := caching.Compare(r.Context(), date)
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, HTTPError{Error: fmt.Sprintf("%s: %s", ErrFetch, err)})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, diffSchedules(strategySchedule(cached, cfg), strategySchedule(fresh, cfg)))
+}
+
+// Routes of the HTTP mode. Only the root itself runs the decision, any
+// other unknown path is a 404 rather than a publishing run
+func newServeMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/{$}", httpHandler)
+	mux.HandleFunc("/backfill", backfillHandler)
+	mux.HandleFunc("/healthz", healthHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/schedule", scheduleHandler)
+	mux.HandleFunc("/schedule/diff", scheduleDiffHandler)
+	mux.HandleFunc("/", notFoundHandler)
+
+	return mux
+}
+
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusNotFound, HTTPError{Error: fmt.Sprintf("no route for %s", r.URL.Path)})
+}
+
+func serveHTTP(port string) {
+	server := &http.Server{
+		Addr:              ":" + port,
+		Handler:           newServeMux(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Stop accepting connections on SIGTERM, as sent by ECS, Kubernetes and
+	// docker stop, and let in-flight runs finish their publish
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	shutdownDone := make(chan struct{})
+
+	go func() {
+		defer close(shutdownDone)
+
+		<-ctx.Done()
+		slog.Info("Shutting down, draining in-flight requests", "timeout", HTTP_SHUTDOWN_TIMEOUT)
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), HTTP_SHUTDOWN_TIMEOUT)
+		defer cancel()
+
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			slog.Error("Error draining HTTP requests", "error", err)
+		}
+	}()
+
+	slog.Info("Listening for HTTP requests", "port", port)
+
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP server failed", "error", err)
+		os.Exit(1)
+	}
+
+	<-shutdownDone
+	slog.Info("HTTP server stopped")
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		slog.Error("Error writing HTTP response", "error", err)
+	}
+}
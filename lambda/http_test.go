@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Environment for handler runs against one HTTPS stub serving the prices
+// on /prices, failing them with priceStatus unless it is 200, and
+// answering Shelly Cloud relay commands with a rejection
+func httpRunEnv(t *testing.T, priceStatus int) {
+	t.Helper()
+
+	isolateAWS(t)
+
+	// The handler reads its clock from the environment, and AS_OF would make
+	// every run a dry run
+	prices := marketPricesBody(t, dayPrices(t, time.Now(), -0.05))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/prices", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(priceStatus)
+		w.Write([]byte(prices))
+	})
+	mux.HandleFunc("/device/relay/control", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"isok": false, "errors": {"device_offline": "Device is offline"}}`))
+	})
+	server := newTLSServer(t, mux)
+
+	t.Setenv("FRANK_ENERGIE_URL", server.URL+"/prices")
+	t.Setenv("TRANSPORT", "shellycloud")
+	t.Setenv("SHELLY_CLOUD_URL", server.URL)
+	t.Setenv("SHELLY_CLOUD_AUTH_KEY", "test")
+	t.Setenv("SHELLY_CLIENT_IDS", "shelly-a")
+	t.Setenv("FETCH_MAX_ATTEMPTS", "1")
+	t.Setenv("PUBLISH_MAX_ATTEMPTS", "1")
+}
+
+func TestHTTPStatusCodes(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		priceStatus int
+		dryRun      bool
+		want        int
+		wantType    string
+	}{
+		{"decision", "/", http.StatusOK, true, http.StatusOK, ""},
+		{"price fetch failure", "/", http.StatusInternalServerError, false, http.StatusBadGateway, "FetchError"},
+		{"publish failure", "/", http.StatusOK, false, http.StatusInternalServerError, "PublishError"},
+		{"unknown path", "/favicon.ico", http.StatusOK, false, http.StatusNotFound, ""},
+		{"unknown subpath", "/schedule/tomorrow", http.StatusOK, false, http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpRunEnv(t, tt.priceStatus)
+			if tt.dryRun {
+				t.Setenv("DRY_RUN", "true")
+			}
+
+			recorder := httptest.NewRecorder()
+			newServeMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+			if recorder.Code != tt.want {
+				t.Fatalf("GET %s = %d, want %d: %s", tt.path, recorder.Code, tt.want, recorder.Body)
+			}
+
+			if tt.want == http.StatusOK {
+				return
+			}
+
+			var body HTTPError
+			if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+				t.Fatalf("body %q is not an HTTPError: %v", recorder.Body, err)
+			}
+			if body.Type != tt.wantType {
+				t.Errorf("error type = %q, want %q", body.Type, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	since := time.Now().Add(-time.Hour).Format(time.RFC3339)
+
+	tests := []struct {
+		name     string
+		method   string
+		query    string
+		env      map[string]string
+		want     int
+		wantType string
+	}{
+		{name: "reconciles", method: http.MethodPost, query: "?since=" + since, env: map[string]string{"DRY_RUN": "true"}, want: http.StatusOK},
+		{name: "GET sends nothing", method: http.MethodGet, query: "?since=" + since, want: http.StatusMethodNotAllowed},
+		{name: "missing since", method: http.MethodPost, want: http.StatusBadRequest},
+		{name: "since in the future", method: http.MethodPost, query: "?since=" + time.Now().Add(time.Hour).Format(time.RFC3339), want: http.StatusBadRequest},
+		{name: "invalid configuration", method: http.MethodPost, query: "?since=" + since, env: map[string]string{"SWITCH_CHANNEL": "-1"}, want: http.StatusInternalServerError, wantType: "ConfigError"},
+		{name: "publish failure", method: http.MethodPost, query: "?since=" + since, want: http.StatusInternalServerError, wantType: "PublishError"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			httpRunEnv(t, http.StatusOK)
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			recorder := httptest.NewRecorder()
+			newServeMux().ServeHTTP(recorder, httptest.NewRequest(tt.method, "/backfill"+tt.query, nil))
+
+			if recorder.Code != tt.want {
+				t.Fatalf("%s /backfill = %d, want %d: %s", tt.method, recorder.Code, tt.want, recorder.Body)
+			}
+
+			switch tt.want {
+			case http.StatusOK:
+				var result HandlerResult
+				if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+					t.Fatalf("body %q is not a HandlerResult: %v", recorder.Body, err)
+				}
+				if !result.Reconciled || !result.ShouldDisableSolar {
+					t.Errorf("result = %+v, want a reconciled decision to disable", result)
+				}
+			case http.StatusMethodNotAllowed:
+				if allow := recorder.Header().Get("Allow"); allow != http.MethodPost {
+					t.Errorf("Allow = %q, want POST", allow)
+				}
+			default:
+				var body HTTPError
+				if err := json.Unmarshal(recorder.Body.Bytes(), &body); err != nil {
+					t.Fatalf("body %q is not an HTTPError: %v", recorder.Body, err)
+				}
+				if body.Type != tt.wantType {
+					t.Errorf("error type = %q, want %q", body.Type, tt.wantType)
+				}
+			}
+		})
+	}
+}
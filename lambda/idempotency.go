@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Key of the idempotency item for a period and resolved command
+func idempotencyKey(periodStart time.Time, shouldDisable bool) string {
+	command := "enable"
+	if shouldDisable {
+		command = "disable"
+	}
+
+	return fmt.Sprintf("idempotency#%s#%s", periodStart.UTC().Format(time.RFC3339), command)
+}
+
+// Atomically record the key until expiresAt; claimed is false when another
+// invocation already recorded it, i.e. this one is a duplicate
+func claimIdempotencyKey(ctx context.Context, tableName string, key string, expiresAt time.Time) (bool, error) {
+	client, err := newDynamoDBClient(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]types.AttributeValue{
+			"id":         &types.AttributeValueMemberS{Value: key},
+			"expires_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(id)"),
+	})
+	if err != nil {
+		var conditionErr *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionErr) {
+			return false, nil
+		}
+		return false, fmt.Errorf("error writing idempotency key to DynamoDB: %w", err)
+	}
+
+	return true, nil
+}
+
+// Release a claimed key after a failed send, so a retry isn't skipped
+func releaseIdempotencyKey(ctx context.Context, tableName string, key string) error {
+	client, err := newDynamoDBClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting idempotency key from DynamoDB: %w", err)
+	}
+
+	return nil
+}
+
+// Start of the price period containing now, or the start of the hour when
+// no period covers it
+func currentPeriodStart(prices []ElectricityPrice, now time.Time) time.Time {
+	for _, entry := range computeSchedule(prices, 0, 0, ThresholdMode{}) {
+		if !now.Before(entry.From) && now.Before(entry.Till) {
+			return entry.From
+		}
+	}
+
+	return now.Truncate(time.Hour)
+}
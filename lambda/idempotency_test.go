@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIdempotencyKey(t *testing.T) {
+	start := time.Date(2024, 1, 2, 13, 0, 0, 0, time.FixedZone("CET", 3600))
+
+	if got, want := idempotencyKey(start, true), "idempotency#2024-01-02T12:00:00Z#disable"; got != want {
+		t.Errorf("idempotencyKey = %q, want %q", got, want)
+	}
+
+	if idempotencyKey(start, true) == idempotencyKey(start, false) {
+		t.Error("disable and enable share a key, a flipped decision would be dropped")
+	}
+}
+
+func TestCurrentPeriodStart(t *testing.T) {
+	start := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	prices := hourlyPrices(start, 0.01, 0.02)
+
+	if got := currentPeriodStart(prices, start.Add(90*time.Minute)); !got.Equal(start.Add(time.Hour)) {
+		t.Errorf("currentPeriodStart = %s, want the 13:00 period", got)
+	}
+
+	// Without a matching period the hour still identifies the invocation
+	if got := currentPeriodStart(nil, start.Add(20*time.Minute)); !got.Equal(start) {
+		t.Errorf("currentPeriodStart without prices = %s, want the start of the hour", got)
+	}
+}
+
+func TestRunIdempotency(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+	iot := newFakeIoT()
+	cfg := runConfig(t, iot, dayPrices(t, now, -0.05), now, map[string]string{
+		"STATE_STORE":     "memory",
+		"IDEMPOTENCY_TTL": "1h",
+	})
+
+	// A failed publish releases the key so the retry still sends
+	iot.fail["shelly-a/command/switch:0"] = errors.New("access denied")
+	if _, err := Run(context.Background(), cfg); !errors.Is(err, ErrPublish) {
+		t.Fatalf("Run error = %v, want ErrPublish", err)
+	}
+	delete(iot.fail, "shelly-a/command/switch:0")
+
+	first, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("retried Run: %v", err)
+	}
+	if first.Duplicate || !first.CommandSent {
+		t.Errorf("retried run = %+v, want the command sent", first)
+	}
+
+	second, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("duplicate Run: %v", err)
+	}
+	if !second.Duplicate || second.CommandSent {
+		t.Errorf("duplicate run = %+v, want it reported as a duplicate without sending", second)
+	}
+
+	if messages := iot.messages(); len(messages) != 1 {
+		t.Errorf("published %d commands, want 1", len(messages))
+	}
+}
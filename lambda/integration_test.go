@@ -0,0 +1,52 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// Query Frank Energie for today's prices and check that the response still
+// has the marketPrices/electricityPrices shape this controller decodes, as
+// an early warning for upstream schema changes. Never publishes anything
+func TestFrankEnergieSchema(t *testing.T) {
+	if os.Getenv("FRANK_ENERGIE_SMOKE") == "" {
+		t.Skip("set FRANK_ENERGIE_SMOKE=1 to query the live Frank Energie API")
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	location, err := time.LoadLocation(cfg.Location)
+	if err != nil {
+		t.Fatalf("error loading time zone: %v", err)
+	}
+
+	date := time.Now().In(location).Format("2006-01-02")
+
+	prices, err := fetchMarketPrices(context.Background(), newHTTPClient(cfg), cfg.FrankEnergieURL, date, cfg.FetchRetry)
+	if err != nil {
+		t.Fatalf("error querying %s: %v", cfg.FrankEnergieURL, err)
+	}
+
+	if len(prices) == 0 {
+		t.Fatalf("no electricity prices for %s, the marketPrices or electricityPrices shape may have changed", date)
+	}
+
+	for _, price := range prices {
+		_, fromErr := time.Parse(time.RFC3339, price.From)
+		_, tillErr := time.Parse(time.RFC3339, price.Till)
+		if fromErr != nil || tillErr != nil {
+			t.Errorf("price period %q to %q is not RFC3339", price.From, price.Till)
+		}
+
+		if price.PerUnit == "" {
+			t.Errorf("price for %s has no perUnit", price.From)
+		}
+	}
+}
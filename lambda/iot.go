@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/iotdataplane"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// Source field of every command, for deduplication on the device
+const COMMAND_SOURCE = "aws-mqtt-drm-controller"
+
+const (
+	CLIENT_ID_PLACEHOLDER  = "{clientId}"
+	CHANNEL_PLACEHOLDER    = "{channel}"
+	DEFAULT_TOPIC_TEMPLATE = CLIENT_ID_PLACEHOLDER + "/command/switch:" + CHANNEL_PLACEHOLDER
+)
+
+// Interval between device shadow reads while confirming a command
+const SHADOW_POLL_INTERVAL = time.Second
+
+// Returned when the device shadow does not report the commanded state in time
+var ErrConfirmationTimeout = errors.New("timed out waiting for device shadow confirmation")
+
+// A command payload or topic failed validation and was not published
+var ErrInvalidCommand = errors.New("invalid relay command")
+
+// Reported state of the Shelly switches in the device shadow, keyed by "switch:<channel>"
+type ShadowDocument struct {
+	State struct {
+		Reported map[string]struct {
+			Output *bool `json:"output"`
+		} `json:"reported"`
+	} `json:"state"`
+}
+
+// Subset of the IoT Data Plane client used to publish commands, so it can be
+// replaced by a fake; *iotdataplane.Client satisfies it
+type Publisher interface {
+	Publish(ctx context.Context, params *iotdataplane.PublishInput, optFns ...func(*iotdataplane.Options)) (*iotdataplane.PublishOutput, error)
+}
+
+// Subset of the IoT Data Plane client used to confirm commands
+type ShadowReader interface {
+	GetThingShadow(ctx context.Context, params *iotdataplane.GetThingShadowInput, optFns ...func(*iotdataplane.Options)) (*iotdataplane.GetThingShadowOutput, error)
+}
+
+// IoT Data Plane operations behind the command topics, as returned by Config.IoTClients
+type IoTClient interface {
+	Publisher
+	ShadowReader
+	ShadowUpdater
+}
+
+// Publishes commands to the devices over IoT Core MQTT
+type IoTCoreTransport struct {
+	Publisher Publisher
+	Shadows   ShadowReader
+	Config    Config
+	Reason    string
+	Sequence  int64
+}
+
+func newIoTCoreTransport(ctx context.Context, cfg Config, meta CommandMeta) (*IoTCoreTransport, error) {
+	iotClient, err := defaultIoTClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MqttQos == 1 {
+		slog.Info("Publishing with QoS 1: delivery is at-least-once, devices may receive a command more than once")
+	} else {
+		slog.Info("Publishing with QoS 0: delivery is at-most-once, a command may be dropped")
+	}
+
+	return &IoTCoreTransport{Publisher: iotClient, Shadows: iotClient, Config: cfg, Reason: meta.Reason, Sequence: meta.Sequence}, nil
+}
+
+func (t *IoTCoreTransport) Send(ctx context.Context, clientID string, on bool) error {
+	publisher, shadows := t.Publisher, t.Shadows
+
+	// Devices behind IOT_TARGETS are reached through their own endpoint
+	if _, ok := findIoTTarget(t.Config.IotTargets, clientID); ok {
+		client, err := deviceIoTClient(ctx, t.Config, nil, clientID)
+		if err != nil {
+			return err
+		}
+		publisher, shadows = client, client
+	}
+
+	if publisher == nil {
+		return fmt.Errorf("IOT_ENDPOINT environment variable must be set for device %s", clientID)
+	}
+
+	err := t.publish(ctx, publisher, buildTopic(t.Config.TopicTemplate, clientID, t.Config.SwitchChannel), on)
+	if err != nil {
+		return err
+	}
+
+	return t.confirm(ctx, shadows, clientID, on)
+}
+
+// Publish a single command to a topic every device subscribes to, then
+// confirm each device separately
+func (t *IoTCoreTransport) SendGroup(ctx context.Context, topic string, clientIDs []string, on bool) error {
+	err := t.publish(ctx, t.Publisher, topic, on)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, clientID := range clientIDs {
+		err = t.confirm(ctx, t.Shadows, clientID, on)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("device %s: %w", clientID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (t *IoTCoreTransport) publish(ctx context.Context, publisher Publisher, topic string, on bool) error {
+	command := "off"
+
+	if on {
+		command = "on"
+	}
+
+	payload, err := buildCommandPayload(command, t.Reason, t.Sequence, configClock(t.Config)(), t.Config.LegacyPayload)
+	if err != nil {
+		return err
+	}
+
+	// Never send the relay something it doesn't understand
+	err = validateCommand(topic, payload, t.Config.LegacyPayload)
+	if err != nil {
+		return err
+	}
+
+	err = publishPayload(ctx, publisher, t.Config, topic, payload)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Published IoT command", "command", command, "topic", topic, "payload", string(payload))
+
+	return nil
+}
+
+// Publish with the configured QoS and retain flag, retrying transient failures
+func publishPayload(ctx context.Context, publisher Publisher, cfg Config, topic string, payload []byte) error {
+	input := buildPublishInput(cfg, topic, payload)
+
+	err := withRetry(ctx, cfg.PublishRetry, "publish to "+topic, func() error {
+		_, err := publisher.Publish(ctx, input)
+		if err != nil {
+			return classifyPublishError(ctx, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error publishing to IoT Core: %w", err)
+	}
+
+	return nil
+}
+
+// Optionally wait for the device to report the new state
+func (t *IoTCoreTransport) confirm(ctx context.Context, shadows ShadowReader, clientID string, on bool) error {
+	if t.Config.ConfirmTimeout <= 0 {
+		return nil
+	}
+
+	err := confirmShadowState(ctx, shadows, clientID, t.Config.SwitchChannel, on, t.Config.ConfirmTimeout)
+	if err != nil {
+		return fmt.Errorf("error confirming command: %w", err)
+	}
+
+	slog.Info("Device confirmed switch output", "client_id", clientID, "output", on)
+
+	return nil
+}
+
+// Retry throttling, 5xx and network failures, honouring any Retry-After hint;
+// other API errors such as authorization failures are final
+func classifyPublishError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return err
+	}
+
+	var respErr *smithyhttp.ResponseError
+	if !errors.As(err, &respErr) {
+		return retryable(err)
+	}
+
+	status := respErr.HTTPStatusCode()
+	if status != http.StatusTooManyRequests && status < 500 {
+		return err
+	}
+
+	return retryableAfter(err, parseRetryAfter(respErr.Response.Header.Get("Retry-After"), time.Now()))
+}
+
+// Expand the topic template for a device and relay channel
+func buildTopic(template string, clientId string, channel int) string {
+	topic := strings.ReplaceAll(template, CLIENT_ID_PLACEHOLDER, clientId)
+	return strings.ReplaceAll(topic, CHANNEL_PLACEHOLDER, strconv.Itoa(channel))
+}
+
+// Publish input carrying the configured QoS and retain flag
+func buildPublishInput(cfg Config, topic string, payload []byte) *iotdataplane.PublishInput {
+	return &iotdataplane.PublishInput{
+		Topic:   aws.String(topic),
+		Payload: payload,
+		Qos:     cfg.MqttQos,
+		Retain:  cfg.MqttRetain,
+	}
+}
+
+// Marshal the command as an IoTCommand, or the bare "on"/"off" string in legacy mode
+func buildCommandPayload(command string, reason string, sequence int64, now time.Time, legacy bool) ([]byte, error) {
+	if legacy {
+		return []byte(command), nil
+	}
+
+	payload, err := json.Marshal(IoTCommand{
+		Command:   command,
+		Timestamp: now.UTC().Format(time.RFC3339),
+		Reason:    reason,
+		Source:    COMMAND_SOURCE,
+		Sequence:  sequence,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling IoT command: %w", err)
+	}
+
+	return payload, nil
+}
+
+// Check that the topic is fully expanded and the payload is exactly "on" or
+// "off" in legacy mode, or otherwise an IoTCommand with one of those commands
+func validateCommand(topic string, payload []byte, legacy bool) error {
+	err := validateTopic(topic)
+	if err != nil {
+		return err
+	}
+
+	if legacy {
+		if string(payload) != "on" && string(payload) != "off" {
+			return fmt.Errorf("%w: legacy payload must be on or off, got %q", ErrInvalidCommand, payload)
+		}
+		return nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.DisallowUnknownFields()
+
+	var command IoTCommand
+
+	err = decoder.Decode(&command)
+	if err != nil {
+		return fmt.Errorf("%w: payload is not an IoTCommand: %w", ErrInvalidCommand, err)
+	}
+
+	if command.Command != "on" && command.Command != "off" {
+		return fmt.Errorf("%w: command must be on or off, got %q", ErrInvalidCommand, command.Command)
+	}
+
+	_, err = time.Parse(time.RFC3339, command.Timestamp)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp %q", ErrInvalidCommand, command.Timestamp)
+	}
+
+	return nil
+}
+
+// Reject topics with an unexpanded placeholder, an MQTT wildcard or an empty level
+func validateTopic(topic string) error {
+	if strings.ContainsAny(topic, "{}+#") || strings.HasPrefix(topic, "/") || strings.HasSuffix(topic, "/") || strings.Contains(topic, "//") {
+		return fmt.Errorf("%w: topic %q has an unexpanded placeholder, a wildcard or an empty level", ErrInvalidCommand, topic)
+	}
+
+	return nil
+}
+
+// IoT Core endpoint of a group of devices from IOT_TARGETS, e.g. in another
+// account, with the region and credentials to reach it. Without a profile
+// or role the Lambda's own credentials are used
+type IoTTarget struct {
+	Endpoint  string   `json:"endpoint"`
+	Region    string   `json:"region,omitempty"`
+	Profile   string   `json:"profile,omitempty"`
+	RoleARN   string   `json:"roleArn,omitempty"`
+	ClientIds []string `json:"clientIds"`
+}
+
+// IOT_TARGETS entry the device belongs to
+func findIoTTarget(targets []IoTTarget, clientId string) (IoTTarget, bool) {
+	for _, target := range targets {
+		if slices.Contains(target.ClientIds, clientId) {
+			return target, true
+		}
+	}
+
+	return IoTTarget{}, false
+}
+
+// IoT Data Plane clients by endpoint and credentials, created once per
+// process and reused across invocations and HTTP requests
+var (
+	iotClientsMu sync.Mutex
+	iotClients   = map[iotClientKey]*iotdataplane.Client{}
+)
+
+type iotClientKey struct {
+	endpoint string
+	region   string
+	profile  string
+	roleARN  string
+}
+
+func newTargetIoTClient(ctx context.Context, target IoTTarget) (*iotdataplane.Client, error) {
+	key := iotClientKey{endpoint: target.Endpoint, region: target.Region, profile: target.Profile, roleARN: target.RoleARN}
+
+	iotClientsMu.Lock()
+	defer iotClientsMu.Unlock()
+
+	if client, ok := iotClients[key]; ok {
+		return client, nil
+	}
+
+	var options []func(*config.LoadOptions) error
+	if target.Region != "" {
+		options = append(options, config.WithRegion(target.Region))
+	}
+	if target.Profile != "" {
+		options = append(options, config.WithSharedConfigProfile(target.Profile))
+	}
+
+	// Load AWS configuration
+	cfg, err := config.LoadDefaultConfig(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS config: %w", err)
+	}
+
+	if target.RoleARN != "" {
+		cfg.Credentials = aws.NewCredentialsCache(stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), target.RoleARN))
+	}
+
+	// Construct the full HTTPS endpoint URL for IoT Data Plane
+	fullEndpoint := fmt.Sprintf("https://%s", target.Endpoint)
+
+	// Create IoT Data client with custom endpoint
+	client := iotdataplane.NewFromConfig(cfg, func(o *iotdataplane.Options) {
+		o.BaseEndpoint = &fullEndpoint
+	})
+
+	iotClients[key] = client
+	return client, nil
+}
+
+// Client for an endpoint through Config.IoTClients when set, e.g. a fake in
+// tests, otherwise the cached iotdataplane client
+func targetIoTClient(ctx context.Context, cfg Config, target IoTTarget) (IoTClient, error) {
+	if cfg.IoTClients != nil {
+		return cfg.IoTClients(ctx, target)
+	}
+
+	return newTargetIoTClient(ctx, target)
+}
+
+// Client publishing to the device: its IOT_TARGETS endpoint, otherwise the
+// IOT_ENDPOINT client passed in, which is nil without IOT_ENDPOINT
+func deviceIoTClient(ctx context.Context, cfg Config, fallback IoTClient, clientId string) (IoTClient, error) {
+	target, ok := findIoTTarget(cfg.IotTargets, clientId)
+	if ok {
+		client, err := targetIoTClient(ctx, cfg, target)
+		if err != nil {
+			return nil, fmt.Errorf("error creating client for IoT endpoint %s: %w", target.Endpoint, err)
+		}
+		return client, nil
+	}
+
+	if fallback == nil {
+		return nil, fmt.Errorf("IOT_ENDPOINT environment variable must be set for device %s", clientId)
+	}
+
+	return fallback, nil
+}
+
+// IOT_ENDPOINT client, nil when every device is reached through IOT_TARGETS
+func defaultIoTClient(ctx context.Context, cfg Config) (IoTClient, error) {
+	if cfg.IotEndpoint == "" && len(cfg.IotTargets) > 0 {
+		return nil, nil
+	}
+
+	if cfg.IotEndpoint == "" {
+		return nil, fmt.Errorf("IOT_ENDPOINT environment variable must be set")
+	}
+
+	return targetIoTClient(ctx, cfg, IoTTarget{Endpoint: cfg.IotEndpoint})
+}
+
+// Poll the device shadow until the reported switch output matches
+func confirmShadowState(ctx context.Context, iotClient ShadowReader, thingName string, channel int, expectedOutput bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		output, err := iotClient.GetThingShadow(ctx, &iotdataplane.GetThingShadowInput{
+			ThingName: aws.String(thingName),
+		})
+		if err != nil {
+			slog.Warn("Error reading device shadow", "client_id", thingName, "error", err)
+		} else {
+			var shadow ShadowDocument
+
+			err = json.Unmarshal(output.Payload, &shadow)
+			if err != nil {
+				return fmt.Errorf("error decoding shadow document: %w", err)
+			}
+
+			reported := shadow.State.Reported[fmt.Sprintf("switch:%d", channel)].Output
+			if reported != nil && *reported == expectedOutput {
+				return nil
+			}
+		}
+
+		if time.Now().Add(SHADOW_POLL_INTERVAL).After(deadline) {
+			return ErrConfirmationTimeout
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(SHADOW_POLL_INTERVAL):
+		}
+	}
+}
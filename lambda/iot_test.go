@@ -0,0 +1,479 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iotdataplane"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+)
+
+// Published message recorded by fakeIoTClient
+type publishedMessage struct {
+	Endpoint string
+	Topic    string
+	Payload  []byte
+	Retain   bool
+}
+
+// In-memory IoT Data Plane recording publishes on its fake instead of sending them
+type fakeIoTClient struct {
+	iot      *fakeIoT
+	endpoint string
+}
+
+func (c *fakeIoTClient) Publish(ctx context.Context, params *iotdataplane.PublishInput, optFns ...func(*iotdataplane.Options)) (*iotdataplane.PublishOutput, error) {
+	f := c.iot
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	topic := aws.ToString(params.Topic)
+	f.attempts[topic]++
+
+	if errs := f.failFirst[topic]; len(errs) > 0 {
+		f.failFirst[topic] = errs[1:]
+		return nil, errs[0]
+	}
+	if err := f.fail[topic]; err != nil {
+		return nil, err
+	}
+
+	f.published = append(f.published, publishedMessage{Endpoint: c.endpoint, Topic: topic, Payload: params.Payload, Retain: params.Retain})
+	return &iotdataplane.PublishOutput{}, nil
+}
+
+func (c *fakeIoTClient) GetThingShadow(ctx context.Context, params *iotdataplane.GetThingShadowInput, optFns ...func(*iotdataplane.Options)) (*iotdataplane.GetThingShadowOutput, error) {
+	return nil, errors.New("fake has no shadows")
+}
+
+func (c *fakeIoTClient) UpdateThingShadow(ctx context.Context, params *iotdataplane.UpdateThingShadowInput, optFns ...func(*iotdataplane.Options)) (*iotdataplane.UpdateThingShadowOutput, error) {
+	f := c.iot
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.shadowUpdates = append(f.shadowUpdates, params)
+	return &iotdataplane.UpdateThingShadowOutput{}, nil
+}
+
+// Fake IoT Core shared by every endpoint, recording what was published where.
+// Publishes to a topic in fail always fail; those in failFirst fail with the
+// queued errors before they succeed
+type fakeIoT struct {
+	mu        sync.Mutex
+	published []publishedMessage
+	fail      map[string]error
+	failFirst map[string][]error
+	attempts  map[string]int
+	endpoints []string
+
+	shadowUpdates []*iotdataplane.UpdateThingShadowInput
+}
+
+func newFakeIoT() *fakeIoT {
+	return &fakeIoT{fail: map[string]error{}, failFirst: map[string][]error{}, attempts: map[string]int{}}
+}
+
+// Config.IoTClients returning a client of the fake per endpoint
+func (f *fakeIoT) clients(ctx context.Context, target IoTTarget) (IoTClient, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.endpoints = append(f.endpoints, target.Endpoint)
+	return &fakeIoTClient{iot: f, endpoint: target.Endpoint}, nil
+}
+
+// Messages published so far
+func (f *fakeIoT) messages() []publishedMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]publishedMessage(nil), f.published...)
+}
+
+// Shadow updates made so far
+func (f *fakeIoT) shadows() []*iotdataplane.UpdateThingShadowInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*iotdataplane.UpdateThingShadowInput(nil), f.shadowUpdates...)
+}
+
+// Publish attempts made to topic so far
+func (f *fakeIoT) publishAttempts(topic string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.attempts[topic]
+}
+
+// API error as the SDK returns it for an HTTP status, with an optional Retry-After
+func newResponseError(status int, retryAfter string) error {
+	header := http.Header{}
+	if retryAfter != "" {
+		header.Set("Retry-After", retryAfter)
+	}
+
+	return &smithyhttp.ResponseError{
+		Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status, Header: header}},
+		Err:      fmt.Errorf("status %d", status),
+	}
+}
+
+// Decoded command payload of a recorded message
+func decodeCommand(t *testing.T, message publishedMessage) IoTCommand {
+	t.Helper()
+
+	var command IoTCommand
+	if err := json.Unmarshal(message.Payload, &command); err != nil {
+		t.Fatalf("payload %q is not an IoTCommand: %v", message.Payload, err)
+	}
+
+	return command
+}
+
+// Config publishing through the fake IoT Core to the given devices
+func fakeIoTConfig(iot *fakeIoT, clientIds ...string) Config {
+	return Config{
+		Transport:       "iot",
+		ControlMode:     "topic",
+		ControlType:     "relay",
+		IotEndpoint:     "default.iot.test",
+		IoTClients:      iot.clients,
+		ShellyClientIds: clientIds,
+		TopicTemplate:   DEFAULT_TOPIC_TEMPLATE,
+		PublishRetry:    testRetry,
+		CurtailTopic:    "{clientId}/command/curtail",
+	}
+}
+
+func TestSendCommandPublishesToEveryDevice(t *testing.T) {
+	iot := newFakeIoT()
+	cfg := fakeIoTConfig(iot, "shelly-a", "shelly-b")
+	cfg.Devices = map[string]DeviceConfig{"shelly-b": {Invert: boolPtr(true)}}
+
+	err := sendCommand(context.Background(), cfg, true, nil, CommandMeta{Reason: "test", Sequence: 7})
+	if err != nil {
+		t.Fatalf("sendCommand: %v", err)
+	}
+
+	messages := iot.messages()
+	if len(messages) != 2 {
+		t.Fatalf("published %d messages, want 2", len(messages))
+	}
+
+	want := map[string]string{"shelly-a/command/switch:0": "on", "shelly-b/command/switch:0": "off"}
+
+	for _, message := range messages {
+		command := decodeCommand(t, message)
+
+		if command.Command != want[message.Topic] {
+			t.Errorf("topic %s got command %q, want %q", message.Topic, command.Command, want[message.Topic])
+		}
+		if command.Reason != "test" || command.Sequence != 7 || command.Source != COMMAND_SOURCE {
+			t.Errorf("topic %s got %+v, want reason, sequence and source carried over", message.Topic, command)
+		}
+		if message.Endpoint != "default.iot.test" {
+			t.Errorf("topic %s published to %s, want IOT_ENDPOINT", message.Topic, message.Endpoint)
+		}
+	}
+}
+
+func TestSendCommandCollectsDeviceFailures(t *testing.T) {
+	iot := newFakeIoT()
+	iot.fail["shelly-a/command/switch:0"] = errors.New("access denied")
+	cfg := fakeIoTConfig(iot, "shelly-a", "shelly-b")
+
+	err := sendCommand(context.Background(), cfg, false, nil, CommandMeta{})
+	if err == nil || !strings.Contains(err.Error(), "shelly-a") {
+		t.Fatalf("error = %v, want one naming shelly-a", err)
+	}
+
+	messages := iot.messages()
+	if len(messages) != 1 || messages[0].Topic != "shelly-b/command/switch:0" {
+		t.Errorf("published %+v, want only shelly-b", messages)
+	}
+}
+
+func TestSendCommandRoutesIoTTargets(t *testing.T) {
+	iot := newFakeIoT()
+	cfg := fakeIoTConfig(iot, "shelly-a", "shelly-b")
+	cfg.IotTargets = []IoTTarget{{Endpoint: "other.iot.test", RoleARN: "arn:aws:iam::123456789012:role/publisher", ClientIds: []string{"shelly-b"}}}
+
+	err := sendCommand(context.Background(), cfg, true, nil, CommandMeta{})
+	if err != nil {
+		t.Fatalf("sendCommand: %v", err)
+	}
+
+	endpoints := map[string]string{}
+	for _, message := range iot.messages() {
+		endpoints[message.Topic] = message.Endpoint
+	}
+
+	if endpoints["shelly-a/command/switch:0"] != "default.iot.test" || endpoints["shelly-b/command/switch:0"] != "other.iot.test" {
+		t.Errorf("published to %v, want shelly-b through its target", endpoints)
+	}
+}
+
+func TestSendCommandWithoutDefaultEndpoint(t *testing.T) {
+	iot := newFakeIoT()
+	cfg := fakeIoTConfig(iot, "shelly-a", "shelly-b")
+	cfg.IotEndpoint = ""
+	cfg.IotTargets = []IoTTarget{{Endpoint: "other.iot.test", ClientIds: []string{"shelly-b"}}}
+
+	err := sendCommand(context.Background(), cfg, true, nil, CommandMeta{})
+	if err == nil || !strings.Contains(err.Error(), "IOT_ENDPOINT") {
+		t.Fatalf("error = %v, want shelly-a to fail without IOT_ENDPOINT", err)
+	}
+
+	messages := iot.messages()
+	if len(messages) != 1 || messages[0].Endpoint != "other.iot.test" {
+		t.Errorf("published %+v, want shelly-b through its target", messages)
+	}
+}
+
+func boolPtr(value bool) *bool {
+	return &value
+}
+
+func TestSendCommandRetain(t *testing.T) {
+	for _, retain := range []bool{false, true} {
+		iot := newFakeIoT()
+		cfg := fakeIoTConfig(iot, "shelly-a")
+		cfg.MqttRetain = retain
+
+		err := sendCommand(context.Background(), cfg, true, nil, CommandMeta{})
+		if err != nil {
+			t.Fatalf("sendCommand: %v", err)
+		}
+
+		messages := iot.messages()
+		if len(messages) != 1 || messages[0].Retain != retain {
+			t.Errorf("MQTT_RETAIN=%t published %+v, want one message with retain %t", retain, messages, retain)
+		}
+	}
+}
+
+func TestLoadConfigRetain(t *testing.T) {
+	t.Setenv("SHELLY_CLIENT_IDS", "shelly-a")
+	t.Setenv("IOT_ENDPOINT", "default.iot.test")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.MqttRetain {
+		t.Error("MqttRetain is on by default, want off")
+	}
+
+	t.Setenv("MQTT_RETAIN", "true")
+
+	cfg, err = loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if !cfg.MqttRetain {
+		t.Error("MQTT_RETAIN=true left MqttRetain off")
+	}
+}
+
+func TestClassifyPublishError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantRetry      bool
+		wantRetryAfter time.Duration
+	}{
+		{name: "throttled", err: newResponseError(http.StatusTooManyRequests, ""), wantRetry: true},
+		{name: "throttled with Retry-After", err: newResponseError(http.StatusTooManyRequests, "3"), wantRetry: true, wantRetryAfter: 3 * time.Second},
+		{name: "service unavailable", err: newResponseError(http.StatusServiceUnavailable, ""), wantRetry: true},
+		{name: "network failure", err: errors.New("connection reset"), wantRetry: true},
+		{name: "forbidden", err: newResponseError(http.StatusForbidden, "")},
+		{name: "bad request", err: newResponseError(http.StatusBadRequest, "")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := classifyPublishError(context.Background(), tt.err)
+
+			var retryErr *retryableError
+			if errors.As(err, &retryErr) != tt.wantRetry {
+				t.Fatalf("classifyPublishError = %v, want retryable: %t", err, tt.wantRetry)
+			}
+			if tt.wantRetry && retryErr.retryAfter != tt.wantRetryAfter {
+				t.Errorf("retryAfter = %s, want %s", retryErr.retryAfter, tt.wantRetryAfter)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Errorf("classifyPublishError = %v, want it to wrap %v", err, tt.err)
+			}
+		})
+	}
+
+	// A cancelled publish isn't retried
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var retryErr *retryableError
+	if err := classifyPublishError(ctx, errors.New("connection reset")); errors.As(err, &retryErr) {
+		t.Errorf("classifyPublishError after cancel = %v, want a final error", err)
+	}
+}
+
+func TestPublishPayloadRetry(t *testing.T) {
+	const topic = "shelly-a/command/switch:0"
+
+	tests := []struct {
+		name         string
+		failures     []error
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "throttled twice", failures: []error{newResponseError(http.StatusTooManyRequests, ""), newResponseError(http.StatusTooManyRequests, "")}, wantAttempts: 3},
+		{name: "service unavailable once", failures: []error{newResponseError(http.StatusServiceUnavailable, "")}, wantAttempts: 2},
+		{name: "network failure once", failures: []error{errors.New("connection reset")}, wantAttempts: 2},
+		{name: "forbidden is final", failures: []error{newResponseError(http.StatusForbidden, "")}, wantAttempts: 1, wantErr: true},
+		{name: "attempts exhausted", failures: []error{newResponseError(http.StatusServiceUnavailable, ""), newResponseError(http.StatusServiceUnavailable, ""), newResponseError(http.StatusServiceUnavailable, "")}, wantAttempts: 3, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iot := newFakeIoT()
+			iot.failFirst[topic] = tt.failures
+			client, _ := iot.clients(context.Background(), IoTTarget{Endpoint: "default.iot.test"})
+
+			cfg := Config{PublishRetry: RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}}
+
+			err := publishPayload(context.Background(), client, cfg, topic, []byte("on"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("publishPayload = %v, want an error: %t", err, tt.wantErr)
+			}
+
+			if attempts := iot.publishAttempts(topic); attempts != tt.wantAttempts {
+				t.Errorf("made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+			if messages := iot.messages(); (len(messages) == 1) == tt.wantErr {
+				t.Errorf("published %+v, want the message delivered: %t", messages, !tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPublishPayloadHonoursRetryAfter(t *testing.T) {
+	const topic = "shelly-a/command/switch:0"
+
+	iot := newFakeIoT()
+	iot.failFirst[topic] = []error{newResponseError(http.StatusTooManyRequests, "1")}
+	client, _ := iot.clients(context.Background(), IoTTarget{Endpoint: "default.iot.test"})
+
+	started := time.Now()
+
+	err := publishPayload(context.Background(), client, Config{PublishRetry: testRetry}, topic, []byte("on"))
+	if err != nil {
+		t.Fatalf("publishPayload: %v", err)
+	}
+
+	if elapsed := time.Since(started); elapsed < time.Second {
+		t.Errorf("retried after %s, want at least the 1s Retry-After over the 1ms base delay", elapsed)
+	}
+	if attempts := iot.publishAttempts(topic); attempts != 2 {
+		t.Errorf("made %d attempts, want 2", attempts)
+	}
+}
+
+func TestValidateCommand(t *testing.T) {
+	topic := "shelly-a/command/switch:0"
+	valid, err := buildCommandPayload("on", "test", 1, time.Date(2024, 1, 2, 13, 0, 0, 0, time.UTC), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		legacy  bool
+		wantErr bool
+	}{
+		{name: "structured command", topic: topic, payload: string(valid)},
+		{name: "legacy on", topic: topic, payload: "on", legacy: true},
+		{name: "legacy off", topic: topic, payload: "off", legacy: true},
+		{name: "legacy garbage", topic: topic, payload: "toggle", legacy: true, wantErr: true},
+		{name: "legacy payload in structured mode", topic: topic, payload: "on", wantErr: true},
+		{name: "unknown command", topic: topic, payload: `{"command":"toggle","timestamp":"2024-01-02T13:00:00Z"}`, wantErr: true},
+		{name: "unknown field", topic: topic, payload: `{"command":"on","timestamp":"2024-01-02T13:00:00Z","brightness":5}`, wantErr: true},
+		{name: "bad timestamp", topic: topic, payload: `{"command":"on","timestamp":"yesterday"}`, wantErr: true},
+		{name: "unexpanded placeholder", topic: "{device}/command/switch:0", payload: "on", legacy: true, wantErr: true},
+		{name: "wildcard", topic: "shelly-a/command/#", payload: "on", legacy: true, wantErr: true},
+		{name: "empty level", topic: "shelly-a//switch:0", payload: "on", legacy: true, wantErr: true},
+		{name: "leading slash", topic: "/shelly-a/command", payload: "on", legacy: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCommand(tt.topic, []byte(tt.payload), tt.legacy)
+
+			if tt.wantErr && !errors.Is(err, ErrInvalidCommand) {
+				t.Errorf("validateCommand = %v, want ErrInvalidCommand", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("validateCommand: %v", err)
+			}
+		})
+	}
+}
+
+func TestSendCommandRejectsInvalidTopic(t *testing.T) {
+	iot := newFakeIoT()
+	cfg := fakeIoTConfig(iot, "shelly-a")
+	cfg.TopicTemplate = "{clientId}/{command}/switch:{channel}"
+
+	cfg.PublishRetry = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+
+	err := sendCommand(context.Background(), cfg, true, nil, CommandMeta{})
+	if !errors.Is(err, ErrInvalidCommand) {
+		t.Errorf("error = %v, want ErrInvalidCommand", err)
+	}
+	if messages := iot.messages(); len(messages) != 0 {
+		t.Errorf("published %+v, want nothing sent to the relay", messages)
+	}
+
+	// The invalid command is final, never attempted or retried
+	if attempts := iot.publishAttempts(buildTopic(cfg.TopicTemplate, "shelly-a", cfg.SwitchChannel)); attempts != 0 {
+		t.Errorf("made %d publish attempts, want none", attempts)
+	}
+}
+
+func TestSendCommandLegacyPayload(t *testing.T) {
+	iot := newFakeIoT()
+	cfg := fakeIoTConfig(iot, "shelly-a")
+	cfg.LegacyPayload = true
+
+	if err := sendCommand(context.Background(), cfg, true, nil, CommandMeta{}); err != nil {
+		t.Fatalf("sendCommand: %v", err)
+	}
+
+	messages := iot.messages()
+	if len(messages) != 1 || string(messages[0].Payload) != "on" {
+		t.Errorf("published %+v, want the bare on payload", messages)
+	}
+}
+
+func TestLoadConfigRejectsInvalidTopicTemplate(t *testing.T) {
+	t.Setenv("SHELLY_CLIENT_IDS", "shelly-a")
+	t.Setenv("IOT_ENDPOINT", "default.iot.test")
+
+	for _, template := range []string{"{device}/command", "shellies/+/command", "{clientId}/command/"} {
+		t.Setenv("TOPIC_TEMPLATE", template)
+
+		if _, err := loadConfig(); err == nil {
+			t.Errorf("TOPIC_TEMPLATE=%s loaded, want an error", template)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Install the default logger: JSON for CloudWatch Logs Insights, or text for
+// humans running the CLI. log.Printf output is routed through it as well
+func setupLogging(level string, human bool) error {
+	var logLevel slog.Level
+
+	switch strings.ToLower(level) {
+	case "debug":
+		logLevel = slog.LevelDebug
+	case "", "info":
+		logLevel = slog.LevelInfo
+	case "warn", "warning":
+		logLevel = slog.LevelWarn
+	case "error":
+		logLevel = slog.LevelError
+	default:
+		return fmt.Errorf("LOG_LEVEL must be debug, info, warn or error, got %q", level)
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+
+	var handler slog.Handler = slog.NewJSONHandler(os.Stderr, options)
+	if human {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	}
+
+	slog.SetDefault(slog.New(handler))
+
+	return nil
+}
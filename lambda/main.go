@@ -1,25 +1,80 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strings"
+	"sync"
 	"time"
+	_ "time/tzdata"
 
 	"github.com/aws/aws-lambda-go/lambda"
-	"github.com/aws/aws-sdk-go-v2/config"
-	"github.com/aws/aws-sdk-go-v2/service/iotdataplane"
+	"github.com/aws/aws-lambda-go/lambda/messages"
 )
 
+// Prices, fees and thresholds are per PRICE_UNIT in the provider's currency;
+// DEFAULT_FEED_IN_FEE is the Frank Energie contract fee, i.e. in euros
 const (
-	PURCHASE_FEE_FEED_IN  = -0.012705
+	DEFAULT_FEED_IN_FEE   = -0.012705
+	DEFAULT_CURRENCY      = "EUR"
 	FRANK_ENERGIE_API_URL = "https://www.frankenergie.nl/graphql"
+	PRICE_TIMEZONE        = "Europe/Amsterdam"
+	PRICE_UNIT            = "kWh"
+
+	// Local hour from which tomorrow's day-ahead prices can be published
+	DAY_AHEAD_PUBLICATION_HOUR = 13
+)
+
+// Failure classes surfaced to callers of the handler
+var (
+	ErrConfig  = errors.New("invalid configuration")
+	ErrFetch   = errors.New("price fetch failed")
+	ErrPublish = errors.New("command publish failed")
+	ErrNoPrice = errors.New("no price found")
+
+	// Wrapped together with ErrNoPrice, so stale data takes the fallback
+	ErrStalePrices = errors.New("stale price data")
+
+	ErrCircuitOpen = errors.New("circuit breaker open")
+
+	// Wrapped together with ErrFetch when the provider answered 429 on every attempt
+	ErrRateLimited = errors.New("rate limited")
 )
 
+// Name of the failure class of err, the errorType Step Functions can catch
+// on; the most specific class wins, e.g. a missing price over its fetch error
+func errorType(err error) string {
+	switch {
+	case errors.Is(err, ErrConfig):
+		return "ConfigError"
+	case errors.Is(err, ErrNoPrice):
+		return "NoPriceError"
+	case errors.Is(err, ErrRateLimited):
+		return "RateLimitedError"
+	case errors.Is(err, ErrFetch):
+		return "FetchError"
+	case errors.Is(err, ErrPublish):
+		return "PublishError"
+	default:
+		return "InternalError"
+	}
+}
+
+// Lambda entry point reporting the failure class as the errorType, instead
+// of the Go type name of the wrapped error
+func lambdaHandler(ctx context.Context, event HandlerEvent) (HandlerResult, error) {
+	result, err := handler(ctx, event)
+	if err != nil {
+		return result, messages.InvokeResponse_Error{Type: errorType(err), Message: err.Error()}
+	}
+
+	return result, nil
+}
+
 // GraphQL request structure
 type GraphQLRequest struct {
 	Query         string                 `json:"query"`
@@ -32,8 +87,10 @@ type MarketPricesResponse struct {
 	Data struct {
 		MarketPrices struct {
 			ElectricityPrices []ElectricityPrice `json:"electricityPrices"`
+			GasPrices         []ElectricityPrice `json:"gasPrices"`
 		} `json:"marketPrices"`
 	} `json:"data"`
+	Errors []GraphQLError `json:"errors"`
 }
 
 type ElectricityPrice struct {
@@ -48,49 +105,947 @@ type IoTCommand struct {
 	Command   string `json:"command"`
 	Timestamp string `json:"timestamp"`
 	Reason    string `json:"reason"`
+	Source    string `json:"source"`
+	Sequence  int64  `json:"sequence,omitempty"`
+}
+
+// Outcome of a single invocation, returned to the caller (e.g. Step Functions)
+type HandlerResult struct {
+	MarketPrice         float64     `json:"marketPrice"`
+	Provider            string      `json:"provider,omitempty"`
+	PeriodFrom          string      `json:"periodFrom,omitempty"`
+	PeriodTill          string      `json:"periodTill,omitempty"`
+	EffectivePrice      float64     `json:"effectivePrice"`
+	DecisionPrice       float64     `json:"decisionPrice"`
+	ShouldDisableSolar  bool        `json:"shouldDisableSolar"`
+	CurtailLimit        *int        `json:"curtailLimit,omitempty"`
+	CommandSent         bool        `json:"commandSent"`
+	Sequence            int64       `json:"sequence,omitempty"`
+	Fallback            string      `json:"fallback,omitempty"`
+	Stale               bool        `json:"stale,omitempty"`
+	SafeState           string      `json:"safeState,omitempty"`
+	OutsideControlHours bool        `json:"outsideControlHours,omitempty"`
+	Override            bool        `json:"override,omitempty"`
+	Held                bool        `json:"held,omitempty"`
+	PreWindow           bool        `json:"preWindow,omitempty"`
+	Forecast            bool        `json:"forecast,omitempty"`
+	Duplicate           bool        `json:"duplicate,omitempty"`
+	Unchanged           bool        `json:"unchanged,omitempty"`
+	Revised             bool        `json:"revised,omitempty"`
+	Reconciled          bool        `json:"reconciled,omitempty"`
+	BatterySOC          *float64    `json:"batterySoc,omitempty"`
+	NegativeProbability *float64    `json:"negativeProbability,omitempty"`
+	EstimatedSavings    float64     `json:"estimatedSavings,omitempty"`
+	GasPrice            *float64    `json:"gasPrice,omitempty"`
+	GasDevicesOn        *bool       `json:"gasDevicesOn,omitempty"`
+	FetchFailures       int         `json:"fetchFailures"`
+	FetchStats          *FetchStats `json:"fetchStats,omitempty"`
+	BreakerOpen         bool        `json:"breakerOpen"`
+	NextTransitionAt    time.Time   `json:"nextTransitionAt"`
+	NextState           string      `json:"nextState,omitempty"`
+	Timestamp           time.Time   `json:"timestamp"`
+}
+
+// Invocation payload, e.g. the input of an EventBridge Scheduler one-off
+// schedule; other events, such as scheduled rule events, leave both empty
+type HandlerEvent struct {
+	Date string `json:"date,omitempty"`
+	AsOf string `json:"asOf,omitempty"`
+}
+
+func handler(ctx context.Context, event HandlerEvent) (HandlerResult, error) {
+	// Load runtime configuration
+	cfg, err := loadConfig()
+	if err != nil {
+		slog.Error("Error loading configuration", "error", err)
+		return HandlerResult{}, fmt.Errorf("%w: %w", ErrConfig, err)
+	}
+
+	cfg, err = applyEvent(cfg, event)
+	if err != nil {
+		slog.Error("Invalid invocation event", "error", err)
+		return HandlerResult{}, fmt.Errorf("%w: %w", ErrConfig, err)
+	}
+
+	return Run(ctx, cfg)
+}
+
+// Evaluate the date and instant carried by the event instead of today and
+// AS_OF, like the --date and --as-of flags of the CLI. A replayed instant is a
+// dry run, as with AS_OF
+func applyEvent(cfg Config, event HandlerEvent) (Config, error) {
+	if event.Date != "" {
+		_, err := time.Parse("2006-01-02", event.Date)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid value %q for date, expected YYYY-MM-DD: %w", event.Date, err)
+		}
+		cfg.Date = event.Date
+	}
+
+	if event.AsOf != "" {
+		clock, err := fixedClock(event.AsOf)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid value %q for asOf, expected RFC3339 such as 2024-01-02T13:00:00+01:00: %w", event.AsOf, err)
+		}
+		cfg.Now = clock
+		cfg.DryRun = true
+	}
+
+	return cfg, nil
+}
+
+// Run the full decision pipeline once, shared by the Lambda, HTTP and CLI entry points
+func Run(ctx context.Context, cfg Config) (HandlerResult, error) {
+	result, err := run(ctx, cfg)
+
+	// Let devices and monitoring react to the failure, e.g. by going to a
+	// safe local state, unless publishing itself is what failed
+	if err != nil && cfg.PublishErrors && !errors.Is(err, ErrPublish) {
+		if cfg.DryRun {
+			slog.Info("Dry run: would publish error notice", "error_type", errorType(err))
+		} else {
+			publishErr := reportError(ctx, cfg, err, configClock(cfg)())
+			if publishErr != nil {
+				slog.Error("Error publishing error notice", "error", publishErr)
+			}
+		}
+	}
+
+	return result, err
+}
+
+func run(ctx context.Context, cfg Config) (HandlerResult, error) {
+	var result HandlerResult
+
+	controllerMetrics.RecordRun()
+
+	// Catch misconfiguration before spending any API calls
+	err := validateConfig(cfg)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		return result, fmt.Errorf("%w: %w", ErrConfig, err)
+	}
+
+	fees := []any{"total", cfg.FeedInFee, "currency", cfg.Currency}
+	for _, component := range cfg.FeeComponents {
+		fees = append(fees, strings.ToLower(component.Name), component.Value)
+	}
+	slog.Info("Fee breakdown", fees...)
+
+	// A cost entered as a positive number would raise the effective price
+	// instead of lowering it and shift every decision
+	if cfg.FeedInFee > 0 {
+		slog.Warn("Total fee is positive and adds to the export revenue; enter costs per exported kWh as negative values", "total", cfg.FeedInFee)
+	}
+
+	// All persisted state goes through one store, a no-op without STATE_TABLE
+	store := cfg.StateStore
+	if store == nil {
+		store, err = newStateStore(cfg)
+		if err != nil {
+			slog.Error("Error configuring state store", "error", err)
+			return result, fmt.Errorf("%w: %w", ErrConfig, err)
+		}
+	}
+
+	// Read the last command state, defaulting to enabled on the first run
+	state, stateFound, err := store.GetState(ctx)
+	if err != nil {
+		slog.Error("Error loading controller state", "error", err)
+		return result, err
+	}
+
+	if !stateFound && cfg.StateStoreKind != "none" {
+		slog.Info("No previous state found, assuming solar is enabled")
+	}
+
+	// Price days follow LOCATION local time, not the runtime's zone
+	location, err := priceLocation(cfg)
+	if err != nil {
+		slog.Error("Error loading time zone", "location", cfg.Location, "error", err)
+		return result, fmt.Errorf("%w: %w", ErrConfig, err)
+	}
+
+	// Read the time through the configured clock, so runs can be pinned to a fixed instant
+	now := configClock(cfg)()
+
+	// An explicit date is evaluated at the current local time of day
+	if cfg.Date != "" {
+		day, err := time.ParseInLocation("2006-01-02", cfg.Date, location)
+		if err != nil {
+			slog.Error("Error parsing date", "date", cfg.Date, "error", err)
+			return result, fmt.Errorf("%w: %w", ErrConfig, err)
+		}
+
+		local := now.In(location)
+		now = time.Date(day.Year(), day.Month(), day.Day(), local.Hour(), local.Minute(), local.Second(), 0, location)
+	}
+
+	date := now.In(location).Format("2006-01-02")
+	result.Timestamp = now
+
+	// The rest of the run decides on the threshold of the local weekday
+	cfg.DisableThreshold = dayThreshold(cfg, now.In(location))
+
+	// Leave the relay alone outside the daylight hours under control, once
+	// it is back in the default enabled state
+	if cfg.ControlHours != nil && !cfg.ControlHours.Contains(now.In(location).Hour()) {
+		slog.Info("Outside CONTROL_HOURS, skipping decision",
+			"control_hours", cfg.ControlHours.String(), "local_time", now.In(location).Format("15:04"))
+		result.OutsideControlHours = true
+
+		if stateFound && state.SolarDisabled {
+			return enableOutsideControlHours(ctx, cfg, store, state, result, now)
+		}
+		return result, nil
+	}
+
+	// Fetch market prices from the configured provider
+	provider, err := newPriceProvider(cfg)
+	if err != nil {
+		slog.Error("Error configuring price provider", "error", err)
+		return result, fmt.Errorf("%w: %w", ErrConfig, err)
+	}
+
+	// A manual override replaces the price-based decision until it expires
+	override, overrideActive, err := store.GetOverride(ctx, now)
+	if err != nil {
+		slog.Error("Error loading manual override", "error", err)
+		return result, err
+	}
+
+	// Skip the fetch entirely during an override or while the circuit breaker is open
+	var prices []ElectricityPrice
+	var cachedPrices []ElectricityPrice
+
+	breakerOpen := cfg.BreakerThreshold > 0 && state.FetchFailures >= cfg.BreakerThreshold &&
+		now.Sub(state.BreakerOpenedAt) < cfg.BreakerCooldown
+
+	if overrideActive {
+		slog.Warn("Manual override in effect, skipping price-based decision",
+			"should_disable", override.SolarDisabled, "expires_at", override.ExpiresAt)
+	} else if breakerOpen {
+		slog.Warn("Circuit breaker open, skipping price fetch",
+			"fetch_failures", state.FetchFailures, "retry_at", state.BreakerOpenedAt.Add(cfg.BreakerCooldown))
+	} else {
+		caching, isCaching := provider.(*CachingProvider)
+
+		// Time the upstream requests, a cache hit makes none
+		fetchCtx, stats := withFetchStats(ctx)
+
+		if cfg.RevalidatePrices && !isCaching {
+			slog.Warn("REVALIDATE_PRICES needs the price cache as the only provider, skipping revalidation",
+				"provider", cfg.PriceProvider, "backup_providers", strings.Join(cfg.BackupPriceProviders, ","))
+		}
+
+		if cfg.RevalidatePrices && isCaching {
+			prices, cachedPrices, err = caching.Revalidate(fetchCtx, date)
+		} else {
+			prices, err = provider.FetchPrices(fetchCtx, date)
+		}
+		result.FetchStats = stats
+
+		if err != nil {
+			slog.Error("Error fetching market prices", "provider", cfg.PriceProvider, "requests", stats.Requests,
+				"fetch_duration_ms", stats.DurationMs, "status_code", stats.StatusCode, "error", err)
+			recordFetchFailure(ctx, cfg, store, state, now)
+			controllerMetrics.RecordFetchFailure()
+			return applySafeState(ctx, cfg, store, result, fmt.Errorf("%w: %w", ErrFetch, err))
+		}
+
+		// Report which provider actually served the prices
+		result.Provider = cfg.PriceProvider
+		if failover, ok := provider.(*FailoverProvider); ok {
+			result.Provider = failover.Served
+		}
+
+		slog.Info("Fetched market prices", "provider", result.Provider, "requests", stats.Requests,
+			"fetch_duration_ms", stats.DurationMs, "status_code", stats.StatusCode, "periods", len(prices))
+
+		// Reset the breaker on the first success
+		state.FetchFailures = 0
+		state.BreakerOpenedAt = time.Time{}
+	}
+
+	result.FetchFailures = state.FetchFailures
+	result.BreakerOpen = breakerOpen
+
+	// Protect the schedule and window calculations from bad upstream data
+	anomalies := validatePrices(prices)
+
+	for _, anomaly := range anomalies {
+		slog.Warn("Price data anomaly", "provider", result.Provider, "anomaly", anomaly)
+	}
+
+	if len(anomalies) > 0 && cfg.PriceValidation == "error" {
+		return applySafeState(ctx, cfg, store, result, fmt.Errorf("%w: %d anomalies in price data from %s: %s", ErrFetch, len(anomalies), result.Provider, strings.Join(anomalies, "; ")))
+	}
+
+	// Log the full day's schedule for reference
+	for _, entry := range strategySchedule(prices, cfg) {
+		slog.Debug("Schedule entry", "from", entry.From, "till", entry.Till,
+			"effective_price", entry.EffectivePrice, "should_disable", entry.ShouldDisable)
+	}
+
+	// Log negative-price windows, e.g. for scheduling battery charging
+	windows := findNegativePriceWindows(prices, cfg.FeedInFee)
+
+	for _, window := range windows {
+		slog.Info("Negative price window", "start", window.Start, "end", window.End, "avg_effective_price", window.AvgPrice)
+	}
+
+	// Estimate what not exporting during those windows saves over the day
+	if cfg.InverterKw > 0 {
+		result.EstimatedSavings = estimateSavings(windows, cfg.InverterKw)
+		slog.Info("Estimated savings from avoided export", "estimated_savings", result.EstimatedSavings, "inverter_kw", cfg.InverterKw)
+	}
+
+	// Find the price of the current period
+	var shouldDisableSolar bool
+	var effectivePrice float64
+	var reason string
+
+	// Decision price for curtailment, nil on a fallback
+	var curtailDecisionPrice *float64
+
+	// Decisions of the devices with their own threshold, nil on a fallback
+	var deviceDecisions map[string]bool
+
+	var period ElectricityPrice
+
+	if overrideActive {
+		err = nil
+	} else if breakerOpen {
+		err = ErrCircuitOpen
+	} else {
+		period, err = getFreshPrice(prices, now, cfg.FreshnessTolerance)
+	}
+
+	if overrideActive {
+		shouldDisableSolar = override.SolarDisabled
+		reason = fmt.Sprintf("manual override until %s", override.ExpiresAt.UTC().Format(time.RFC3339))
+		result.Override = true
+		result.ShouldDisableSolar = shouldDisableSolar
+	} else if (errors.Is(err, ErrNoPrice) || errors.Is(err, ErrCircuitOpen)) && cfg.DefaultOnMissing != "error" {
+		// Fall back rather than leaving the inverter in whatever state it was
+		shouldDisableSolar = cfg.DefaultOnMissing == "keep" && state.SolarDisabled
+		reason = fmt.Sprintf("no price for current period, fallback: %s", cfg.DefaultOnMissing)
+
+		if errors.Is(err, ErrStalePrices) {
+			slog.Warn("Price data is stale", "provider", result.Provider, "error", err)
+			reason = fmt.Sprintf("stale price data, fallback: %s", cfg.DefaultOnMissing)
+			result.Stale = true
+		}
+
+		slog.Warn("Applying DEFAULT_ON_MISSING fallback", "fallback", cfg.DefaultOnMissing,
+			"should_disable", shouldDisableSolar, "error", err)
+		result.Fallback = cfg.DefaultOnMissing
+		result.ShouldDisableSolar = shouldDisableSolar
+	} else if err != nil {
+		slog.Error("Error finding current price", "error", err)
+		return applySafeState(ctx, cfg, store, result, fmt.Errorf("%w: %w", ErrFetch, err))
+	} else {
+		currentPrice := period.MarketPrice
+		result.MarketPrice = currentPrice
+		result.PeriodFrom = period.From
+		result.PeriodTill = period.Till
+
+		// Apply the decision logic
+		decision := decide(period, newDecisionConfig(cfg, prices, now, state.SolarDisabled))
+		effectivePrice = decision.EffectivePrice
+		decisionPrice := decision.DecisionPrice
+		curtailDecisionPrice = &decisionPrice
+		shouldDisableSolar = decision.ShouldDisable
+		reason = decision.Reason
+
+		// A revision that changes the decision on the cached prices forces a
+		// re-evaluation, whatever the strategy
+		if cachedPrices != nil {
+			cachedPeriod, err := getCurrentPrice(cachedPrices, now)
+			if err == nil {
+				cachedDecision := decide(cachedPeriod, newDecisionConfig(cfg, cachedPrices, now, state.SolarDisabled))
+				if cachedDecision.ShouldDisable != shouldDisableSolar {
+					slog.Warn("Retroactive price revision changed the decision",
+						"period_from", period.From, "cached_market_price", cachedPeriod.MarketPrice, "market_price", currentPrice,
+						"cached_should_disable", cachedDecision.ShouldDisable, "should_disable", shouldDisableSolar)
+					result.Revised = true
+				}
+			}
+		}
+
+		// PRE_WINDOW_MINUTES, the forecast and the battery gate, shared with the
+		// per-device decisions
+		gates := newDecisionGates(ctx, cfg, provider, prices, windows, now, location)
+
+		gated := gates.apply(shouldDisableSolar, effectivePrice, cfg.DisableThreshold)
+		shouldDisableSolar = gated.ShouldDisable
+		result.PreWindow = gated.PreWindow
+		result.Forecast = gated.Forecast
+		result.NegativeProbability = gated.Probability
+		result.BatterySOC = gated.BatterySOC
+
+		if hasDeviceThresholds(cfg) {
+			deviceDecisions = decideDevices(cfg, period, prices, now, state.SolarDisabled, gates)
+		}
+
+		slog.Info("Price decision",
+			"strategy", cfg.Strategy,
+			"currency", cfg.Currency,
+			"period_from", period.From,
+			"period_till", period.Till,
+			"market_price", currentPrice,
+			"feed_in_fee", cfg.FeedInFee,
+			"effective_price", effectivePrice,
+			"decision_price", decisionPrice,
+			"decision_window", cfg.DecisionWindow,
+			"threshold", cfg.DisableThreshold,
+			"hysteresis", cfg.SwitchHysteresis,
+			"previously_disabled", state.SolarDisabled,
+			"should_disable", shouldDisableSolar)
+		result.EffectivePrice = effectivePrice
+		result.DecisionPrice = decisionPrice
+		result.ShouldDisableSolar = shouldDisableSolar
+
+		if result.Forecast {
+			reason += fmt.Sprintf(", forecast %.0f%% chance of negative prices (threshold %.0f%%)",
+				*result.NegativeProbability*100, cfg.ForecastProbability*100)
+		}
+
+		if result.BatterySOC != nil {
+			reason += fmt.Sprintf(", battery %.1f%% (threshold %.1f%%)", *result.BatterySOC, cfg.BatterySOCThreshold)
+		}
+	}
+
+	// Hold the current state if it only changed recently, to protect the relay,
+	// unless the change corrects a revised price or is forced by an override
+	if stateFound && shouldDisableSolar != state.SolarDisabled && now.Sub(state.ChangedAt) < cfg.MinStateDuration && !result.Revised && !result.Override {
+		slog.Info("Holding current state within MIN_STATE_DURATION",
+			"should_disable", state.SolarDisabled, "changed_at", state.ChangedAt, "min_state_duration", cfg.MinStateDuration)
+		shouldDisableSolar = state.SolarDisabled
+		result.ShouldDisableSolar = shouldDisableSolar
+		result.Held = true
+	}
+
+	// Skip republishing the state the devices already have, unless a device
+	// decides on its own threshold, which the stored state doesn't cover, or
+	// the devices are being reconciled after missed runs
+	if cfg.SkipUnchanged && !cfg.Reconcile && stateFound && !result.Held && !result.Revised && shouldDisableSolar == state.SolarDisabled && !hasDeviceThresholds(cfg) {
+		slog.Info("No change, skipping publish", "should_disable", shouldDisableSolar, "updated_at", state.UpdatedAt)
+		result.Unchanged = true
+	}
+
+	// Look ahead for the next expected toggle, e.g. for a dashboard countdown
+	if result.Fallback == "" && !result.Override {
+		result.NextTransitionAt, result.NextState = nextTransition(ctx, cfg, provider, prices, now, location, shouldDisableSolar)
+	}
+
+	// Turn a duplicate delivery of the scheduled event within the same period into a no-op
+	var idempotencyClaim string
+
+	if !result.Held && !result.Unchanged && cfg.IdempotencyTTL > 0 && !cfg.DryRun && !cfg.Reconcile {
+		key := idempotencyKey(currentPeriodStart(prices, now), shouldDisableSolar)
+
+		claimed, err := store.ClaimKey(ctx, key, now, cfg.IdempotencyTTL)
+		if err != nil {
+			slog.Error("Error checking idempotency key, sending anyway", "error", err)
+		} else if !claimed {
+			slog.Info("Duplicate invocation for this period and command, skipping", "idempotency_key", key)
+			result.Duplicate = true
+		} else {
+			idempotencyClaim = key
+		}
+	}
+
+	// Send the command through the configured transport
+	if !result.Held && !result.Duplicate && !result.Unchanged {
+		meta := commandMeta(ctx, cfg, store, reason)
+
+		if cfg.ControlType == "curtail" {
+			limit := resolveCurtailment(cfg, shouldDisableSolar, curtailDecisionPrice, result.PreWindow || result.Forecast)
+			result.CurtailLimit = &limit
+			err = sendCurtailment(ctx, cfg, limit, meta)
+		} else {
+			err = sendCommand(ctx, cfg, shouldDisableSolar, deviceDecisions, meta)
+		}
+		if !cfg.DryRun {
+			controllerMetrics.RecordPublish(err)
+		}
+		if err != nil {
+			slog.Error("Error sending command", "error", err)
+
+			// Let a retry of this invocation send the command again
+			if idempotencyClaim != "" {
+				releaseErr := store.ReleaseKey(ctx, idempotencyClaim)
+				if releaseErr != nil {
+					slog.Error("Error releasing idempotency key", "error", releaseErr)
+				}
+			}
+
+			return result, fmt.Errorf("%w: %w", ErrPublish, err)
+		}
+		result.CommandSent = !cfg.DryRun
+		result.Sequence = meta.Sequence
+		result.Reconciled = cfg.Reconcile
+
+		if result.Revised && shouldDisableSolar != state.SolarDisabled {
+			slog.Info("Retroactive price revision triggered a re-toggle", "should_disable", shouldDisableSolar)
+		}
+	}
+
+	// Gas devices follow their own price, without affecting the solar decision
+	if len(cfg.GasClientIds) > 0 {
+		gasPrice, gasOn, err := controlGasDevices(ctx, cfg, date, now)
+		if err != nil {
+			slog.Error("Error controlling gas devices", "error", err)
+		} else {
+			result.GasPrice = &gasPrice
+			result.GasDevicesOn = &gasOn
+		}
+	}
+
+	// Explain the relay's state to dashboards, without failing the run on errors
+	if cfg.PublishStatus {
+		if cfg.DryRun {
+			slog.Info("Dry run: would publish controller status", "should_disable", shouldDisableSolar)
+		} else {
+			err = publishStatus(ctx, cfg, result, reason)
+			if err != nil {
+				slog.Error("Error publishing controller status", "error", err)
+			}
+		}
+	}
+
+	// Persist the command state for the next run, unless nothing was published
+	if !cfg.DryRun {
+		changedAt := state.ChangedAt
+		if !stateFound || shouldDisableSolar != state.SolarDisabled {
+			changedAt = now
+		}
+
+		err = store.PutState(ctx, ControllerState{
+			SolarDisabled:   shouldDisableSolar,
+			UpdatedAt:       now,
+			ChangedAt:       changedAt,
+			FetchFailures:   state.FetchFailures,
+			BreakerOpenedAt: state.BreakerOpenedAt,
+		})
+		if err != nil {
+			slog.Error("Error saving controller state", "error", err)
+			return result, err
+		}
+	}
+
+	// Notify on state transitions, without failing the run on errors; without
+	// a prior state there is nothing to compare with
+	if cfg.TelegramBotToken != "" && cfg.TelegramChatId != "" && !cfg.DryRun && !result.Duplicate && stateFound && shouldDisableSolar != state.SolarDisabled {
+		message := "Solar inverter enabled: " + reason
+		if shouldDisableSolar {
+			message = "Solar inverter disabled: " + reason
+		}
+
+		err = sendTelegramNotification(ctx, newHTTPClient(cfg), cfg.TelegramBotToken, cfg.TelegramChatId, message)
+		if err != nil {
+			slog.Error("Error sending Telegram notification", "error", err)
+		}
+	}
+
+	// Let other automations react to the state flipping, without failing the
+	// run on errors; without a prior state there is nothing to compare with
+	if cfg.TransitionEventBus != "" && !cfg.DryRun && !result.Duplicate && stateFound && shouldDisableSolar != state.SolarDisabled {
+		var err error
+
+		client := cfg.EventPutter
+		if client == nil {
+			client, err = newEventBridgeClient(ctx)
+		}
+		if err == nil {
+			err = putTransitionEvent(ctx, client, cfg.TransitionEventBus, TransitionEvent{
+				PreviousState:  solarState(state.SolarDisabled),
+				NewState:       solarState(shouldDisableSolar),
+				EffectivePrice: effectivePrice,
+				Reason:         reason,
+				Timestamp:      now,
+			})
+		}
+		if err != nil {
+			slog.Error("Error emitting transition event", "error", err)
+		}
+	}
+
+	// Publish metrics, without failing the run on errors; dry runs stay out
+	// of CloudWatch so they don't skew the dashboards
+	if result.Fallback == "" && !result.Override {
+		controllerMetrics.RecordDecision(effectivePrice, shouldDisableSolar)
+
+		if cfg.DryRun {
+			slog.Info("Dry run: would publish metrics", "effective_price", effectivePrice, "should_disable", shouldDisableSolar)
+		} else {
+			err = publishMetrics(ctx, cfg.MetricsNamespace, now, controllerMetrics)
+			if err != nil {
+				slog.Error("Error publishing metrics", "error", err)
+			}
+		}
+	}
+
+	// Mirror the published command to a webhook, without failing the run on errors
+	if cfg.WebhookURL != "" && result.CommandSent {
+		err = postWebhook(ctx, newHTTPClient(cfg), cfg.WebhookURL, cfg.WebhookSecret, result)
+		if err != nil {
+			slog.Error("Error calling webhook", "error", err)
+		}
+	}
+
+	// Fan the decision out to SNS once the command is sent, without failing
+	// the run on errors
+	if cfg.DecisionTopicArn != "" && result.CommandSent {
+		err = publishDecision(ctx, cfg.DecisionTopicArn, result)
+		if err != nil {
+			slog.Error("Error publishing decision", "error", err)
+		}
+	}
+
+	// Keep an audit trail of every decision, without failing the run on errors
+	if cfg.DecisionLogBucket != "" && !cfg.DryRun {
+		var err error
+
+		client := cfg.ObjectStore
+		if client == nil {
+			client, err = newS3Client(ctx)
+		}
+		if err == nil {
+			err = appendDecisionLog(ctx, client, cfg.DecisionLogBucket, location, result)
+		}
+		if err != nil {
+			slog.Error("Error appending to decision log", "error", err)
+		}
+	}
+
+	slog.Info("Solar panel control completed successfully", "should_disable", shouldDisableSolar, "dry_run", cfg.DryRun)
+	return result, nil
+}
+
+// Publish SAFE_STATE when neither the prices nor a fallback produced a
+// decision, so the relay isn't left stuck; the run still fails with cause
+func applySafeState(ctx context.Context, cfg Config, store StateStore, result HandlerResult, cause error) (HandlerResult, error) {
+	if cfg.SafeState == "" {
+		return result, cause
+	}
+
+	shouldDisable := cfg.SafeState == "off"
+
+	slog.Error("No decision possible, applying SAFE_STATE", "safe_state", cfg.SafeState, "should_disable", shouldDisable, "error", cause)
+
+	meta := commandMeta(ctx, cfg, store, fmt.Sprintf("safe state %s: %v", cfg.SafeState, cause))
+
+	var err error
+
+	if cfg.ControlType == "curtail" {
+		limit := resolveCurtailment(cfg, shouldDisable, nil, false)
+		result.CurtailLimit = &limit
+		err = sendCurtailment(ctx, cfg, limit, meta)
+	} else {
+		err = sendCommand(ctx, cfg, shouldDisable, nil, meta)
+	}
+	if !cfg.DryRun {
+		controllerMetrics.RecordPublish(err)
+	}
+	if err != nil {
+		slog.Error("Error sending safe state command", "error", err)
+		return result, fmt.Errorf("%w (applying SAFE_STATE: %w: %w)", cause, ErrPublish, err)
+	}
+
+	result.SafeState = cfg.SafeState
+	result.ShouldDisableSolar = shouldDisable
+	result.CommandSent = !cfg.DryRun
+	result.Sequence = meta.Sequence
+
+	return result, cause
 }
 
-func handler(ctx context.Context) error {
-	// Get current date in the required format
-	now := time.Now()
-	date := now.Format("2006-01-02")
+// Send one enable command when the window closes with solar still disabled,
+// so it isn't left off until the next window opens
+func enableOutsideControlHours(ctx context.Context, cfg Config, store StateStore, state ControllerState, result HandlerResult, now time.Time) (HandlerResult, error) {
+	slog.Info("Outside CONTROL_HOURS with solar disabled, enabling it")
+
+	meta := commandMeta(ctx, cfg, store, "outside CONTROL_HOURS "+cfg.ControlHours.String())
+
+	var err error
 
-	// Fetch market prices
-	prices, err := fetchMarketPrices(date)
+	if cfg.ControlType == "curtail" {
+		limit := resolveCurtailment(cfg, false, nil, false)
+		result.CurtailLimit = &limit
+		err = sendCurtailment(ctx, cfg, limit, meta)
+	} else {
+		err = sendCommand(ctx, cfg, false, nil, meta)
+	}
+	if !cfg.DryRun {
+		controllerMetrics.RecordPublish(err)
+	}
 	if err != nil {
-		log.Printf("Error fetching market prices: %v", err)
-		return err
+		slog.Error("Error sending command", "error", err)
+		return result, fmt.Errorf("%w: %w", ErrPublish, err)
 	}
 
-	// Find current hour's price
-	currentPrice, err := getCurrentHourPrice(prices, now)
+	result.CommandSent = !cfg.DryRun
+	result.Sequence = meta.Sequence
+
+	if cfg.DryRun {
+		return result, nil
+	}
+
+	err = store.PutState(ctx, ControllerState{
+		SolarDisabled:   false,
+		UpdatedAt:       now,
+		ChangedAt:       now,
+		FetchFailures:   state.FetchFailures,
+		BreakerOpenedAt: state.BreakerOpenedAt,
+	})
 	if err != nil {
-		log.Printf("Error finding current hour price: %v", err)
-		return err
+		slog.Error("Error saving controller state", "error", err)
+		return result, err
 	}
 
-	log.Printf("Current market price: €%.5f/kWh", currentPrice)
+	return result, nil
+}
 
-	// Apply the decision logic
-	effectivePrice := currentPrice + PURCHASE_FEE_FEED_IN
+// Reserve the next command sequence number so devices can drop stale or
+// replayed commands. A store failure only costs the sequence, not the command
+func commandMeta(ctx context.Context, cfg Config, store StateStore, reason string) CommandMeta {
+	meta := CommandMeta{Reason: reason}
 
-	shouldDisableSolar := effectivePrice < 0
+	if cfg.DryRun {
+		return meta
+	}
 
-	log.Printf("Effective price (market + feed-in fee): €%.5f/kWh", effectivePrice)
-	log.Printf("Should disable solar inverter: %t", shouldDisableSolar)
+	sequence, err := store.NextSequence(ctx)
+	if err != nil {
+		slog.Error("Error reserving command sequence, sending without one", "error", err)
+		return meta
+	}
 
-	// Send command to IoT Core via HTTPS
-	err = sendIoTCommand(ctx, shouldDisableSolar)
+	meta.Sequence = sequence
+	return meta
+}
+
+// Count a failed fetch and (re)open the breaker once the threshold is reached
+func recordFetchFailure(ctx context.Context, cfg Config, store StateStore, state ControllerState, now time.Time) {
+	if cfg.BreakerThreshold == 0 || cfg.DryRun {
+		return
+	}
+
+	state.FetchFailures++
+	if state.FetchFailures >= cfg.BreakerThreshold {
+		slog.Warn("Opening circuit breaker", "fetch_failures", state.FetchFailures, "cooldown", cfg.BreakerCooldown)
+		state.BreakerOpenedAt = now
+	}
+
+	err := store.PutState(ctx, state)
 	if err != nil {
-		log.Printf("Error sending IoT command: %v", err)
-		return err
+		slog.Error("Error saving circuit breaker state", "error", err)
+	}
+}
+
+// Find a negative window starting within PRE_WINDOW_MINUTES, looking into
+// tomorrow's prices when the lookahead crosses the end of today's data
+func upcomingNegativeWindow(ctx context.Context, cfg Config, provider PriceProvider, prices []ElectricityPrice, windows []Window, now time.Time, location *time.Location) (Window, bool) {
+	window, found := findUpcomingWindow(windows, now, cfg.PreWindow)
+	if found {
+		return window, true
+	}
+
+	schedule := computeSchedule(prices, cfg.FeedInFee, cfg.DisableThreshold, cfg.ThresholdMode)
+	// Like findUpcomingWindow, a window starting exactly at the lead counts
+	if len(schedule) == 0 || now.Add(cfg.PreWindow).Before(schedule[len(schedule)-1].Till) {
+		return Window{}, false
+	}
+
+	tomorrow := now.In(location).AddDate(0, 0, 1).Format("2006-01-02")
+
+	tomorrowPrices, err := provider.FetchPrices(ctx, tomorrow)
+	if err != nil {
+		slog.Warn("Error fetching tomorrow's prices for the pre-window lookahead", "date", tomorrow, "error", err)
+		return Window{}, false
+	}
+
+	return findUpcomingWindow(findNegativePriceWindows(tomorrowPrices, cfg.FeedInFee), now, cfg.PreWindow)
+}
+
+// Inputs of the PRE_WINDOW_MINUTES, forecast and battery gates, each fetched at
+// most once per run by the first decision that reaches the gate
+type decisionGates struct {
+	cfg         Config
+	preWindow   func() bool
+	probability func() (float64, bool)
+	batterySOC  func() (float64, bool)
+}
+
+// Outcome of a decision after the gates
+type gatedDecision struct {
+	ShouldDisable bool
+	PreWindow     bool
+	Forecast      bool
+	Probability   *float64
+	BatterySOC    *float64
+}
+
+func newDecisionGates(ctx context.Context, cfg Config, provider PriceProvider, prices []ElectricityPrice, windows []Window, now time.Time, location *time.Location) *decisionGates {
+	return &decisionGates{
+		cfg: cfg,
+		preWindow: sync.OnceValue(func() bool {
+			window, found := upcomingNegativeWindow(ctx, cfg, provider, prices, windows, now, location)
+			if found {
+				slog.Info("Within PRE_WINDOW_MINUTES of a negative price window, treating it as started",
+					"window_start", window.Start, "window_end", window.End, "pre_window", cfg.PreWindow)
+			}
+			return found
+		}),
+		probability: sync.OnceValues(func() (float64, bool) {
+			probability, err := fetchNegativeProbability(ctx, newHTTPClient(cfg), cfg.ForecastURL, cfg.FetchRetry)
+			if err != nil {
+				slog.Warn("Error fetching price forecast, deciding on price alone", "error", err)
+				return 0, false
+			}
+			slog.Info("Negative price forecast", "probability", probability,
+				"probability_threshold", cfg.ForecastProbability, "price_margin", cfg.ForecastMargin)
+			return probability, true
+		}),
+		batterySOC: sync.OnceValues(func() (float64, bool) {
+			soc, err := fetchBatterySOC(ctx, newHTTPClient(cfg), cfg.BatterySOCURL, cfg.FetchRetry)
+			if err != nil {
+				slog.Warn("Error fetching battery state of charge, deciding on price alone", "error", err)
+				return 0, false
+			}
+			slog.Info("Battery state of charge", "battery_soc", soc, "battery_soc_threshold", cfg.BatterySOCThreshold)
+			return soc, true
+		}),
+	}
+}
+
+// Apply the gates to a decision on threshold: act ahead of an upcoming
+// negative-price window as if it had already started, or of negative prices
+// the forecast considers likely, and prefer charging the battery over
+// curtailing while it has room left
+func (g *decisionGates) apply(shouldDisable bool, effectivePrice float64, threshold float64) gatedDecision {
+	cfg := g.cfg
+	gated := gatedDecision{ShouldDisable: shouldDisable}
+
+	if cfg.PreWindow > 0 && !gated.ShouldDisable && g.preWindow() {
+		gated.ShouldDisable = true
+		gated.PreWindow = true
+	}
+
+	if cfg.ForecastURL != "" && !gated.ShouldDisable {
+		if probability, ok := g.probability(); ok {
+			gated.ShouldDisable = applyForecast(false, probability, cfg.ForecastProbability,
+				effectivePrice, threshold, cfg.ForecastMargin, cfg.ThresholdMode)
+			gated.Forecast = gated.ShouldDisable
+			gated.Probability = &probability
+		}
+	}
+
+	if cfg.BatterySOCURL != "" && gated.ShouldDisable {
+		if soc, ok := g.batterySOC(); ok {
+			gated.ShouldDisable = applyBatteryGate(true, soc, cfg.BatterySOCThreshold)
+			gated.BatterySOC = &soc
+		}
+	}
+
+	return gated
+}
+
+// Decide for every device with its own DEVICE_CONFIG threshold through the
+// same strategy, hysteresis and gates as the global decision. Hysteresis
+// compares with the stored state, which the devices share
+func decideDevices(cfg Config, period ElectricityPrice, prices []ElectricityPrice, now time.Time, previouslyDisabled bool, gates *decisionGates) map[string]bool {
+	decisions := make(map[string]bool)
+
+	for _, clientId := range cfg.ShellyClientIds {
+		device, ok := cfg.Devices[clientId]
+		if !ok || device.Threshold == nil {
+			continue
+		}
+
+		deviceCfg := cfg
+		deviceCfg.DisableThreshold = *device.Threshold
+
+		decision := decide(period, newDecisionConfig(deviceCfg, prices, now, previouslyDisabled))
+		gated := gates.apply(decision.ShouldDisable, decision.EffectivePrice, deviceCfg.DisableThreshold)
+
+		slog.Info("Device decision", "client_id", clientId, "threshold", deviceCfg.DisableThreshold,
+			"decision_price", decision.DecisionPrice, "should_disable", gated.ShouldDisable)
+		decisions[clientId] = gated.ShouldDisable
+	}
+
+	return decisions
+}
+
+// Find the next transition in today's remaining periods, then in tomorrow's
+// once they are published; a zero time means none is known
+func nextTransition(ctx context.Context, cfg Config, provider PriceProvider, prices []ElectricityPrice, now time.Time, location *time.Location, currentlyDisabled bool) (time.Time, string) {
+	at, shouldDisable, found := findNextTransition(strategySchedule(prices, cfg), now, currentlyDisabled)
+
+	if !found {
+		tomorrow := now.In(location).AddDate(0, 0, 1).Format("2006-01-02")
+
+		// Don't ask for prices the day-ahead auction can't have published yet
+		if now.In(location).Hour() < DAY_AHEAD_PUBLICATION_HOUR {
+			slog.Debug("Tomorrow's prices aren't published yet, skipping the next transition lookahead", "date", tomorrow)
+			return time.Time{}, ""
+		}
+
+		// The lookahead is informational and must not hold up the run
+		lookaheadCtx, cancel := context.WithTimeout(ctx, cfg.HTTPTimeout)
+		defer cancel()
+
+		tomorrowPrices, err := provider.FetchPrices(lookaheadCtx, tomorrow)
+		if err != nil {
+			slog.Warn("Error fetching tomorrow's prices for the next transition", "date", tomorrow, "error", err)
+			return time.Time{}, ""
+		}
+
+		if len(tomorrowPrices) == 0 {
+			slog.Debug("Tomorrow's prices aren't published yet", "date", tomorrow)
+			return time.Time{}, ""
+		}
+
+		at, shouldDisable, found = findNextTransition(strategySchedule(tomorrowPrices, cfg), now, currentlyDisabled)
+		if !found {
+			return time.Time{}, ""
+		}
+	}
+
+	nextState := solarState(shouldDisable)
+
+	slog.Info("Next expected transition", "next_transition_at", at, "next_state", nextState)
+
+	return at, nextState
+}
+
+// Format a per-unit price with its currency label, e.g. "-0.03371 EUR/kWh"
+func formatPrice(price float64, currency string) string {
+	return fmt.Sprintf("%.5f %s/%s", price, currency, PRICE_UNIT)
+}
+
+// Only change state once the price leaves the dead-band around the threshold
+func applyHysteresis(effectivePrice float64, threshold float64, hysteresis float64, mode ThresholdMode, previouslyDisabled bool) bool {
+	// Without a dead band the decision is the plain threshold comparison,
+	// so a price exactly at the threshold follows THRESHOLD_INCLUSIVE
+	if hysteresis <= 0 {
+		return belowThreshold(effectivePrice, threshold, mode)
+	}
+
+	if belowThreshold(effectivePrice, threshold-hysteresis, mode) {
+		return true
+	}
+
+	if comparePrice(effectivePrice, threshold+hysteresis, mode.Epsilon) > 0 {
+		return false
 	}
 
-	log.Printf("Solar panel control completed successfully")
-	return nil
+	return previouslyDisabled
 }
 
-func fetchMarketPrices(date string) ([]ElectricityPrice, error) {
+func fetchMarketPrices(ctx context.Context, client *http.Client, url string, date string, retry RetryPolicy) ([]ElectricityPrice, error) {
 	// Prepare GraphQL query
 	query := `query MarketPrices($date: String!) {
 		marketPrices(date: $date) {
@@ -111,41 +1066,82 @@ func fetchMarketPrices(date string) ([]ElectricityPrice, error) {
 		OperationName: "MarketPrices",
 	}
 
-	jsonData, err := json.Marshal(reqBody)
+	var response MarketPricesResponse
+
+	err := postGraphQL(ctx, client, url, nil, reqBody, retry, &response)
 	if err != nil {
-		return nil, fmt.Errorf("error marshaling request: %w", err)
+		return nil, err
 	}
 
-	// Make HTTP request
-	client := &http.Client{Timeout: 30 * time.Second}
-	req, err := http.NewRequest("POST", FRANK_ENERGIE_API_URL, bytes.NewBuffer(jsonData))
+	err = graphQLError(response.Errors)
 	if err != nil {
-		return nil, fmt.Errorf("error creating request: %w", err)
+		return nil, err
 	}
 
-	req.Header.Set("Content-Type", "application/json")
+	return response.Data.MarketPrices.ElectricityPrices, nil
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("error making request: %w", err)
+// Match purely on the From/Till bounds, so hourly and quarter-hourly periods both work
+func getCurrentPrice(prices []ElectricityPrice, currentTime time.Time) (ElectricityPrice, error) {
+	// An empty day points at the provider or cache rather than a gap in the prices
+	if len(prices) == 0 {
+		return ElectricityPrice{}, fmt.Errorf("%w: price list is empty", ErrNoPrice)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API returned status code: %d", resp.StatusCode)
+	price, found := currentPeriod(prices, currentTime)
+	if !found {
+		return ElectricityPrice{}, fmt.Errorf("%w for current period: %s", ErrNoPrice, currentTime.UTC().Format(time.RFC3339))
 	}
 
-	var response MarketPricesResponse
-	err = json.NewDecoder(resp.Body).Decode(&response)
-	if err != nil {
-		return nil, fmt.Errorf("error decoding response: %w", err)
+	// The fee and threshold are per kWh, so any other unit would skew the decision
+	if !strings.EqualFold(price.PerUnit, PRICE_UNIT) {
+		return ElectricityPrice{}, fmt.Errorf("unexpected price unit %q for period %s, expected %s", price.PerUnit, price.From, PRICE_UNIT)
 	}
 
-	return response.Data.MarketPrices.ElectricityPrices, nil
+	return price, nil
 }
 
-func getCurrentHourPrice(prices []ElectricityPrice, currentTime time.Time) (float64, error) {
-	// Convert current time to UTC for comparison
+// Current period as getCurrentPrice, rejecting data that ended before now,
+// such as yesterday's prices from a stale cache, as ErrStalePrices. Within
+// tolerance after the latest period ends, e.g. a run delayed past midnight,
+// that period is still used
+func getFreshPrice(prices []ElectricityPrice, now time.Time, tolerance time.Duration) (ElectricityPrice, error) {
+	price, err := getCurrentPrice(prices, now)
+	if !errors.Is(err, ErrNoPrice) || len(prices) == 0 {
+		return price, err
+	}
+
+	var latest ElectricityPrice
+	var latestTill time.Time
+
+	for _, candidate := range prices {
+		tillTime, parseErr := time.Parse(time.RFC3339, candidate.Till)
+		if parseErr == nil && tillTime.After(latestTill) {
+			latest, latestTill = candidate, tillTime
+		}
+	}
+
+	// A gap inside the data rather than data that ended
+	if latestTill.After(now) {
+		return price, err
+	}
+
+	if now.Sub(latestTill) > tolerance {
+		return ElectricityPrice{}, fmt.Errorf("%w: %w: latest period ended at %s, %s ago", ErrNoPrice, ErrStalePrices,
+			latest.Till, now.Sub(latestTill).Round(time.Second))
+	}
+
+	slog.Warn("Using the latest price period within PRICE_FRESHNESS_TOLERANCE after it ended",
+		"period_from", latest.From, "period_till", latest.Till, "tolerance", tolerance)
+
+	return getCurrentPrice(prices, latestTill.Add(-time.Nanosecond))
+}
+
+// Price period containing the given time
+func currentPeriod(prices []ElectricityPrice, currentTime time.Time) (ElectricityPrice, bool) {
+	// Compare absolute instants in UTC, so the repeated wall-clock hour on
+	// DST fall-back days and the skipped hour on spring-forward days are
+	// matched by their offsets rather than their local time
 	currentUTC := currentTime.UTC()
 
 	for _, price := range prices {
@@ -159,63 +1155,50 @@ func getCurrentHourPrice(prices []ElectricityPrice, currentTime time.Time) (floa
 			continue
 		}
 
-		// Check if current time falls within this price period
-		if currentUTC.After(fromTime) && currentUTC.Before(tillTime) || currentUTC.Equal(fromTime) {
-			log.Printf("Found matching price period: %s - %s", price.From, price.Till)
-			return price.MarketPrice, nil
+		// Check if current time falls within the half-open period [from, till)
+		if (currentUTC.Equal(fromTime) || currentUTC.After(fromTime)) && currentUTC.Before(tillTime) {
+			slog.Debug("Found matching price period", "from", price.From, "till", price.Till)
+			return price, true
 		}
 	}
 
-	return 0, fmt.Errorf("no price found for current hour: %s", currentUTC.Format(time.RFC3339))
+	return ElectricityPrice{}, false
 }
 
-func sendIoTCommand(ctx context.Context, shouldDisable bool) error {
-	// Get IoT Core endpoint and Shelly client ID from environment variables
-	iotEndpoint := os.Getenv("IOT_ENDPOINT")
-	shellyClientId := os.Getenv("SHELLY_CLIENT_ID")
-
-	if iotEndpoint == "" || shellyClientId == "" {
-		return fmt.Errorf("IOT_ENDPOINT and SHELLY_CLIENT_ID environment variables must be set")
-	}
-
-	// Load AWS configuration
-	cfg, err := config.LoadDefaultConfig(ctx)
-	if err != nil {
-		return fmt.Errorf("error loading AWS config: %w", err)
+func main() {
+	// Run as a Lambda event handler inside Lambda and as a CLI elsewhere,
+	// unless RUN_MODE selects a mode explicitly
+	defaultMode := "cli"
+	if os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
+		defaultMode = "lambda"
 	}
 
-	// Construct the full HTTPS endpoint URL for IoT Data Plane
-	fullEndpoint := fmt.Sprintf("https://%s", iotEndpoint)
+	runMode := getEnvString("RUN_MODE", defaultMode)
 
-	// Create IoT Data client with custom endpoint
-	iotClient := iotdataplane.NewFromConfig(cfg, func(o *iotdataplane.Options) {
-		o.BaseEndpoint = &fullEndpoint
-	})
-
-	// Prepare IoT command
-	command := "off"
-
-	if shouldDisable {
-		command = "on"
-	}
-
-	// Publish to IoT Core
-	topic := fmt.Sprintf("%s/command/switch:0", shellyClientId)
-	input := &iotdataplane.PublishInput{
-		Topic:   &topic,
-		Payload: []byte(command),
+	// Structured JSON logs, except for humans at the CLI
+	err := setupLogging(os.Getenv("LOG_LEVEL"), runMode == "cli")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	_, err = iotClient.Publish(ctx, input)
+	// Swap ssm: and secretsmanager: references for their values once, before
+	// any configuration is loaded
+	err = resolveSecretEnv(context.Background())
 	if err != nil {
-		return fmt.Errorf("error publishing to IoT Core: %w", err)
+		slog.Error("Error resolving secrets", "error", err)
+		os.Exit(1)
 	}
 
-	log.Printf("Successfully published IoT command: %s to topic: %s", command, topic)
-
-	return nil
-}
-
-func main() {
-	lambda.Start(handler)
+	switch runMode {
+	case "lambda":
+		lambda.Start(lambdaHandler)
+	case "http":
+		serveHTTP(getEnvString("PORT", "8080"))
+	case "cli":
+		os.Exit(runCLI(os.Args[1:]))
+	default:
+		slog.Error("Unknown RUN_MODE", "run_mode", runMode)
+		os.Exit(1)
+	}
 }
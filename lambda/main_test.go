@@ -0,0 +1,1173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Retry policy without delays, so failure paths don't slow the tests down
+var testRetry = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond}
+
+// Server answering every request with the status and JSON body
+func newJSONServer(t *testing.T, status int, body string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// Frank Energie response body carrying the electricity prices
+func marketPricesBody(t *testing.T, prices []ElectricityPrice) string {
+	t.Helper()
+
+	var response MarketPricesResponse
+	response.Data.MarketPrices.ElectricityPrices = prices
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
+
+// Hourly prices starting at start, one per market price
+func hourlyPrices(start time.Time, marketPrices ...float64) []ElectricityPrice {
+	prices := make([]ElectricityPrice, len(marketPrices))
+
+	for i, marketPrice := range marketPrices {
+		from := start.Add(time.Duration(i) * time.Hour)
+		prices[i] = ElectricityPrice{
+			From:        from.UTC().Format(time.RFC3339),
+			Till:        from.Add(time.Hour).UTC().Format(time.RFC3339),
+			MarketPrice: marketPrice,
+			PerUnit:     "KWH",
+		}
+	}
+
+	return prices
+}
+
+// Keep the AWS SDK away from real accounts: static credentials and every
+// service endpoint pointing at a stub that rejects the request
+func isolateAWS(t *testing.T) {
+	t.Helper()
+
+	stub := newJSONServer(t, http.StatusBadRequest, `{"__type": "ValidationException", "message": "stubbed"}`)
+	dir := t.TempDir()
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_REGION", "eu-west-1")
+	t.Setenv("AWS_ENDPOINT_URL", stub.URL)
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(dir, "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(dir, "credentials"))
+
+	resetAWSClients(t)
+}
+
+// Drop the process-wide AWS config and clients, which would otherwise keep an
+// earlier test's endpoint
+func resetAWSClients(t *testing.T) {
+	t.Helper()
+
+	reset := func() {
+		awsConfigMu.Lock()
+		awsConfig = nil
+		awsConfigMu.Unlock()
+
+		dynamoDBClientMu.Lock()
+		dynamoDBClient = nil
+		dynamoDBClientMu.Unlock()
+	}
+
+	reset()
+	t.Cleanup(reset)
+}
+
+// HTTPS server running handler, trusted through CA_BUNDLE_PATH as the
+// https-only provider URLs require
+func newTLSServer(t *testing.T, handler http.Handler) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewTLSServer(handler)
+	t.Cleanup(server.Close)
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certificate := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, certificate, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CA_BUNDLE_PATH", bundle)
+
+	return server
+}
+
+// Frank Energie stand-in serving the prices for every date
+func newPriceServer(t *testing.T, prices []ElectricityPrice) *httptest.Server {
+	t.Helper()
+
+	body := marketPricesBody(t, prices)
+
+	return newTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+}
+
+// Configuration loaded from the environment like in production, with
+// prices from a local server, commands going to the fake IoT Core, state
+// kept in memory and the clock pinned to now
+func runConfig(t *testing.T, iot *fakeIoT, prices []ElectricityPrice, now time.Time, env map[string]string) Config {
+	t.Helper()
+
+	isolateAWS(t)
+	server := newPriceServer(t, prices)
+
+	t.Setenv("FRANK_ENERGIE_URL", server.URL)
+	t.Setenv("SHELLY_CLIENT_IDS", "shelly-a")
+	t.Setenv("IOT_ENDPOINT", "default.iot.test")
+	t.Setenv("FETCH_MAX_ATTEMPTS", "1")
+	t.Setenv("PUBLISH_MAX_ATTEMPTS", "1")
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	cfg.IoTClients = iot.clients
+	cfg.StateStore = NewMemoryStateStore()
+	cfg.Now = func() time.Time { return now }
+
+	return cfg
+}
+
+// Prices of the local day of now in Europe/Amsterdam, all at marketPrice
+func dayPrices(t *testing.T, now time.Time, marketPrice float64) []ElectricityPrice {
+	t.Helper()
+
+	location, err := time.LoadLocation(PRICE_TIMEZONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := now.In(location)
+	start := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, location)
+
+	marketPrices := make([]float64, 24)
+	for i := range marketPrices {
+		marketPrices[i] = marketPrice
+	}
+
+	return hourlyPrices(start, marketPrices...)
+}
+
+func TestRunPublishesDecision(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+	iot := newFakeIoT()
+	cfg := runConfig(t, iot, dayPrices(t, now, -0.05), now, nil)
+
+	result, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if !result.ShouldDisableSolar || !result.CommandSent {
+		t.Errorf("result = %+v, want solar disabled and the command sent", result)
+	}
+
+	messages := iot.messages()
+	if len(messages) != 1 || messages[0].Topic != "shelly-a/command/switch:0" {
+		t.Fatalf("published %+v, want one command to shelly-a", messages)
+	}
+
+	if command := decodeCommand(t, messages[0]); command.Command != "on" || command.Sequence != result.Sequence {
+		t.Errorf("command = %+v, want on with the result's sequence %d", command, result.Sequence)
+	}
+}
+
+func TestRunAsOfIsDryRun(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		event HandlerEvent
+	}{
+		{name: "AS_OF", env: map[string]string{"AS_OF": now.Format(time.RFC3339)}},
+		{name: "asOf event", event: HandlerEvent{AsOf: now.Format(time.RFC3339)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iot := newFakeIoT()
+			cfg := runConfig(t, iot, dayPrices(t, now, -0.05), now, tt.env)
+
+			cfg, err := applyEvent(cfg, tt.event)
+			if err != nil {
+				t.Fatalf("applyEvent: %v", err)
+			}
+
+			result, err := Run(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			if !result.ShouldDisableSolar || result.CommandSent {
+				t.Errorf("result = %+v, want the replayed decision without a command", result)
+			}
+			if messages := iot.messages(); len(messages) != 0 {
+				t.Errorf("published %+v, want nothing", messages)
+			}
+
+			// Neither the state nor the sequence moved
+			if _, found, _ := cfg.StateStore.GetState(context.Background()); found {
+				t.Error("replay stored its state")
+			}
+			if sequence, _ := cfg.StateStore.NextSequence(context.Background()); sequence != 1 {
+				t.Errorf("next sequence = %d, want 1", sequence)
+			}
+		})
+	}
+}
+
+func TestFetchMarketPrices(t *testing.T) {
+	want := hourlyPrices(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), -0.02, 0.01)
+
+	var request GraphQLRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("error decoding request: %v", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(marketPricesBody(t, want)))
+	}))
+	defer server.Close()
+
+	prices, err := fetchMarketPrices(context.Background(), server.Client(), server.URL, "2024-01-02", testRetry)
+	if err != nil {
+		t.Fatalf("fetchMarketPrices: %v", err)
+	}
+
+	if request.Variables["date"] != "2024-01-02" || request.OperationName != "MarketPrices" {
+		t.Errorf("request = %+v, want the MarketPrices query for 2024-01-02", request)
+	}
+
+	if len(prices) != len(want) {
+		t.Fatalf("got %d prices, want %d", len(prices), len(want))
+	}
+
+	for i := range want {
+		if prices[i] != want[i] {
+			t.Errorf("price %d = %+v, want %+v", i, prices[i], want[i])
+		}
+	}
+}
+
+func TestFetchMarketPricesErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"server error", http.StatusInternalServerError, `{}`, "status code: 500"},
+		{"client error", http.StatusBadRequest, `{}`, "status code: 400"},
+		{"malformed JSON", http.StatusOK, `{"data": {"marketPrices": `, "error decoding response"},
+		{"GraphQL errors", http.StatusOK, `{"data": null, "errors": [{"message": "date out of range"}]}`, "date out of range"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newJSONServer(t, tt.status, tt.body)
+
+			_, err := fetchMarketPrices(context.Background(), server.Client(), server.URL, "2024-01-02", testRetry)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error = %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchMarketPricesEmpty(t *testing.T) {
+	server := newJSONServer(t, http.StatusOK, `{"data": {"marketPrices": {"electricityPrices": []}}}`)
+
+	prices, err := fetchMarketPrices(context.Background(), server.Client(), server.URL, "2024-01-02", testRetry)
+	if err != nil {
+		t.Fatalf("fetchMarketPrices: %v", err)
+	}
+
+	if len(prices) != 0 {
+		t.Fatalf("got %d prices, want none", len(prices))
+	}
+
+	// An empty day has no current price rather than a silent default
+	_, err = getCurrentPrice(prices, time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC))
+	if !errors.Is(err, ErrNoPrice) {
+		t.Errorf("getCurrentPrice error = %v, want ErrNoPrice", err)
+	}
+}
+
+func TestApplyHysteresis(t *testing.T) {
+	strict := ThresholdMode{}
+	inclusive := ThresholdMode{Inclusive: true}
+
+	tests := []struct {
+		name               string
+		price              float64
+		hysteresis         float64
+		mode               ThresholdMode
+		previouslyDisabled bool
+		want               bool
+	}{
+		{"strict at threshold while disabled", 0, 0, strict, true, false},
+		{"strict at threshold while enabled", 0, 0, strict, false, false},
+		{"inclusive at threshold while disabled", 0, 0, inclusive, true, true},
+		{"inclusive at threshold while enabled", 0, 0, inclusive, false, true},
+		{"below threshold", -0.01, 0, strict, false, true},
+		{"above threshold", 0.01, 0, strict, true, false},
+		{"epsilon counts as at threshold", 1e-9, 0, ThresholdMode{Inclusive: true, Epsilon: 1e-6}, false, true},
+		{"inside band keeps disabled", 0.005, 0.01, strict, true, true},
+		{"inside band keeps enabled", -0.005, 0.01, strict, false, false},
+		{"below band disables", -0.02, 0.01, strict, false, true},
+		{"above band enables", 0.02, 0.01, strict, true, false},
+		{"strict at lower band edge keeps enabled", -0.01, 0.01, strict, false, false},
+		{"inclusive at lower band edge disables", -0.01, 0.01, inclusive, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := applyHysteresis(tt.price, 0, tt.hysteresis, tt.mode, tt.previouslyDisabled)
+			if got != tt.want {
+				t.Errorf("applyHysteresis(%g, 0, %g, %+v, %t) = %t, want %t",
+					tt.price, tt.hysteresis, tt.mode, tt.previouslyDisabled, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyHysteresisMatchesSchedule(t *testing.T) {
+	// A period netting exactly to the threshold decides the same in both
+	prices := []ElectricityPrice{{From: "2024-01-02T12:00:00Z", Till: "2024-01-02T13:00:00Z", MarketPrice: 0.01}}
+
+	for _, mode := range []ThresholdMode{{}, {Inclusive: true}} {
+		schedule := computeSchedule(prices, -0.01, 0, mode)
+		for _, previouslyDisabled := range []bool{false, true} {
+			got := applyHysteresis(schedule[0].EffectivePrice, 0, 0, mode, previouslyDisabled)
+			if got != schedule[0].ShouldDisable {
+				t.Errorf("mode %+v, previously disabled %t: applyHysteresis = %t, schedule = %t",
+					mode, previouslyDisabled, got, schedule[0].ShouldDisable)
+			}
+		}
+	}
+}
+
+func TestRunControlHours(t *testing.T) {
+	// 14:30 and 22:30 in Europe/Amsterdam
+	inside := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+	outside := time.Date(2024, 1, 2, 21, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		now          time.Time
+		stored       *ControllerState
+		wantCommands []string
+		wantOutside  bool
+		wantDisabled bool
+	}{
+		{"inside the window", inside, nil, []string{"on"}, false, true},
+		{"outside the window while enabled", outside, &ControllerState{SolarDisabled: false}, nil, true, false},
+		{"outside the window without state", outside, nil, nil, true, false},
+		{"outside the window while disabled", outside, &ControllerState{SolarDisabled: true}, []string{"off"}, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iot := newFakeIoT()
+			cfg := runConfig(t, iot, dayPrices(t, tt.now, -0.05), tt.now, map[string]string{"CONTROL_HOURS": "8-20"})
+
+			if tt.stored != nil {
+				if err := cfg.StateStore.PutState(context.Background(), *tt.stored); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			result, err := Run(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			if result.OutsideControlHours != tt.wantOutside {
+				t.Errorf("OutsideControlHours = %t, want %t", result.OutsideControlHours, tt.wantOutside)
+			}
+
+			var commands []string
+			for _, message := range iot.messages() {
+				commands = append(commands, decodeCommand(t, message).Command)
+			}
+			if strings.Join(commands, ",") != strings.Join(tt.wantCommands, ",") {
+				t.Errorf("published %v, want %v", commands, tt.wantCommands)
+			}
+
+			state, found, err := cfg.StateStore.GetState(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found && state.SolarDisabled != tt.wantDisabled {
+				t.Errorf("stored SolarDisabled = %t, want %t", state.SolarDisabled, tt.wantDisabled)
+			}
+
+			// The enable command is sent once, later runs leave the relay alone
+			if tt.wantOutside {
+				if _, err := Run(context.Background(), cfg); err != nil {
+					t.Fatalf("second Run: %v", err)
+				}
+				if len(iot.messages()) != len(tt.wantCommands) {
+					t.Errorf("second run published %d more commands, want none", len(iot.messages())-len(tt.wantCommands))
+				}
+			}
+		})
+	}
+}
+
+func TestGetCurrentPriceDST(t *testing.T) {
+	// Periods as Frank Energie publishes them, with the local offset
+	price := func(from, till string, marketPrice float64) ElectricityPrice {
+		return ElectricityPrice{From: from, Till: till, MarketPrice: marketPrice, PerUnit: "KWH"}
+	}
+
+	fallBack := []ElectricityPrice{
+		price("2024-10-27T01:00:00+02:00", "2024-10-27T02:00:00+02:00", 0.01),
+		price("2024-10-27T02:00:00+02:00", "2024-10-27T02:00:00+01:00", 0.02),
+		price("2024-10-27T02:00:00+01:00", "2024-10-27T03:00:00+01:00", 0.03),
+		price("2024-10-27T03:00:00+01:00", "2024-10-27T04:00:00+01:00", 0.04),
+	}
+
+	springForward := []ElectricityPrice{
+		price("2024-03-31T01:00:00+01:00", "2024-03-31T03:00:00+02:00", 0.01),
+		price("2024-03-31T03:00:00+02:00", "2024-03-31T04:00:00+02:00", 0.02),
+	}
+
+	tests := []struct {
+		name   string
+		prices []ElectricityPrice
+		now    time.Time
+		want   float64
+	}{
+		{"first 02:00 on fall-back day", fallBack, time.Date(2024, 10, 27, 0, 30, 0, 0, time.UTC), 0.02},
+		{"repeated 02:00 on fall-back day", fallBack, time.Date(2024, 10, 27, 1, 30, 0, 0, time.UTC), 0.03},
+		{"after fall-back", fallBack, time.Date(2024, 10, 27, 2, 30, 0, 0, time.UTC), 0.04},
+		{"before spring-forward", springForward, time.Date(2024, 3, 31, 0, 30, 0, 0, time.UTC), 0.01},
+		{"after the skipped hour", springForward, time.Date(2024, 3, 31, 1, 30, 0, 0, time.UTC), 0.02},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getCurrentPrice(tt.prices, tt.now)
+			if err != nil {
+				t.Fatalf("getCurrentPrice: %v", err)
+			}
+
+			if got.MarketPrice != tt.want {
+				t.Errorf("got period %s to %s (%g), want the one at %g", got.From, got.Till, got.MarketPrice, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetCurrentPriceBoundaries(t *testing.T) {
+	start := time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC)
+	prices := hourlyPrices(start, 0.01, 0.02)
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want float64
+	}{
+		{"start of the first period", start, 0.01},
+		{"just before the boundary", start.Add(time.Hour - time.Nanosecond), 0.01},
+		{"on the boundary", start.Add(time.Hour), 0.02},
+		{"same instant in another zone", start.Add(time.Hour).In(time.FixedZone("CET", 3600)), 0.02},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := getCurrentPrice(prices, tt.now)
+			if err != nil {
+				t.Fatalf("getCurrentPrice: %v", err)
+			}
+
+			if got.MarketPrice != tt.want {
+				t.Errorf("got period %s (%g), want the one at %g", got.From, got.MarketPrice, tt.want)
+			}
+		})
+	}
+
+	// Till is exclusive, so the end of the last period has no price
+	for _, now := range []time.Time{start.Add(-time.Nanosecond), start.Add(2 * time.Hour)} {
+		_, err := getCurrentPrice(prices, now)
+		if !errors.Is(err, ErrNoPrice) {
+			t.Errorf("getCurrentPrice at %s error = %v, want ErrNoPrice", now.Format(time.RFC3339Nano), err)
+		}
+	}
+}
+
+func TestGetCurrentPriceQuarterHours(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	prices := make([]ElectricityPrice, 96)
+	for i := range prices {
+		from := start.Add(time.Duration(i) * 15 * time.Minute)
+		prices[i] = ElectricityPrice{
+			From:        from.Format(time.RFC3339),
+			Till:        from.Add(15 * time.Minute).Format(time.RFC3339),
+			MarketPrice: float64(i),
+			PerUnit:     "KWH",
+		}
+	}
+
+	tests := []struct {
+		now  time.Time
+		want int
+	}{
+		{start, 0},
+		{start.Add(14*time.Minute + 59*time.Second), 0},
+		{start.Add(15 * time.Minute), 1},
+		{start.Add(13*time.Hour + 40*time.Minute), 54},
+		{start.Add(24*time.Hour - time.Second), 95},
+	}
+
+	for _, tt := range tests {
+		got, err := getCurrentPrice(prices, tt.now)
+		if err != nil {
+			t.Fatalf("getCurrentPrice at %s: %v", tt.now.Format(time.RFC3339), err)
+		}
+
+		if got != prices[tt.want] {
+			t.Errorf("at %s got period %s, want %s", tt.now.Format(time.RFC3339), got.From, prices[tt.want].From)
+		}
+	}
+}
+
+func TestGetCurrentPriceUnit(t *testing.T) {
+	now := time.Date(2024, 1, 2, 12, 30, 0, 0, time.UTC)
+
+	for _, unit := range []string{"MWh", "MWH", "", "m3"} {
+		prices := hourlyPrices(time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC), -0.02)
+		prices[0].PerUnit = unit
+
+		_, err := getCurrentPrice(prices, now)
+		if err == nil || !strings.Contains(err.Error(), "unexpected price unit") {
+			t.Errorf("perUnit %q: error = %v, want an unexpected unit error", unit, err)
+		}
+	}
+
+	// Frank Energie spells it KWH, the check is case-insensitive
+	for _, unit := range []string{"KWH", "kWh"} {
+		prices := hourlyPrices(time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC), -0.02)
+		prices[0].PerUnit = unit
+
+		if _, err := getCurrentPrice(prices, now); err != nil {
+			t.Errorf("perUnit %q: %v", unit, err)
+		}
+	}
+}
+
+func TestFetchMarketPricesCancelled(t *testing.T) {
+	// A server that never answers, released when the test ends
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	started := time.Now()
+	retry := RetryPolicy{MaxAttempts: 3, BaseDelay: time.Second}
+
+	_, err := fetchMarketPrices(ctx, server.Client(), server.URL, "2024-01-02", retry)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error = %v, want context.DeadlineExceeded", err)
+	}
+
+	// Neither waiting on the server nor retrying after the deadline
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("returned after %s, want promptly after the deadline", elapsed)
+	}
+}
+
+func TestRunPriceValidation(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+
+	// A gap in the morning, the current period is still there
+	prices := dayPrices(t, now, -0.05)
+	prices = append(prices[:5], prices[6:]...)
+
+	t.Run("warn", func(t *testing.T) {
+		iot := newFakeIoT()
+		cfg := runConfig(t, iot, prices, now, nil)
+
+		if _, err := Run(context.Background(), cfg); err != nil {
+			t.Fatalf("Run: %v, want the anomaly only logged", err)
+		}
+		if len(iot.messages()) != 1 {
+			t.Errorf("published %d commands, want 1", len(iot.messages()))
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		iot := newFakeIoT()
+		cfg := runConfig(t, iot, prices, now, map[string]string{"PRICE_VALIDATION": "error"})
+
+		_, err := Run(context.Background(), cfg)
+		if !errors.Is(err, ErrFetch) || !strings.Contains(err.Error(), "gap between") {
+			t.Fatalf("Run error = %v, want ErrFetch describing the gap", err)
+		}
+		if len(iot.messages()) != 0 {
+			t.Errorf("published %d commands, want none", len(iot.messages()))
+		}
+	})
+}
+
+func TestRecordFetchFailure(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+	openedAt := now.Add(-2 * time.Hour)
+
+	tests := []struct {
+		name         string
+		threshold    int
+		dryRun       bool
+		state        ControllerState
+		wantStored   bool
+		wantFailures int
+		wantOpenedAt time.Time
+	}{
+		{name: "breaker disabled", threshold: 0},
+		{name: "dry run", threshold: 2, dryRun: true},
+		{name: "below the threshold", threshold: 2, wantStored: true, wantFailures: 1},
+		{name: "reaches the threshold", threshold: 2, state: ControllerState{FetchFailures: 1}, wantStored: true, wantFailures: 2, wantOpenedAt: now},
+		{name: "half-open probe fails", threshold: 2, state: ControllerState{FetchFailures: 2, BreakerOpenedAt: openedAt}, wantStored: true, wantFailures: 3, wantOpenedAt: now},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryStateStore()
+			cfg := Config{BreakerThreshold: tt.threshold, BreakerCooldown: time.Hour, DryRun: tt.dryRun}
+
+			recordFetchFailure(context.Background(), cfg, store, tt.state, now)
+
+			state, found, err := store.GetState(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != tt.wantStored {
+				t.Fatalf("state stored = %t, want %t", found, tt.wantStored)
+			}
+			if !found {
+				return
+			}
+
+			if state.FetchFailures != tt.wantFailures || !state.BreakerOpenedAt.Equal(tt.wantOpenedAt) {
+				t.Errorf("state = %d failures, opened at %s, want %d and %s", state.FetchFailures, state.BreakerOpenedAt, tt.wantFailures, tt.wantOpenedAt)
+			}
+		})
+	}
+}
+
+func TestRunCircuitBreaker(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		stored        ControllerState
+		priceStatus   int
+		wantRequested bool
+		wantOpen      bool
+		wantFailures  int
+		wantOpenedAt  time.Time
+	}{
+		{name: "closed, fetch fails", priceStatus: http.StatusInternalServerError, wantRequested: true, wantFailures: 1},
+		{name: "opens at the threshold", stored: ControllerState{FetchFailures: 1}, priceStatus: http.StatusInternalServerError, wantRequested: true, wantFailures: 2, wantOpenedAt: now},
+		{name: "open skips the fetch", stored: ControllerState{FetchFailures: 2, BreakerOpenedAt: now.Add(-10 * time.Minute)}, priceStatus: http.StatusOK, wantOpen: true, wantFailures: 2, wantOpenedAt: now.Add(-10 * time.Minute)},
+		{name: "half-open probe succeeds", stored: ControllerState{FetchFailures: 2, BreakerOpenedAt: now.Add(-2 * time.Hour)}, priceStatus: http.StatusOK, wantRequested: true},
+		{name: "half-open probe fails", stored: ControllerState{FetchFailures: 2, BreakerOpenedAt: now.Add(-2 * time.Hour)}, priceStatus: http.StatusInternalServerError, wantRequested: true, wantFailures: 3, wantOpenedAt: now},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isolateAWS(t)
+
+			prices := marketPricesBody(t, dayPrices(t, now, -0.05))
+			var requests atomic.Int32
+
+			server := newTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.priceStatus)
+				w.Write([]byte(prices))
+			}))
+
+			cfg := runConfig(t, newFakeIoT(), nil, now, map[string]string{
+				"FRANK_ENERGIE_URL":  server.URL,
+				"CA_BUNDLE_PATH":     os.Getenv("CA_BUNDLE_PATH"),
+				"STATE_STORE":        "memory",
+				"BREAKER_THRESHOLD":  "2",
+				"BREAKER_COOLDOWN":   "1h",
+				"DEFAULT_ON_MISSING": "enable",
+			})
+			if err := cfg.StateStore.PutState(context.Background(), tt.stored); err != nil {
+				t.Fatal(err)
+			}
+
+			result, err := Run(context.Background(), cfg)
+			if tt.priceStatus != http.StatusOK {
+				if !errors.Is(err, ErrFetch) {
+					t.Fatalf("Run = %v, want ErrFetch", err)
+				}
+			} else if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			if (requests.Load() > 0) != tt.wantRequested {
+				t.Errorf("made %d price requests, want a fetch: %t", requests.Load(), tt.wantRequested)
+			}
+			if result.BreakerOpen != tt.wantOpen {
+				t.Errorf("BreakerOpen = %t, want %t", result.BreakerOpen, tt.wantOpen)
+			}
+			if tt.wantOpen && result.Fallback != "enable" {
+				t.Errorf("Fallback = %q, want DEFAULT_ON_MISSING while open", result.Fallback)
+			}
+
+			state, _, err := cfg.StateStore.GetState(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state.FetchFailures != tt.wantFailures || !state.BreakerOpenedAt.Equal(tt.wantOpenedAt) {
+				t.Errorf("state = %d failures, opened at %s, want %d and %s", state.FetchFailures, state.BreakerOpenedAt, tt.wantFailures, tt.wantOpenedAt)
+			}
+		})
+	}
+}
+
+func TestUpcomingNegativeWindowAcrossMidnight(t *testing.T) {
+	location, err := time.LoadLocation(PRICE_TIMEZONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 23:45 local, today's prices all positive and tomorrow opening negative
+	now := time.Date(2024, 1, 2, 23, 45, 0, 0, location)
+	today := dayPrices(t, now, 0.05)
+	tomorrow := dayPrices(t, now.AddDate(0, 0, 1), 0.05)
+	tomorrow[0].MarketPrice = -0.02
+	tomorrow[1].MarketPrice = -0.01
+
+	tests := []struct {
+		name          string
+		preWindow     time.Duration
+		tomorrow      []ElectricityPrice
+		want          bool
+		wantRequested int
+	}{
+		{"window starts within the lead", 30 * time.Minute, tomorrow, true, 1},
+		{"window starts exactly at the lead", 15 * time.Minute, tomorrow, true, 1},
+		{"lead ends before midnight", 10 * time.Minute, tomorrow, false, 0},
+		{"tomorrow not published", 30 * time.Minute, nil, false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &fakeProvider{prices: map[string][]ElectricityPrice{"2024-01-03": tt.tomorrow}}
+			cfg := Config{PreWindow: tt.preWindow}
+
+			window, found := upcomingNegativeWindow(context.Background(), cfg, provider, today, findNegativePriceWindows(today, 0), now, location)
+			if found != tt.want {
+				t.Fatalf("found = %t, want %t", found, tt.want)
+			}
+
+			if found && !window.Start.Equal(time.Date(2024, 1, 3, 0, 0, 0, 0, location)) {
+				t.Errorf("window starts %s, want midnight", window.Start)
+			}
+
+			if len(provider.requested) != tt.wantRequested {
+				t.Errorf("requested %v, want %d fetches of tomorrow", provider.requested, tt.wantRequested)
+			}
+		})
+	}
+}
+
+func TestFindUpcomingWindow(t *testing.T) {
+	start := time.Date(2024, 1, 2, 14, 0, 0, 0, time.UTC)
+	windows := []Window{{Start: start, End: start.Add(2 * time.Hour), AvgPrice: -0.02}}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		{"inside the lead", start.Add(-10 * time.Minute), true},
+		{"at the lead", start.Add(-30 * time.Minute), true},
+		{"before the lead", start.Add(-31 * time.Minute), false},
+		{"window already started", start, false},
+	}
+
+	for _, tt := range tests {
+		if _, found := findUpcomingWindow(windows, tt.now, 30*time.Minute); found != tt.want {
+			t.Errorf("%s: found = %t, want %t", tt.name, found, tt.want)
+		}
+	}
+}
+
+func TestRunSequenceSurvivesRestarts(t *testing.T) {
+	// 14:30 and 15:30 in Europe/Amsterdam, negative then positive
+	first := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+	second := first.Add(time.Hour)
+
+	marketPrices := make([]float64, 24)
+	for i := range marketPrices {
+		marketPrices[i] = 0.05
+	}
+	marketPrices[14] = -0.05
+	prices := hourlyPrices(time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC), marketPrices...)
+
+	iot := newFakeIoT()
+	cfg := runConfig(t, iot, prices, first, nil)
+	newFakeDynamoDB(t)
+
+	var sequences []int64
+
+	for _, now := range []time.Time{first, second} {
+		// A fresh store per run, like a cold start, sharing only the table
+		cfg.StateStore = &DynamoDBStateStore{TableName: "state"}
+		cfg.Now = func() time.Time { return now }
+
+		result, err := Run(context.Background(), cfg)
+		if err != nil {
+			t.Fatalf("Run at %s: %v", now, err)
+		}
+		if !result.CommandSent {
+			t.Fatalf("Run at %s sent no command: %+v", now, result)
+		}
+
+		sequences = append(sequences, result.Sequence)
+	}
+
+	if sequences[0] != 1 || sequences[1] != 2 {
+		t.Errorf("sequences = %v, want 1 then 2", sequences)
+	}
+
+	messages := iot.messages()
+	if len(messages) != 2 {
+		t.Fatalf("published %d commands, want 2", len(messages))
+	}
+	for i, message := range messages {
+		if command := decodeCommand(t, message); command.Sequence != sequences[i] || command.Source != COMMAND_SOURCE {
+			t.Errorf("command %d = %+v, want sequence %d from %s", i, command, sequences[i], COMMAND_SOURCE)
+		}
+	}
+}
+
+func TestNextTransitionLookahead(t *testing.T) {
+	location, err := time.LoadLocation(PRICE_TIMEZONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Today stays enabled, tomorrow disables from midnight
+	today := dayPrices(t, time.Date(2024, 1, 2, 12, 0, 0, 0, location), 0.01)
+	tomorrow := dayPrices(t, time.Date(2024, 1, 3, 12, 0, 0, 0, location), -0.01)
+	midnight := time.Date(2024, 1, 3, 0, 0, 0, 0, location)
+
+	tests := []struct {
+		name          string
+		now           time.Time
+		tomorrow      []ElectricityPrice
+		err           error
+		wantRequested bool
+		wantAt        time.Time
+	}{
+		{name: "before the day-ahead publication", now: time.Date(2024, 1, 2, 10, 30, 0, 0, location), tomorrow: tomorrow},
+		{name: "published", now: time.Date(2024, 1, 2, 14, 30, 0, 0, location), tomorrow: tomorrow, wantRequested: true, wantAt: midnight},
+		{name: "not published yet", now: time.Date(2024, 1, 2, 14, 30, 0, 0, location), wantRequested: true},
+		{name: "fetch fails", now: time.Date(2024, 1, 2, 14, 30, 0, 0, location), err: errors.New("service unavailable"), wantRequested: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := &fakeProvider{prices: map[string][]ElectricityPrice{"2024-01-03": tt.tomorrow}, err: tt.err}
+			cfg := Config{HTTPTimeout: time.Second}
+
+			at, state := nextTransition(context.Background(), cfg, provider, today, tt.now, location, false)
+
+			if (len(provider.requested) > 0) != tt.wantRequested {
+				t.Fatalf("requested %v, want tomorrow requested: %t", provider.requested, tt.wantRequested)
+			}
+			if tt.wantRequested {
+				if _, ok := provider.contexts[0].Deadline(); !ok {
+					t.Error("lookahead fetched without a deadline")
+				}
+			}
+
+			if !at.Equal(tt.wantAt) {
+				t.Errorf("next transition at %s, want %s", at, tt.wantAt)
+			}
+			if tt.wantAt.IsZero() != (state == "") {
+				t.Errorf("next state = %q, want one only with a transition", state)
+			}
+		})
+	}
+}
+
+func TestDayThreshold(t *testing.T) {
+	cfg := Config{WeekdayThreshold: 0.01, WeekendThreshold: 0.05}
+	location, err := time.LoadLocation(PRICE_TIMEZONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want float64
+	}{
+		{"wednesday", time.Date(2024, 1, 3, 12, 0, 0, 0, time.UTC), 0.01},
+		{"saturday", time.Date(2024, 1, 6, 12, 0, 0, 0, time.UTC), 0.05},
+		{"sunday", time.Date(2024, 1, 7, 12, 0, 0, 0, time.UTC), 0.05},
+		// Still Friday in UTC, already Saturday in Amsterdam
+		{"local saturday", time.Date(2024, 1, 5, 23, 30, 0, 0, time.UTC), 0.05},
+		// Still Sunday in UTC, already Monday in Amsterdam
+		{"local monday", time.Date(2024, 1, 7, 23, 30, 0, 0, time.UTC), 0.01},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dayThreshold(cfg, tt.now.In(location)); got != tt.want {
+				t.Errorf("dayThreshold(%s) = %g, want %g", tt.now.In(location).Format(time.RFC3339), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunWeekdayWeekendThreshold(t *testing.T) {
+	tests := []struct {
+		name        string
+		now         time.Time
+		env         map[string]string
+		wantDisable bool
+	}{
+		{"saturday uses WEEKEND_THRESHOLD", time.Date(2024, 1, 6, 13, 30, 0, 0, time.UTC), map[string]string{"WEEKDAY_THRESHOLD": "0.01", "WEEKEND_THRESHOLD": "0.05"}, true},
+		{"wednesday uses WEEKDAY_THRESHOLD", time.Date(2024, 1, 3, 13, 30, 0, 0, time.UTC), map[string]string{"WEEKDAY_THRESHOLD": "0.01", "WEEKEND_THRESHOLD": "0.05"}, false},
+		{"saturday falls back to DISABLE_THRESHOLD", time.Date(2024, 1, 6, 13, 30, 0, 0, time.UTC), map[string]string{"DISABLE_THRESHOLD": "0.05", "WEEKDAY_THRESHOLD": "0.01"}, true},
+		{"wednesday falls back to DISABLE_THRESHOLD", time.Date(2024, 1, 3, 13, 30, 0, 0, time.UTC), map[string]string{"DISABLE_THRESHOLD": "0.05", "WEEKEND_THRESHOLD": "0.01"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iot := newFakeIoT()
+			cfg := runConfig(t, iot, dayPrices(t, tt.now, 0.03), tt.now, tt.env)
+
+			result, err := Run(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+
+			if result.ShouldDisableSolar != tt.wantDisable {
+				t.Errorf("ShouldDisableSolar = %t at 0.03, want %t", result.ShouldDisableSolar, tt.wantDisable)
+			}
+		})
+	}
+}
+
+func TestGetFreshPrice(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	day := hourlyPrices(start, 0.01, 0.02, 0.03)
+	gap := []ElectricityPrice{day[0], day[2]}
+
+	tests := []struct {
+		name      string
+		prices    []ElectricityPrice
+		now       time.Time
+		tolerance time.Duration
+		want      float64
+		wantStale bool
+		wantErr   bool
+	}{
+		{name: "current period", prices: day, now: start.Add(90 * time.Minute), want: 0.02},
+		{name: "yesterday's prices", prices: day, now: start.AddDate(0, 0, 1).Add(time.Hour), wantStale: true, wantErr: true},
+		{name: "just past the end without tolerance", prices: day, now: start.Add(3*time.Hour + time.Minute), wantStale: true, wantErr: true},
+		{name: "within tolerance after the end", prices: day, now: start.Add(3*time.Hour + 10*time.Minute), tolerance: 15 * time.Minute, want: 0.03},
+		{name: "beyond tolerance after the end", prices: day, now: start.Add(3*time.Hour + 20*time.Minute), tolerance: 15 * time.Minute, wantStale: true, wantErr: true},
+		{name: "gap inside the data", prices: gap, now: start.Add(90 * time.Minute), wantErr: true},
+		{name: "no prices", prices: nil, now: start, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			price, err := getFreshPrice(tt.prices, tt.now, tt.tolerance)
+
+			if tt.wantErr {
+				if !errors.Is(err, ErrNoPrice) {
+					t.Fatalf("error = %v, want ErrNoPrice", err)
+				}
+				if errors.Is(err, ErrStalePrices) != tt.wantStale {
+					t.Errorf("error = %v, stale %t, want stale %t", err, errors.Is(err, ErrStalePrices), tt.wantStale)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("getFreshPrice: %v", err)
+			}
+			if price.MarketPrice != tt.want {
+				t.Errorf("MarketPrice = %g, want %g", price.MarketPrice, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunStalePrices(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+	yesterday := dayPrices(t, now.AddDate(0, 0, -1), -0.05)
+
+	t.Run("fallback", func(t *testing.T) {
+		iot := newFakeIoT()
+		cfg := runConfig(t, iot, yesterday, now, map[string]string{"DEFAULT_ON_MISSING": "enable"})
+
+		result, err := Run(context.Background(), cfg)
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+
+		if !result.Stale || result.Fallback != "enable" || result.ShouldDisableSolar {
+			t.Errorf("result = %+v, want the enable fallback for stale data", result)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		cfg := runConfig(t, newFakeIoT(), yesterday, now, nil)
+
+		_, err := Run(context.Background(), cfg)
+		if !errors.Is(err, ErrStalePrices) {
+			t.Errorf("error = %v, want ErrStalePrices", err)
+		}
+	})
+}
+
+// Server answering 429 with retryAfter for the first limited requests, then
+// the prices
+func newRateLimitedServer(t *testing.T, limited int, retryAfter string, prices []ElectricityPrice) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+
+	body := marketPricesBody(t, prices)
+	var requests atomic.Int32
+
+	server := newTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if int(requests.Add(1)) <= limited {
+			if retryAfter != "" {
+				w.Header().Set("Retry-After", retryAfter)
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+
+	return server, &requests
+}
+
+func TestFetchMarketPricesRateLimited(t *testing.T) {
+	prices := hourlyPrices(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), 0.01, 0.02)
+
+	t.Run("429 then 200", func(t *testing.T) {
+		server, requests := newRateLimitedServer(t, 1, "", prices)
+
+		got, err := fetchMarketPrices(context.Background(), server.Client(), server.URL, "2024-01-02", testRetry)
+		if err != nil {
+			t.Fatalf("fetchMarketPrices: %v", err)
+		}
+
+		if len(got) != 2 || requests.Load() != 2 {
+			t.Errorf("got %d prices after %d requests, want 2 after a retry", len(got), requests.Load())
+		}
+	})
+
+	t.Run("429 on every attempt", func(t *testing.T) {
+		server, requests := newRateLimitedServer(t, testRetry.MaxAttempts, "", prices)
+
+		_, err := fetchMarketPrices(context.Background(), server.Client(), server.URL, "2024-01-02", testRetry)
+		if !errors.Is(err, ErrRateLimited) {
+			t.Errorf("error = %v, want ErrRateLimited", err)
+		}
+		if int(requests.Load()) != testRetry.MaxAttempts {
+			t.Errorf("made %d requests, want %d", requests.Load(), testRetry.MaxAttempts)
+		}
+	})
+
+	t.Run("Retry-After beyond the deadline", func(t *testing.T) {
+		server, requests := newRateLimitedServer(t, 1, "60", prices)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		start := time.Now()
+		_, err := fetchMarketPrices(ctx, server.Client(), server.URL, "2024-01-02", testRetry)
+
+		// Giving up early keeps the rate limit as the reason, not a timeout
+		if !errors.Is(err, ErrRateLimited) || requests.Load() != 1 {
+			t.Errorf("error = %v after %d requests, want ErrRateLimited without a retry", err, requests.Load())
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("returned after %s, want no wait for the Retry-After", elapsed)
+		}
+	})
+}
+
+func TestRunRateLimited(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+	server, _ := newRateLimitedServer(t, 2, "", dayPrices(t, now, -0.05))
+	bundle := os.Getenv("CA_BUNDLE_PATH")
+
+	cfg := runConfig(t, newFakeIoT(), nil, now, map[string]string{
+		"FRANK_ENERGIE_URL":  server.URL,
+		"CA_BUNDLE_PATH":     bundle,
+		"FETCH_MAX_ATTEMPTS": "2",
+		"FETCH_RETRY_DELAY":  "1ms",
+	})
+
+	_, err := Run(context.Background(), cfg)
+	if !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("error = %v, want ErrRateLimited", err)
+	}
+	if errorType(err) != "RateLimitedError" {
+		t.Errorf("errorType = %s, want RateLimitedError", errorType(err))
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	"github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+)
+
+// Process-wide counters and the latest decision, shared by the CloudWatch
+// metrics and the Prometheus /metrics endpoint of long-lived HTTP deployments
+type ControllerMetrics struct {
+	mu              sync.Mutex
+	Runs            uint64
+	FetchFailures   uint64
+	Publishes       uint64
+	PublishFailures uint64
+	EffectivePrice  float64
+	SolarDisabled   bool
+	HasDecision     bool
+}
+
+var controllerMetrics = &ControllerMetrics{}
+
+func (m *ControllerMetrics) RecordRun() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.Runs++
+}
+
+func (m *ControllerMetrics) RecordFetchFailure() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.FetchFailures++
+}
+
+func (m *ControllerMetrics) RecordPublish(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err != nil {
+		m.PublishFailures++
+	} else {
+		m.Publishes++
+	}
+}
+
+func (m *ControllerMetrics) RecordDecision(effectivePrice float64, solarDisabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.EffectivePrice = effectivePrice
+	m.SolarDisabled = solarDisabled
+	m.HasDecision = true
+}
+
+// Write the metrics in the Prometheus text exposition format
+func (m *ControllerMetrics) WritePrometheus(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	writeMetric := func(name string, kind string, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %g\n", name, help, name, kind, name, value)
+	}
+
+	writeMetric("solar_controller_runs_total", "counter", "Decision runs started.", float64(m.Runs))
+	writeMetric("solar_controller_fetch_failures_total", "counter", "Price fetches that failed after all retries.", float64(m.FetchFailures))
+	writeMetric("solar_controller_publishes_total", "counter", "Commands delivered to the devices.", float64(m.Publishes))
+	writeMetric("solar_controller_publish_failures_total", "counter", "Commands that failed to reach at least one device.", float64(m.PublishFailures))
+
+	// Gauges are only meaningful once a price-based decision was made
+	if m.HasDecision {
+		disabled := 0.0
+		if m.SolarDisabled {
+			disabled = 1.0
+		}
+
+		writeMetric("solar_controller_effective_price", "gauge", "Effective price of the latest decision per kWh.", m.EffectivePrice)
+		writeMetric("solar_controller_solar_disabled", "gauge", "Whether the latest decision disabled solar.", disabled)
+	}
+}
+
+// Serve the metrics for Prometheus to scrape
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	controllerMetrics.WritePrometheus(w)
+}
+
+// CloudWatch data of the latest decision, the same values as the /metrics
+// gauges; none before a price-based decision was made
+func (m *ControllerMetrics) MetricData(timestamp time.Time) []types.MetricDatum {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.HasDecision {
+		return nil
+	}
+
+	disabled := 0.0
+	if m.SolarDisabled {
+		disabled = 1.0
+	}
+
+	return []types.MetricDatum{
+		{
+			MetricName: aws.String("EffectivePrice"),
+			Timestamp:  aws.Time(timestamp),
+			Value:      aws.Float64(m.EffectivePrice),
+			Unit:       types.StandardUnitNone,
+		},
+		{
+			MetricName: aws.String("SolarDisabled"),
+			Timestamp:  aws.Time(timestamp),
+			Value:      aws.Float64(disabled),
+			Unit:       types.StandardUnitCount,
+		},
+	}
+}
+
+// Publish the latest decision of metrics in a single PutMetricData call
+func publishMetrics(ctx context.Context, namespace string, timestamp time.Time, metrics *ControllerMetrics) error {
+	data := metrics.MetricData(timestamp)
+	if len(data) == 0 {
+		return nil
+	}
+
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("error loading AWS config: %w", err)
+	}
+
+	client := cloudwatch.NewFromConfig(cfg)
+
+	_, err = client.PutMetricData(ctx, &cloudwatch.PutMetricDataInput{
+		Namespace:  aws.String(namespace),
+		MetricData: data,
+	})
+	if err != nil {
+		return fmt.Errorf("error publishing CloudWatch metrics: %w", err)
+	}
+
+	return nil
+}
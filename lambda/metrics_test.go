@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+func TestControllerMetricsMetricData(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+	metrics := &ControllerMetrics{}
+
+	if data := metrics.MetricData(now); data != nil {
+		t.Fatalf("MetricData before a decision = %+v, want none", data)
+	}
+
+	metrics.RecordDecision(-0.05, true)
+
+	data := metrics.MetricData(now)
+	if len(data) != 2 {
+		t.Fatalf("MetricData = %+v, want EffectivePrice and SolarDisabled", data)
+	}
+
+	want := map[string]float64{"EffectivePrice": -0.05, "SolarDisabled": 1}
+	for _, datum := range data {
+		name := aws.ToString(datum.MetricName)
+		if value := aws.ToFloat64(datum.Value); value != want[name] {
+			t.Errorf("%s = %g, want %g", name, value, want[name])
+		}
+		if !aws.ToTime(datum.Timestamp).Equal(now) {
+			t.Errorf("%s timestamp = %s, want %s", name, aws.ToTime(datum.Timestamp), now)
+		}
+	}
+
+	// CloudWatch and /metrics report the same decision
+	var prometheus strings.Builder
+	metrics.WritePrometheus(&prometheus)
+	if !strings.Contains(prometheus.String(), "solar_controller_effective_price -0.05\n") || !strings.Contains(prometheus.String(), "solar_controller_solar_disabled 1\n") {
+		t.Errorf("/metrics = %s, want the same gauges", prometheus.String())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const NORDPOOL_API_URL = "https://dataportal-api.nordpoolgroup.com/api/DayAheadPrices"
+
+// Nord Pool day-ahead prices for a delivery area, e.g. NO1 or SE3
+type NordPoolProvider struct {
+	URL      string
+	Client   *http.Client
+	Area     string
+	Currency string
+	Retry    RetryPolicy
+}
+
+// Response structures
+type NordPoolPricesResponse struct {
+	Currency         string `json:"currency"`
+	MultiAreaEntries []struct {
+		DeliveryStart string             `json:"deliveryStart"`
+		DeliveryEnd   string             `json:"deliveryEnd"`
+		EntryPerArea  map[string]float64 `json:"entryPerArea"`
+	} `json:"multiAreaEntries"`
+}
+
+func (p *NordPoolProvider) FetchPrices(ctx context.Context, date string) ([]ElectricityPrice, error) {
+	query := url.Values{}
+	query.Set("date", date)
+	query.Set("market", "DayAhead")
+	query.Set("deliveryArea", p.Area)
+	query.Set("currency", p.Currency)
+
+	requestURL := p.URL + "?" + query.Encode()
+
+	newRequest := func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+	}
+
+	var response NordPoolPricesResponse
+
+	decode := func(body io.Reader) error {
+		return json.NewDecoder(body).Decode(&response)
+	}
+
+	// Nord Pool answers 204 No Content until the day's prices are published
+	err := doRequest(ctx, p.Client, p.Retry, "query Nord Pool day-ahead prices", "json", newRequest, decode)
+	if err != nil {
+		return nil, err
+	}
+
+	return mapNordPoolPrices(response, p.Area, p.Currency)
+}
+
+// Map the area's entries onto periods, normalizing per-MWh prices to per-kWh
+func mapNordPoolPrices(response NordPoolPricesResponse, area string, currency string) ([]ElectricityPrice, error) {
+	if len(response.MultiAreaEntries) > 0 && response.Currency != currency {
+		return nil, fmt.Errorf("unexpected Nord Pool currency %q, expected %s", response.Currency, currency)
+	}
+
+	var prices []ElectricityPrice
+
+	for _, entry := range response.MultiAreaEntries {
+		price, ok := entry.EntryPerArea[area]
+		if !ok {
+			return nil, fmt.Errorf("no Nord Pool price for area %s in period %s", area, entry.DeliveryStart)
+		}
+
+		start, err := time.Parse(time.RFC3339, entry.DeliveryStart)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing Nord Pool deliveryStart %q: %w", entry.DeliveryStart, err)
+		}
+
+		end, err := time.Parse(time.RFC3339, entry.DeliveryEnd)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing Nord Pool deliveryEnd %q: %w", entry.DeliveryEnd, err)
+		}
+
+		prices = append(prices, ElectricityPrice{
+			From:        start.UTC().Format(time.RFC3339),
+			Till:        end.UTC().Format(time.RFC3339),
+			MarketPrice: price / 1000,
+			PerUnit:     PRICE_UNIT,
+		})
+	}
+
+	return prices, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const TELEGRAM_API_URL = "https://api.telegram.org"
+
+// Telegram sendMessage request structure
+type TelegramMessage struct {
+	ChatId string `json:"chat_id"`
+	Text   string `json:"text"`
+}
+
+func sendTelegramNotification(ctx context.Context, client *http.Client, botToken string, chatId string, text string) error {
+	jsonData, err := json.Marshal(TelegramMessage{ChatId: chatId, Text: text})
+	if err != nil {
+		return fmt.Errorf("error marshaling Telegram message: %w", err)
+	}
+
+	endpoint := fmt.Sprintf("%s/bot%s/sendMessage", TELEGRAM_API_URL, botToken)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return fmt.Errorf("error creating Telegram request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// Avoid leaking the bot token, which is part of the URL
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("error sending Telegram message: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Telegram API returned status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
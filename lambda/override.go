@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Key of the manual override item in the state table
+const OVERRIDE_KEY = "override"
+
+// Manually forced state, e.g. during maintenance, valid until ExpiresAt
+type Override struct {
+	SolarDisabled bool
+	ExpiresAt     time.Time
+}
+
+// Read the override; active is false when none is set or it has expired
+func loadOverride(ctx context.Context, tableName string, now time.Time) (Override, bool, error) {
+	client, err := newDynamoDBClient(ctx)
+	if err != nil {
+		return Override{}, false, err
+	}
+
+	output, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: OVERRIDE_KEY},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return Override{}, false, fmt.Errorf("error reading override from DynamoDB: %w", err)
+	}
+
+	if output.Item == nil {
+		return Override{}, false, nil
+	}
+
+	var override Override
+
+	value, ok := output.Item["solar_disabled"].(*types.AttributeValueMemberBOOL)
+	if !ok {
+		return Override{}, false, fmt.Errorf("override item has no solar_disabled")
+	}
+
+	override.SolarDisabled = value.Value
+
+	// An override without an expiry would never clear, so it's required
+	expiresAt, ok := output.Item["expires_at"].(*types.AttributeValueMemberN)
+	if !ok {
+		return Override{}, false, fmt.Errorf("override item has no expires_at")
+	}
+
+	seconds, err := strconv.ParseInt(expiresAt.Value, 10, 64)
+	if err != nil {
+		return Override{}, false, fmt.Errorf("error parsing override expires_at: %w", err)
+	}
+
+	override.ExpiresAt = time.Unix(seconds, 0)
+
+	// DynamoDB deletes expired items lazily, so check the expiry ourselves
+	if !now.Before(override.ExpiresAt) {
+		return override, false, nil
+	}
+
+	return override, true, nil
+}
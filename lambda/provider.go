@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// Source of electricity prices for a given day
+type PriceProvider interface {
+	FetchPrices(ctx context.Context, date string) ([]ElectricityPrice, error)
+}
+
+// Select the price provider configured by PRICE_PROVIDER, failing over to
+// BACKUP_PRICE_PROVIDERS in order when any are configured
+func newPriceProvider(cfg Config) (PriceProvider, error) {
+	// Share one HTTP client between requests
+	client := newHTTPClient(cfg)
+
+	provider, err := newNamedProvider(cfg, cfg.PriceProvider, client)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.BackupPriceProviders) == 0 {
+		return provider, nil
+	}
+
+	failover := &FailoverProvider{Names: []string{cfg.PriceProvider}, Providers: []PriceProvider{provider}}
+
+	for _, name := range cfg.BackupPriceProviders {
+		backup, err := newNamedProvider(cfg, name, client)
+		if err != nil {
+			return nil, err
+		}
+
+		failover.Names = append(failover.Names, name)
+		failover.Providers = append(failover.Providers, backup)
+	}
+
+	return failover, nil
+}
+
+// Build a single provider by name, cached per provider when configured
+func newNamedProvider(cfg Config, name string, client *http.Client) (PriceProvider, error) {
+	var provider PriceProvider
+
+	location, err := priceLocation(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch name {
+	case "frankenergie":
+		provider = &FrankEnergieProvider{URL: cfg.FrankEnergieURL, Client: client, Retry: cfg.FetchRetry}
+	case "tibber":
+		if cfg.TibberToken == "" {
+			return nil, fmt.Errorf("TIBBER_TOKEN environment variable must be set for the tibber provider")
+		}
+		provider = &TibberProvider{URL: TIBBER_API_URL, Client: client, Token: cfg.TibberToken, HomeId: cfg.TibberHomeId, Retry: cfg.FetchRetry}
+	case "entsoe":
+		if cfg.EntsoeToken == "" {
+			return nil, fmt.Errorf("ENTSOE_TOKEN environment variable must be set for the entsoe provider")
+		}
+		provider = &EntsoeProvider{URL: ENTSOE_API_URL, Client: client, Token: cfg.EntsoeToken, BiddingZone: cfg.EntsoeBiddingZone, Location: location, Retry: cfg.FetchRetry}
+	case "nordpool":
+		if cfg.NordPoolArea == "" {
+			return nil, fmt.Errorf("NORDPOOL_AREA environment variable must be set for the nordpool provider")
+		}
+		provider = &NordPoolProvider{URL: NORDPOOL_API_URL, Client: client, Area: cfg.NordPoolArea, Currency: cfg.NordPoolCurrency, Retry: cfg.FetchRetry}
+	default:
+		return nil, fmt.Errorf("unknown price provider: %q", name)
+	}
+
+	// Wrap the provider in the DynamoDB cache when configured
+	if cfg.PriceCacheTable != "" {
+		provider = &CachingProvider{Provider: provider, Name: name, TableName: cfg.PriceCacheTable, Location: location, Now: configClock(cfg)}
+	}
+
+	return provider, nil
+}
+
+// Providers tried in order, the first success serves the prices
+type FailoverProvider struct {
+	Names     []string
+	Providers []PriceProvider
+
+	// Name of the provider that served the last successful fetch
+	Served string
+}
+
+func (p *FailoverProvider) FetchPrices(ctx context.Context, date string) ([]ElectricityPrice, error) {
+	var errs []error
+
+	for i, provider := range p.Providers {
+		prices, err := provider.FetchPrices(ctx, date)
+		if err == nil {
+			if i > 0 {
+				slog.Warn("Prices served by backup provider", "provider", p.Names[i], "date", date)
+			}
+
+			p.Served = p.Names[i]
+			return prices, nil
+		}
+
+		slog.Error("Price provider failed", "provider", p.Names[i], "date", date, "error", err)
+		errs = append(errs, fmt.Errorf("%s: %w", p.Names[i], err))
+	}
+
+	return nil, fmt.Errorf("all price providers failed: %w", errors.Join(errs...))
+}
+
+// Frank Energie market prices
+type FrankEnergieProvider struct {
+	URL    string
+	Client *http.Client
+	Retry  RetryPolicy
+}
+
+func (p *FrankEnergieProvider) FetchPrices(ctx context.Context, date string) ([]ElectricityPrice, error) {
+	return fetchMarketPrices(ctx, p.Client, p.URL, date, p.Retry)
+}
+
+// Longest range fetched at once, prices are rarely published beyond tomorrow
+const MAX_FETCH_DAYS = 7
+
+// Fetch days consecutive days starting at date and merge them into one
+// chronological list. Days without published prices contribute nothing
+func fetchPriceRange(ctx context.Context, provider PriceProvider, date string, days int) ([]ElectricityPrice, error) {
+	if days < 1 || days > MAX_FETCH_DAYS {
+		return nil, fmt.Errorf("days must be between 1 and %d, got %d", MAX_FETCH_DAYS, days)
+	}
+
+	start, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return nil, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", date)
+	}
+
+	lists := make([][]ElectricityPrice, 0, days)
+
+	for i := 0; i < days; i++ {
+		day := start.AddDate(0, 0, i).Format("2006-01-02")
+
+		prices, err := provider.FetchPrices(ctx, day)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching prices for %s: %w", day, err)
+		}
+
+		lists = append(lists, prices)
+	}
+
+	return mergePrices(lists...), nil
+}
+
+// Combine price lists sorted by start, keeping one entry per period start;
+// for periods returned more than once, e.g. around midnight, the later list wins
+func mergePrices(lists ...[]ElectricityPrice) []ElectricityPrice {
+	byStart := map[time.Time]ElectricityPrice{}
+
+	for _, prices := range lists {
+		for _, price := range prices {
+			fromTime, err := time.Parse(time.RFC3339, price.From)
+			if err != nil {
+				continue
+			}
+
+			byStart[fromTime.UTC()] = price
+		}
+	}
+
+	starts := make([]time.Time, 0, len(byStart))
+	for start := range byStart {
+		starts = append(starts, start)
+	}
+
+	sort.Slice(starts, func(i, j int) bool {
+		return starts[i].Before(starts[j])
+	})
+
+	merged := make([]ElectricityPrice, 0, len(starts))
+	for _, start := range starts {
+		merged = append(merged, byStart[start])
+	}
+
+	return merged
+}
+
+// Fetch tomorrow's prices, falling back to today's remaining periods while
+// tomorrow's prices are not published yet (around 13:00 local time)
+func fetchPricesWithFallback(ctx context.Context, provider PriceProvider, now time.Time, location *time.Location) ([]ElectricityPrice, error) {
+	tomorrow := now.In(location).AddDate(0, 0, 1).Format("2006-01-02")
+
+	prices, err := provider.FetchPrices(ctx, tomorrow)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(prices) > 0 {
+		return prices, nil
+	}
+
+	slog.Info("No prices published yet, falling back to today's remaining periods", "date", tomorrow)
+
+	today := now.In(location).Format("2006-01-02")
+
+	prices, err = provider.FetchPrices(ctx, today)
+	if err != nil {
+		return nil, err
+	}
+
+	var remaining []ElectricityPrice
+
+	for _, price := range prices {
+		tillTime, err := time.Parse(time.RFC3339, price.Till)
+		if err != nil {
+			continue
+		}
+
+		if tillTime.After(now) {
+			remaining = append(remaining, price)
+		}
+	}
+
+	return remaining, nil
+}
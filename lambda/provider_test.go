@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Provider serving fixed prices per date, failing with err when set
+type fakeProvider struct {
+	prices    map[string][]ElectricityPrice
+	err       error
+	requested []string
+	contexts  []context.Context
+}
+
+func (p *fakeProvider) FetchPrices(ctx context.Context, date string) ([]ElectricityPrice, error) {
+	p.requested = append(p.requested, date)
+	p.contexts = append(p.contexts, ctx)
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	return p.prices[date], nil
+}
+
+func TestFetchPricesWithFallback(t *testing.T) {
+	location, err := time.LoadLocation(PRICE_TIMEZONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 10:30 local, before tomorrow's prices are published
+	now := time.Date(2024, 1, 2, 10, 30, 0, 0, location)
+	today := dayPrices(t, now, 0.01)
+	tomorrow := dayPrices(t, now.AddDate(0, 0, 1), -0.01)
+
+	t.Run("tomorrow published", func(t *testing.T) {
+		provider := &fakeProvider{prices: map[string][]ElectricityPrice{"2024-01-02": today, "2024-01-03": tomorrow}}
+
+		prices, err := fetchPricesWithFallback(context.Background(), provider, now, location)
+		if err != nil {
+			t.Fatalf("fetchPricesWithFallback: %v", err)
+		}
+
+		if len(prices) != 24 || prices[0] != tomorrow[0] {
+			t.Errorf("got %d prices starting %+v, want tomorrow's 24", len(prices), prices[0])
+		}
+	})
+
+	t.Run("tomorrow empty", func(t *testing.T) {
+		provider := &fakeProvider{prices: map[string][]ElectricityPrice{"2024-01-02": today}}
+
+		prices, err := fetchPricesWithFallback(context.Background(), provider, now, location)
+		if err != nil {
+			t.Fatalf("fetchPricesWithFallback: %v", err)
+		}
+
+		// The 10:00 period is still running, the ones before it are over
+		if len(prices) != 14 || prices[0] != today[10] {
+			t.Errorf("got %d prices starting %+v, want today's 14 from 10:00", len(prices), prices[0])
+		}
+
+		if len(provider.requested) != 2 || provider.requested[0] != "2024-01-03" || provider.requested[1] != "2024-01-02" {
+			t.Errorf("requested %v, want tomorrow then today", provider.requested)
+		}
+	})
+
+	t.Run("fetch failure", func(t *testing.T) {
+		provider := &fakeProvider{err: errors.New("connection refused")}
+
+		_, err := fetchPricesWithFallback(context.Background(), provider, now, location)
+		if err == nil {
+			t.Fatal("fetchPricesWithFallback succeeded, want the fetch error")
+		}
+
+		if len(provider.requested) != 1 {
+			t.Errorf("requested %v, want no fallback to today after an error", provider.requested)
+		}
+	})
+
+	t.Run("failover", func(t *testing.T) {
+		primary := &fakeProvider{err: errors.New("connection refused")}
+		backup := &fakeProvider{prices: map[string][]ElectricityPrice{"2024-01-02": today}}
+		failover := &FailoverProvider{Names: []string{"frankenergie", "entsoe"}, Providers: []PriceProvider{primary, backup}}
+
+		prices, err := fetchPricesWithFallback(context.Background(), failover, now, location)
+		if err != nil {
+			t.Fatalf("fetchPricesWithFallback: %v", err)
+		}
+
+		if len(prices) != 14 || failover.Served != "entsoe" {
+			t.Errorf("got %d prices served by %q, want today's 14 from the backup", len(prices), failover.Served)
+		}
+	})
+}
+
+func TestScheduleHandlerFallsBackToToday(t *testing.T) {
+	isolateAWS(t)
+
+	location, err := time.LoadLocation(PRICE_TIMEZONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 1, 2, 10, 30, 0, 0, location)
+	today := marketPricesBody(t, dayPrices(t, now, -0.01))
+
+	// Only today's prices are published, tomorrow's come back empty
+	server := newTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request GraphQLRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("error decoding request: %v", err)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if request.Variables["date"] == "2024-01-02" {
+			w.Write([]byte(today))
+			return
+		}
+		w.Write([]byte(`{"data": {"marketPrices": {"electricityPrices": []}}}`))
+	}))
+
+	t.Setenv("FRANK_ENERGIE_URL", server.URL)
+	t.Setenv("SHELLY_CLIENT_IDS", "shelly-a")
+	t.Setenv("AS_OF", now.Format(time.RFC3339))
+	t.Setenv("FETCH_MAX_ATTEMPTS", "1")
+
+	recorder := httptest.NewRecorder()
+	newServeMux().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/schedule", nil))
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("GET /schedule = %d, want 200: %s", recorder.Code, recorder.Body)
+	}
+
+	var schedule []ScheduleEntry
+	if err := json.Unmarshal(recorder.Body.Bytes(), &schedule); err != nil {
+		t.Fatalf("body %q is not a schedule: %v", recorder.Body, err)
+	}
+
+	if len(schedule) != 14 {
+		t.Errorf("got %d entries, want today's 14 remaining periods", len(schedule))
+	}
+}
+
+func TestFetchPriceRange(t *testing.T) {
+	first := hourlyPrices(time.Date(2024, 1, 1, 23, 0, 0, 0, time.UTC), 0.01, 0.02)
+	// The second day repeats the last period of the first at a new price
+	second := hourlyPrices(time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC), 0.05, 0.03)
+	provider := &fakeProvider{prices: map[string][]ElectricityPrice{"2024-01-02": first, "2024-01-03": second}}
+
+	prices, err := fetchPriceRange(context.Background(), provider, "2024-01-02", 2)
+	if err != nil {
+		t.Fatalf("fetchPriceRange: %v", err)
+	}
+
+	if len(provider.requested) != 2 || provider.requested[0] != "2024-01-02" || provider.requested[1] != "2024-01-03" {
+		t.Errorf("requested %v, want both days in order", provider.requested)
+	}
+
+	want := []float64{0.01, 0.05, 0.03}
+	if len(prices) != len(want) {
+		t.Fatalf("got %d prices, want %d with the overlap merged", len(prices), len(want))
+	}
+	for i, price := range prices {
+		if price.MarketPrice != want[i] {
+			t.Errorf("price %d (%s) = %g, want %g", i, price.From, price.MarketPrice, want[i])
+		}
+	}
+}
+
+func TestFetchPriceRangeErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		date     string
+		days     int
+		provider *fakeProvider
+	}{
+		{"no days", "2024-01-02", 0, &fakeProvider{}},
+		{"beyond the maximum", "2024-01-02", MAX_FETCH_DAYS + 1, &fakeProvider{}},
+		{"invalid date", "02-01-2024", 2, &fakeProvider{}},
+		{"provider fails", "2024-01-02", 2, &fakeProvider{err: errors.New("unavailable")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := fetchPriceRange(context.Background(), tt.provider, tt.date, tt.days); err == nil {
+				t.Error("fetchPriceRange succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestMergePricesSortsAndDeduplicates(t *testing.T) {
+	later := ElectricityPrice{From: "2024-01-02T01:00:00Z", Till: "2024-01-02T02:00:00Z", MarketPrice: 0.02}
+	earlier := ElectricityPrice{From: "2024-01-02T00:00:00Z", Till: "2024-01-02T01:00:00Z", MarketPrice: 0.01}
+	// The same instant as earlier written with a local offset
+	repeated := ElectricityPrice{From: "2024-01-02T01:00:00+01:00", Till: "2024-01-02T02:00:00+01:00", MarketPrice: 0.04}
+
+	merged := mergePrices([]ElectricityPrice{later, earlier}, []ElectricityPrice{repeated})
+
+	if len(merged) != 2 || merged[0] != repeated || merged[1] != later {
+		t.Errorf("mergePrices = %+v, want the repeated period once, then the later one", merged)
+	}
+}
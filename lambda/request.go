@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Default timeout for requests to the price APIs, configurable via HTTP_TIMEOUT
+const HTTP_CLIENT_TIMEOUT = 30 * time.Second
+
+// Largest response body read from an API, prices for a day are a few KiB
+const MAX_RESPONSE_BYTES = 4 << 20
+
+// Length of the body excerpt included in decode errors
+const RESPONSE_SNIPPET_BYTES = 200
+
+// Upstream timing of the requests made with a context from withFetchStats
+type FetchStats struct {
+	Requests   int   `json:"requests"`
+	DurationMs int64 `json:"durationMs"`
+	StatusCode int   `json:"statusCode,omitempty"`
+}
+
+type fetchStatsKey struct{}
+
+// Collect the stats of every request made with the returned context, so
+// they reach the caller without threading them through the providers
+func withFetchStats(ctx context.Context) (context.Context, *FetchStats) {
+	stats := &FetchStats{}
+	return context.WithValue(ctx, fetchStatsKey{}, stats), stats
+}
+
+// Add a request to the context's stats, the status code of the last one wins
+func recordFetchStats(ctx context.Context, duration time.Duration, statusCode int) {
+	stats, ok := ctx.Value(fetchStatsKey{}).(*FetchStats)
+	if !ok {
+		return
+	}
+
+	stats.Requests++
+	stats.DurationMs += duration.Milliseconds()
+	stats.StatusCode = statusCode
+}
+
+// Clients shared by every request in the process, so a long-lived HTTP
+// deployment or a warm Lambda keeps its connections to the APIs open; one per
+// timeout and CA bundle, which only change with the configuration
+var (
+	httpClientsMu sync.Mutex
+	httpClients   = map[httpClientKey]*http.Client{}
+)
+
+type httpClientKey struct {
+	timeout  time.Duration
+	caBundle string
+}
+
+func newHTTPClient(cfg Config) *http.Client {
+	key := httpClientKey{timeout: cfg.HTTPTimeout, caBundle: cfg.CABundlePath}
+	if key.timeout <= 0 {
+		key.timeout = HTTP_CLIENT_TIMEOUT
+	}
+
+	httpClientsMu.Lock()
+	defer httpClientsMu.Unlock()
+
+	if client, ok := httpClients[key]; ok {
+		return client
+	}
+
+	client := &http.Client{Timeout: key.timeout, Transport: newHTTPTransport(cfg.RootCAs)}
+	httpClients[key] = client
+
+	return client
+}
+
+// Transport honouring HTTPS_PROXY, HTTP_PROXY and NO_PROXY, trusting rootCAs
+// instead of the system roots when set
+func newHTTPTransport(rootCAs *x509.CertPool) *http.Transport {
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		MaxIdleConns:          20,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+
+	if rootCAs != nil {
+		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs, MinVersion: tls.VersionTLS12}
+	}
+
+	return transport
+}
+
+// System roots plus the PEM certificates in path, e.g. a corporate proxy's CA
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificates found in CA bundle %s", path)
+	}
+
+	return pool, nil
+}
+
+// Send a request built by newRequest and hand a 200 response body of the
+// expected content type ("json" or "xml") to decode, retrying on network
+// errors and 5xx responses; a 204 leaves decode uncalled
+func doRequest(ctx context.Context, client *http.Client, retry RetryPolicy, operation string, contentType string, newRequest func() (*http.Request, error), decode func(io.Reader) error) error {
+	return withRetry(ctx, retry, operation, func() error {
+		req, err := newRequest()
+		if err != nil {
+			return fmt.Errorf("error creating request: %w", err)
+		}
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			recordFetchStats(ctx, time.Since(start), 0)
+
+			// Cancellation or a deadline is final, don't retry it
+			if ctx.Err() != nil {
+				return fmt.Errorf("error making request: %w", ctx.Err())
+			}
+
+			// Drop the URL from the error, it may carry an API token
+			var urlErr *url.Error
+			if errors.As(err, &urlErr) {
+				err = urlErr.Err
+			}
+			return retryable(fmt.Errorf("error making request: %w", err))
+		}
+		defer resp.Body.Close()
+
+		recordFetchStats(ctx, time.Since(start), resp.StatusCode)
+
+		if resp.StatusCode >= 500 {
+			return retryable(fmt.Errorf("API returned status code: %d", resp.StatusCode))
+		}
+
+		// Back off for at least as long as the API asks, e.g. when several
+		// controllers or multi-day fetches share its quota
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return retryableAfter(fmt.Errorf("%w: API returned status code: %d", ErrRateLimited, resp.StatusCode),
+				parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+		}
+
+		// Nothing to decode, e.g. prices that are not published yet
+		if resp.StatusCode == http.StatusNoContent {
+			return nil
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("API returned status code: %d", resp.StatusCode)
+		}
+
+		// Read one byte past the cap to tell a full body from a truncated one
+		body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_RESPONSE_BYTES+1))
+		if err != nil {
+			return retryable(fmt.Errorf("error reading response: %w", err))
+		}
+
+		if len(body) > MAX_RESPONSE_BYTES {
+			return fmt.Errorf("response exceeds %d bytes", MAX_RESPONSE_BYTES)
+		}
+
+		// An HTML error page would otherwise surface as a confusing decode error
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if !strings.Contains(mediaType, contentType) {
+			return fmt.Errorf("unexpected content type %q, expected %s: %s", resp.Header.Get("Content-Type"), contentType, snippet(body))
+		}
+
+		err = decode(bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("error decoding response: %w: %s", err, snippet(body))
+		}
+
+		return nil
+	})
+}
+
+// Start of a response body for error messages, quoted to keep logs on one line
+func snippet(body []byte) string {
+	if len(body) > RESPONSE_SNIPPET_BYTES {
+		return fmt.Sprintf("%q...", body[:RESPONSE_SNIPPET_BYTES])
+	}
+
+	return fmt.Sprintf("%q", body)
+}
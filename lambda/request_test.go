@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchMarketPricesHTMLBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte("<html><body>Gateway maintenance</body></html>"))
+	}))
+	defer server.Close()
+
+	_, err := fetchMarketPrices(context.Background(), server.Client(), server.URL, "2024-01-02", testRetry)
+	if err == nil || !strings.Contains(err.Error(), `unexpected content type "text/html; charset=utf-8"`) {
+		t.Fatalf("error = %v, want an unexpected content type error", err)
+	}
+
+	if !strings.Contains(err.Error(), "Gateway maintenance") {
+		t.Errorf("error = %v, want a snippet of the body", err)
+	}
+}
+
+func TestFetchMarketPricesOversizedBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": "` + strings.Repeat("x", MAX_RESPONSE_BYTES) + `"}`))
+	}))
+	defer server.Close()
+
+	_, err := fetchMarketPrices(context.Background(), server.Client(), server.URL, "2024-01-02", testRetry)
+	if err == nil || !strings.Contains(err.Error(), "response exceeds") {
+		t.Fatalf("error = %v, want the size limit error", err)
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	if got := snippet([]byte("short\nbody")); got != `"short\nbody"` {
+		t.Errorf("snippet = %s, want the quoted body", got)
+	}
+
+	long := strings.Repeat("a", RESPONSE_SNIPPET_BYTES+10)
+	if got := snippet([]byte(long)); got != `"`+long[:RESPONSE_SNIPPET_BYTES]+`"...` {
+		t.Errorf("snippet = %s, want the first %d bytes", got, RESPONSE_SNIPPET_BYTES)
+	}
+}
+
+// Re-run in a fresh process, as net/http reads the proxy variables once
+func TestHTTPClientUsesProxy(t *testing.T) {
+	if os.Getenv("DRM_CONTROLLER_PROXY_TEST") == "" {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestHTTPClientUsesProxy$", "-test.count=1")
+		cmd.Env = append(os.Environ(), "DRM_CONTROLLER_PROXY_TEST=1")
+
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("proxy test process: %v\n%s", err, output)
+		}
+		return
+	}
+
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy receives the absolute URL of the request
+		proxied = append(proxied, r.URL.String())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(proxy.Close)
+
+	t.Setenv("HTTP_PROXY", proxy.URL)
+	t.Setenv("NO_PROXY", "")
+
+	resp, err := newHTTPClient(Config{}).Get("http://prices.test/graphql")
+	if err != nil {
+		t.Fatalf("request through the proxy: %v", err)
+	}
+	resp.Body.Close()
+
+	if len(proxied) != 1 || proxied[0] != "http://prices.test/graphql" {
+		t.Errorf("proxy received %v, want the request to prices.test", proxied)
+	}
+}
+
+func TestHTTPClientTrustsCABundle(t *testing.T) {
+	server := newTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	t.Setenv("SHELLY_CLIENT_IDS", "shelly-a")
+	t.Setenv("IOT_ENDPOINT", "default.iot.test")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	resp, err := newHTTPClient(cfg).Get(server.URL)
+	if err != nil {
+		t.Fatalf("request with CA_BUNDLE_PATH: %v", err)
+	}
+	resp.Body.Close()
+
+	// The system roots alone don't know the test server's certificate
+	if _, err := newHTTPClient(Config{}).Get(server.URL); err == nil {
+		t.Error("request without CA_BUNDLE_PATH succeeded, want a certificate error")
+	}
+}
+
+func TestLoadConfigHTTPClient(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr bool
+	}{
+		{name: "timeout", env: map[string]string{"HTTP_TIMEOUT": "5s"}},
+		{name: "negative timeout", env: map[string]string{"HTTP_TIMEOUT": "-1s"}, wantErr: true},
+		{name: "missing CA bundle", env: map[string]string{"CA_BUNDLE_PATH": filepath.Join(t.TempDir(), "missing.pem")}, wantErr: true},
+		{name: "CA bundle without certificates", env: map[string]string{"CA_BUNDLE_PATH": notPEM}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SHELLY_CLIENT_IDS", "shelly-a")
+			t.Setenv("IOT_ENDPOINT", "default.iot.test")
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			cfg, err := loadConfig()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("loadConfig succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+
+			if client := newHTTPClient(cfg); client.Timeout != 5*time.Second {
+				t.Errorf("client timeout = %s, want HTTP_TIMEOUT", client.Timeout)
+			}
+		})
+	}
+}
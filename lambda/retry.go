@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Exponential backoff settings for retried operations
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+}
+
+// Marks an error as transient so the operation is attempted again, after at
+// least retryAfter when the server asked for a delay
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+func retryable(err error) error {
+	return &retryableError{err: err}
+}
+
+func retryableAfter(err error, retryAfter time.Duration) error {
+	return &retryableError{err: err, retryAfter: retryAfter}
+}
+
+// Parse a Retry-After header given in seconds or as an HTTP date, 0 if absent or invalid
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+
+	return 0
+}
+
+// Run fn until it succeeds, returns a non-retryable error or runs out of attempts
+func withRetry(ctx context.Context, policy RetryPolicy, operation string, fn func() error) error {
+	attempts := max(policy.MaxAttempts, 1)
+	delay := policy.BaseDelay
+
+	var err error
+
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = fn()
+		if err == nil {
+			return nil
+		}
+
+		var retryErr *retryableError
+		if !errors.As(err, &retryErr) {
+			return err
+		}
+
+		if attempt == attempts {
+			break
+		}
+
+		// Honour the server's hint when it asks for a longer wait
+		wait := max(delay, retryErr.retryAfter)
+
+		// Waiting past the deadline would only replace the error with a timeout
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			slog.Warn("Retry delay exceeds the deadline, giving up", "operation", operation, "attempt", attempt, "delay", wait, "error", err)
+			return fmt.Errorf("giving up after %d of %d attempts: %w", attempt, attempts, err)
+		}
+
+		slog.Warn("Attempt failed, retrying", "operation", operation, "attempt", attempt, "max_attempts", attempts, "delay", wait, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+
+		delay *= 2
+	}
+
+	return fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+}
+
+// Sleep a random duration below maxJitter, returning early when the context is done
+func sleepJitter(ctx context.Context, maxJitter time.Duration) error {
+	if maxJitter <= 0 {
+		return nil
+	}
+
+	wait := rand.N(maxJitter)
+
+	slog.Debug("Delaying publish", "jitter", wait)
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(wait):
+		return nil
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSleepJitter(t *testing.T) {
+	if err := sleepJitter(context.Background(), 0); err != nil {
+		t.Errorf("sleepJitter without jitter: %v", err)
+	}
+
+	started := time.Now()
+	if err := sleepJitter(context.Background(), 20*time.Millisecond); err != nil {
+		t.Errorf("sleepJitter: %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("slept %s, want at most the 20ms bound", elapsed)
+	}
+}
+
+func TestSleepJitterCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	started := time.Now()
+
+	err := sleepJitter(ctx, time.Hour)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(started); elapsed > time.Second {
+		t.Errorf("returned after %s, want promptly after the cancel", elapsed)
+	}
+}
+
+func TestSendCommandCancelledDuringJitter(t *testing.T) {
+	iot := newFakeIoT()
+	cfg := fakeIoTConfig(iot, "shelly-a")
+	cfg.PublishJitter = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := sendCommand(ctx, cfg, true, nil, CommandMeta{})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error = %v, want context.DeadlineExceeded", err)
+	}
+
+	if messages := iot.messages(); len(messages) != 0 {
+		t.Errorf("published %+v after the deadline, want nothing", messages)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{"", 0},
+		{"30", 30 * time.Second},
+		{"0", 0},
+		{"-5", 0},
+		{"Tue, 02 Jan 2024 13:01:00 GMT", time.Minute},
+		{"Tue, 02 Jan 2024 12:59:00 GMT", 0},
+		{"soon", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseRetryAfter(tt.value, now); got != tt.want {
+			t.Errorf("parseRetryAfter(%q) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestWithRetryHonoursRetryAfter(t *testing.T) {
+	var attempts []time.Time
+
+	err := withRetry(context.Background(), testRetry, "test", func() error {
+		attempts = append(attempts, time.Now())
+		if len(attempts) == 1 {
+			return retryableAfter(ErrRateLimited, 50*time.Millisecond)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("withRetry: %v", err)
+	}
+
+	if len(attempts) != 2 {
+		t.Fatalf("made %d attempts, want 2", len(attempts))
+	}
+	if wait := attempts[1].Sub(attempts[0]); wait < 50*time.Millisecond {
+		t.Errorf("retried after %s, want at least the 50ms Retry-After over the 1ms base delay", wait)
+	}
+}
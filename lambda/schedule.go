@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Decision for a single price period
+type ScheduleEntry struct {
+	From           time.Time `json:"from"`
+	Till           time.Time `json:"till"`
+	EffectivePrice float64   `json:"effectivePrice"`
+	ShouldDisable  bool      `json:"shouldDisable"`
+}
+
+// What exporting a kWh earns: the market price plus the fee. The fee is
+// signed from the exporter's point of view, so costs per exported kWh, such
+// as DEFAULT_FEED_IN_FEE of -0.012705, are negative and reduce the revenue,
+// and a feed-in bonus is positive. All decisions compare this net revenue,
+// the effective price, with the threshold
+func NetExportRevenue(marketPrice float64, fee float64) float64 {
+	return marketPrice + fee
+}
+
+// Prices closer to the threshold than this count as equal to it, so float
+// rounding such as -1e-17 can't flip the decision
+const DEFAULT_THRESHOLD_EPSILON = 1e-9
+
+// How prices are compared with a threshold
+type ThresholdMode struct {
+	Inclusive bool
+	Epsilon   float64
+}
+
+// -1, 0 or 1 as the price is below, within epsilon of or above the threshold
+func comparePrice(price float64, threshold float64, epsilon float64) int {
+	switch {
+	case math.Abs(price-threshold) <= epsilon:
+		return 0
+	case price < threshold:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// Whether a price is below the threshold, or at it with THRESHOLD_INCLUSIVE
+func belowThreshold(price float64, threshold float64, mode ThresholdMode) bool {
+	c := comparePrice(price, threshold, mode.Epsilon)
+	return c < 0 || (c == 0 && mode.Inclusive)
+}
+
+// Compute whether solar should be disabled for every price period
+func computeSchedule(prices []ElectricityPrice, fee float64, threshold float64, mode ThresholdMode) []ScheduleEntry {
+	schedule := make([]ScheduleEntry, 0, len(prices))
+
+	for _, price := range prices {
+		fromTime, err := time.Parse(time.RFC3339, price.From)
+		if err != nil {
+			continue
+		}
+
+		tillTime, err := time.Parse(time.RFC3339, price.Till)
+		if err != nil {
+			continue
+		}
+
+		effectivePrice := NetExportRevenue(price.MarketPrice, fee)
+
+		schedule = append(schedule, ScheduleEntry{
+			From:           fromTime,
+			Till:           tillTime,
+			EffectivePrice: effectivePrice,
+			ShouldDisable:  belowThreshold(effectivePrice, threshold, mode),
+		})
+	}
+
+	// Keep the schedule in chronological order
+	sort.Slice(schedule, func(i, j int) bool {
+		return schedule[i].From.Before(schedule[j].From)
+	})
+
+	return schedule
+}
+
+// Check that the periods parse, are sorted by From and that each Till is the
+// next period's From, returning a description of every anomaly found
+func validatePrices(prices []ElectricityPrice) []string {
+	var anomalies []string
+	var previousTill time.Time
+
+	for i, price := range prices {
+		fromTime, err := time.Parse(time.RFC3339, price.From)
+		if err != nil {
+			anomalies = append(anomalies, fmt.Sprintf("period %d has an invalid from %q", i, price.From))
+			previousTill = time.Time{}
+			continue
+		}
+
+		tillTime, err := time.Parse(time.RFC3339, price.Till)
+		if err != nil {
+			anomalies = append(anomalies, fmt.Sprintf("period %d has an invalid till %q", i, price.Till))
+			previousTill = time.Time{}
+			continue
+		}
+
+		if !tillTime.After(fromTime) {
+			anomalies = append(anomalies, fmt.Sprintf("period %s ends at or before it starts (%s)", price.From, price.Till))
+		}
+
+		if !previousTill.IsZero() {
+			switch {
+			case fromTime.Before(previousTill):
+				anomalies = append(anomalies, fmt.Sprintf("period %s overlaps or precedes the previous period ending %s", price.From, previousTill.Format(time.RFC3339)))
+			case fromTime.After(previousTill):
+				anomalies = append(anomalies, fmt.Sprintf("gap between %s and %s", previousTill.Format(time.RFC3339), price.From))
+			}
+		}
+
+		previousTill = tillTime
+	}
+
+	return anomalies
+}
+
+// Schedule for the configured STRATEGY: the threshold decisions as computed,
+// the cheapest N periods of the day for cheapest-n, or the periods below a
+// percentage of the day's median for relative
+func strategySchedule(prices []ElectricityPrice, cfg Config) []ScheduleEntry {
+	return decisionSchedule(prices, newDecisionConfig(cfg, prices, time.Time{}, false))
+}
+
+func decisionSchedule(prices []ElectricityPrice, cfg DecisionConfig) []ScheduleEntry {
+	schedule := computeSchedule(prices, cfg.FeedInFee, cfg.Threshold, cfg.Mode)
+
+	switch cfg.Strategy {
+	case "cheapest-n":
+		markCheapestPeriods(schedule, cfg.CheapestN)
+	case "relative":
+		threshold := relativeThreshold(schedule, cfg.RelativePercent)
+		for i := range schedule {
+			schedule[i].ShouldDisable = belowThreshold(schedule[i].EffectivePrice, threshold, cfg.Mode)
+		}
+	}
+
+	return schedule
+}
+
+// Schedule of prices spanning several days, each local day evaluated on its
+// own so the cheapest-n and relative strategies and the weekday threshold
+// apply per day as in a single-day schedule
+func rangeSchedule(prices []ElectricityPrice, cfg Config, location *time.Location) []ScheduleEntry {
+	schedule := []ScheduleEntry{}
+	var day []ElectricityPrice
+	var dayDate string
+
+	flush := func() {
+		if len(day) == 0 {
+			return
+		}
+
+		dayCfg := cfg
+		date, _ := time.Parse("2006-01-02", dayDate)
+		dayCfg.DisableThreshold = dayThreshold(cfg, date)
+
+		schedule = append(schedule, strategySchedule(day, dayCfg)...)
+		day = nil
+	}
+
+	for _, price := range prices {
+		fromTime, err := time.Parse(time.RFC3339, price.From)
+		if err != nil {
+			continue
+		}
+
+		date := fromTime.In(location).Format("2006-01-02")
+		if date != dayDate {
+			flush()
+			dayDate = date
+		}
+
+		day = append(day, price)
+	}
+
+	flush()
+
+	return schedule
+}
+
+// RELATIVE_THRESHOLD_PERCENT of the median effective price of the schedule
+func relativeThreshold(schedule []ScheduleEntry, percent float64) float64 {
+	prices := make([]float64, len(schedule))
+	for i, entry := range schedule {
+		prices[i] = entry.EffectivePrice
+	}
+
+	return medianPrice(prices) * percent / 100
+}
+
+// Median of the prices, the mean of the middle two for an even count and 0
+// for no prices
+func medianPrice(prices []float64) float64 {
+	if len(prices) == 0 {
+		return 0
+	}
+
+	sorted := append([]float64(nil), prices...)
+	sort.Float64s(sorted)
+
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+
+	return sorted[middle]
+}
+
+// Disable exactly the n periods with the lowest effective price; equal prices
+// are ranked by start time, so the earlier period wins the tie
+func markCheapestPeriods(schedule []ScheduleEntry, n int) {
+	order := make([]int, len(schedule))
+	for i := range order {
+		order[i] = i
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := schedule[order[i]], schedule[order[j]]
+		if a.EffectivePrice != b.EffectivePrice {
+			return a.EffectivePrice < b.EffectivePrice
+		}
+		return a.From.Before(b.From)
+	})
+
+	for rank, index := range order {
+		schedule[index].ShouldDisable = rank < n
+	}
+}
+
+// Decision of the period containing now, false when no period covers it
+func scheduledDecision(schedule []ScheduleEntry, now time.Time) bool {
+	for _, entry := range schedule {
+		if !now.Before(entry.From) && now.Before(entry.Till) {
+			return entry.ShouldDisable
+		}
+	}
+
+	return false
+}
+
+// Mean effective price over the period containing now and the following
+// window-1 periods; near the end of the data fewer periods are averaged
+func averageEffectivePrice(schedule []ScheduleEntry, now time.Time, window int) float64 {
+	var sum float64
+	var count int
+
+	for _, entry := range schedule {
+		if count == 0 && (now.Before(entry.From) || !now.Before(entry.Till)) {
+			continue
+		}
+
+		sum += entry.EffectivePrice
+		count++
+
+		if count == window {
+			break
+		}
+	}
+
+	if count == 0 {
+		return 0
+	}
+
+	return sum / float64(count)
+}
+
+// First period starting after now whose decision differs from the current
+// state; found is false when the schedule has no such period
+func findNextTransition(schedule []ScheduleEntry, now time.Time, currentlyDisabled bool) (at time.Time, shouldDisable bool, found bool) {
+	for _, entry := range schedule {
+		if !entry.From.After(now) {
+			continue
+		}
+
+		if entry.ShouldDisable != currentlyDisabled {
+			return entry.From, entry.ShouldDisable, true
+		}
+	}
+
+	return time.Time{}, false, false
+}
+
+// Contiguous block of periods with a negative effective price
+type Window struct {
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	AvgPrice float64   `json:"avgPrice"`
+}
+
+// Merge adjacent negative-price periods into windows
+func findNegativePriceWindows(prices []ElectricityPrice, fee float64) []Window {
+	var windows []Window
+	var current *Window
+	var weightedSum float64
+
+	closeWindow := func() {
+		if current != nil {
+			current.AvgPrice = weightedSum / current.End.Sub(current.Start).Hours()
+			windows = append(windows, *current)
+			current = nil
+		}
+	}
+
+	for _, entry := range computeSchedule(prices, fee, 0, ThresholdMode{Epsilon: DEFAULT_THRESHOLD_EPSILON}) {
+		if !entry.ShouldDisable {
+			closeWindow()
+			continue
+		}
+
+		// Start a new window unless this period directly follows the current one
+		if current == nil || !entry.From.Equal(current.End) {
+			closeWindow()
+			current = &Window{Start: entry.From, End: entry.From}
+			weightedSum = 0
+		}
+
+		// Weight by period length so mixed granularities average correctly
+		weightedSum += entry.EffectivePrice * entry.Till.Sub(entry.From).Hours()
+		current.End = entry.Till
+	}
+
+	closeWindow()
+
+	return windows
+}
+
+// Window starting after now but no more than lead away
+func findUpcomingWindow(windows []Window, now time.Time, lead time.Duration) (Window, bool) {
+	for _, window := range windows {
+		if window.Start.After(now) && !window.Start.Add(-lead).After(now) {
+			return window, true
+		}
+	}
+
+	return Window{}, false
+}
+
+// Euros saved by not exporting at full inverter output during the windows,
+// the negative effective price being what each exported kWh would cost
+func estimateSavings(windows []Window, inverterKw float64) float64 {
+	var savings float64
+
+	for _, window := range windows {
+		savings += -window.AvgPrice * inverterKw * window.End.Sub(window.Start).Hours()
+	}
+
+	return savings
+}
+
+// Period whose decision differs between the cached and the fresh prices
+type ScheduleChange struct {
+	From                 time.Time `json:"from"`
+	Till                 time.Time `json:"till"`
+	CachedEffectivePrice float64   `json:"cachedEffectivePrice"`
+	EffectivePrice       float64   `json:"effectivePrice"`
+	ShouldDisable        bool      `json:"shouldDisable"`
+}
+
+// Periods, matched by their start, whose ShouldDisable flipped from the
+// cached schedule to the fresh one
+func diffSchedules(cached []ScheduleEntry, fresh []ScheduleEntry) []ScheduleChange {
+	previous := make(map[time.Time]ScheduleEntry, len(cached))
+	for _, entry := range cached {
+		previous[entry.From.UTC()] = entry
+	}
+
+	changes := []ScheduleChange{}
+
+	for _, entry := range fresh {
+		old, ok := previous[entry.From.UTC()]
+		if !ok || old.ShouldDisable == entry.ShouldDisable {
+			continue
+		}
+
+		changes = append(changes, ScheduleChange{
+			From:                 entry.From,
+			Till:                 entry.Till,
+			CachedEffectivePrice: old.EffectivePrice,
+			EffectivePrice:       entry.EffectivePrice,
+			ShouldDisable:        entry.ShouldDisable,
+		})
+	}
+
+	return changes
+}
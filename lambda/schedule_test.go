@@ -0,0 +1,384 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAverageEffectivePrice(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	schedule := computeSchedule(hourlyPrices(start, 0.09, -0.03, 0.06, 0.03, -0.06), 0, 0, ThresholdMode{})
+	now := start.Add(time.Hour + 30*time.Minute)
+
+	tests := []struct {
+		name   string
+		now    time.Time
+		window int
+		want   float64
+	}{
+		{"window 1 is the current period", now, 1, -0.03},
+		{"window 2 adds the next period", now, 2, 0.015},
+		{"window 3 adds the next two periods", now, 3, 0.02},
+		{"window past the end of the data", start.Add(4 * time.Hour), 3, -0.06},
+		{"no current period", start.Add(-time.Hour), 2, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := averageEffectivePrice(schedule, tt.now, tt.window)
+			if math.Abs(got-tt.want) > 1e-12 {
+				t.Errorf("averageEffectivePrice(window %d) = %g, want %g", tt.window, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEstimateSavings(t *testing.T) {
+	start := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		windows    []Window
+		inverterKw float64
+		want       float64
+	}{
+		{"no windows", nil, 5, 0},
+		{"one hour at -0.02", []Window{{Start: start, End: start.Add(time.Hour), AvgPrice: -0.02}}, 5, 0.1},
+		{"two windows", []Window{
+			{Start: start, End: start.Add(2 * time.Hour), AvgPrice: -0.01},
+			{Start: start.Add(4 * time.Hour), End: start.Add(4*time.Hour + 30*time.Minute), AvgPrice: -0.04},
+		}, 4, 0.16},
+		{"no inverter output", []Window{{Start: start, End: start.Add(time.Hour), AvgPrice: -0.02}}, 0, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := estimateSavings(tt.windows, tt.inverterKw)
+			if math.Abs(got-tt.want) > 1e-12 {
+				t.Errorf("estimateSavings = %g, want %g", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindNegativePriceWindows(t *testing.T) {
+	start := time.Date(2024, 1, 2, 10, 0, 0, 0, time.UTC)
+	prices := hourlyPrices(start, 0.01, -0.01, -0.03, 0.02, -0.04)
+
+	// Quarter-hour periods weigh a quarter of an hour
+	prices = append(prices, ElectricityPrice{
+		From:        start.Add(5 * time.Hour).Format(time.RFC3339),
+		Till:        start.Add(5*time.Hour + 15*time.Minute).Format(time.RFC3339),
+		MarketPrice: -0.08,
+		PerUnit:     "KWH",
+	})
+
+	windows := findNegativePriceWindows(prices, 0)
+	if len(windows) != 2 {
+		t.Fatalf("got %d windows, want 2: %+v", len(windows), windows)
+	}
+
+	want := []Window{
+		{Start: start.Add(time.Hour), End: start.Add(3 * time.Hour), AvgPrice: -0.02},
+		{Start: start.Add(4 * time.Hour), End: start.Add(5*time.Hour + 15*time.Minute), AvgPrice: -0.048},
+	}
+
+	for i := range want {
+		if !windows[i].Start.Equal(want[i].Start) || !windows[i].End.Equal(want[i].End) || math.Abs(windows[i].AvgPrice-want[i].AvgPrice) > 1e-12 {
+			t.Errorf("window %d = %+v, want %+v", i, windows[i], want[i])
+		}
+	}
+
+	// 5 kW for 2 hours at 0.02 plus 1.25 hours at 0.048
+	if got := estimateSavings(windows, 5); math.Abs(got-0.5) > 1e-12 {
+		t.Errorf("estimateSavings = %g, want 0.5", got)
+	}
+}
+
+func TestValidatePrices(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	gap := hourlyPrices(start, 0.01, 0.02, 0.03)
+	gap = append(gap[:1], gap[2])
+
+	overlap := hourlyPrices(start, 0.01, 0.02)
+	overlap[1].From = start.Add(30 * time.Minute).Format(time.RFC3339)
+
+	unsorted := hourlyPrices(start, 0.01, 0.02)
+	unsorted[0], unsorted[1] = unsorted[1], unsorted[0]
+
+	invalid := hourlyPrices(start, 0.01, 0.02)
+	invalid[0].From = "yesterday"
+
+	empty := hourlyPrices(start, 0.01)
+	empty[0].Till = empty[0].From
+
+	tests := []struct {
+		name   string
+		prices []ElectricityPrice
+		want   []string
+	}{
+		{"contiguous", hourlyPrices(start, 0.01, 0.02, 0.03), nil},
+		{"no prices", nil, nil},
+		{"gap", gap, []string{"gap between 2024-01-02T01:00:00Z and 2024-01-02T02:00:00Z"}},
+		{"overlap", overlap, []string{"period 2024-01-02T00:30:00Z overlaps or precedes the previous period ending 2024-01-02T01:00:00Z"}},
+		{"unsorted", unsorted, []string{"period 2024-01-02T00:00:00Z overlaps or precedes the previous period ending 2024-01-02T02:00:00Z"}},
+		{"invalid from", invalid, []string{`period 0 has an invalid from "yesterday"`}},
+		{"zero length", empty, []string{"period 2024-01-02T00:00:00Z ends at or before it starts (2024-01-02T00:00:00Z)"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := validatePrices(tt.prices)
+
+			if len(got) != len(tt.want) {
+				t.Fatalf("validatePrices = %q, want %q", got, tt.want)
+			}
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("anomaly %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMarkCheapestPeriods(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		marketPrices []float64
+		n            int
+		want         []bool
+	}{
+		{"cheapest two", []float64{0.05, 0.01, 0.04, 0.02}, 2, []bool{false, true, false, true}},
+		{"ties go to the earlier period", []float64{0.03, 0.01, 0.01, 0.01}, 2, []bool{false, true, true, false}},
+		{"all equal", []float64{0.02, 0.02, 0.02}, 1, []bool{true, false, false}},
+		{"n beyond the day", []float64{0.02, 0.01}, 5, []bool{true, true}},
+		{"n of zero", []float64{-0.02, -0.01}, 0, []bool{false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule := computeSchedule(hourlyPrices(start, tt.marketPrices...), 0, 0, ThresholdMode{})
+			markCheapestPeriods(schedule, tt.n)
+
+			for i, entry := range schedule {
+				if entry.ShouldDisable != tt.want[i] {
+					t.Errorf("period %d (%g) ShouldDisable = %t, want %t", i, entry.EffectivePrice, entry.ShouldDisable, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestMarkCheapestPeriodsTiesStable(t *testing.T) {
+	// The tie-break is by start, not by position in the provider's response
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	prices := hourlyPrices(start, 0.01, 0.01, 0.01)
+	prices[0], prices[2] = prices[2], prices[0]
+
+	schedule := computeSchedule(prices, 0, 0, ThresholdMode{})
+	markCheapestPeriods(schedule, 1)
+
+	for _, entry := range schedule {
+		if entry.ShouldDisable != entry.From.Equal(start) {
+			t.Errorf("period %s ShouldDisable = %t, want only the earliest tied period", entry.From, entry.ShouldDisable)
+		}
+	}
+}
+
+func TestBelowThresholdFloatNoise(t *testing.T) {
+	// 0.1 + 0.2 - 0.3 nets to 5.55e-17 rather than 0 at run time
+	a, b, c := 0.1, 0.2, 0.3
+	noise := a + b - c
+	if noise == 0 {
+		t.Fatal("no float noise to test with")
+	}
+
+	strict := ThresholdMode{Epsilon: DEFAULT_THRESHOLD_EPSILON}
+	inclusive := ThresholdMode{Inclusive: true, Epsilon: DEFAULT_THRESHOLD_EPSILON}
+
+	tests := []struct {
+		name  string
+		price float64
+		mode  ThresholdMode
+		want  bool
+	}{
+		{"positive noise, strict", noise, strict, false},
+		{"negative noise, strict", -noise, strict, false},
+		{"negative zero, strict", math.Copysign(0, -1), strict, false},
+		{"positive noise, inclusive", noise, inclusive, true},
+		{"negative noise, inclusive", -noise, inclusive, true},
+		{"clearly below", -0.001, strict, true},
+		{"clearly above, inclusive", 0.001, inclusive, false},
+		{"negative noise without epsilon flips", -noise, ThresholdMode{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := belowThreshold(tt.price, 0, tt.mode); got != tt.want {
+				t.Errorf("belowThreshold(%g, 0, %+v) = %t, want %t", tt.price, tt.mode, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputeScheduleFeeNoise(t *testing.T) {
+	// A market price that nets to the threshold through the fee arithmetic
+	prices := hourlyPrices(time.Date(2024, 1, 2, 12, 0, 0, 0, time.UTC), 0.3)
+	a, b := 0.1, 0.2
+	fee := -a - b
+
+	entry := computeSchedule(prices, fee, 0, ThresholdMode{Epsilon: DEFAULT_THRESHOLD_EPSILON})[0]
+	if entry.EffectivePrice == 0 {
+		t.Fatal("no float noise to test with")
+	}
+	if entry.ShouldDisable {
+		t.Errorf("effective price %g disables solar, want it treated as the threshold", entry.EffectivePrice)
+	}
+}
+
+func TestMedianPrice(t *testing.T) {
+	tests := []struct {
+		name   string
+		prices []float64
+		want   float64
+	}{
+		{"no prices", nil, 0},
+		{"single price", []float64{0.04}, 0.04},
+		{"odd count", []float64{0.05, 0.01, 0.03}, 0.03},
+		{"even count takes the middle mean", []float64{0.04, 0.01, 0.02, 0.10}, 0.03},
+		{"negative prices", []float64{-0.02, -0.06, 0.01}, -0.02},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prices := append([]float64(nil), tt.prices...)
+
+			if got := medianPrice(prices); math.Abs(got-tt.want) > 1e-12 {
+				t.Errorf("medianPrice(%v) = %g, want %g", tt.prices, got, tt.want)
+			}
+
+			for i := range prices {
+				if prices[i] != tt.prices[i] {
+					t.Fatalf("medianPrice reordered its input to %v", prices)
+				}
+			}
+		})
+	}
+}
+
+func TestDecisionScheduleRelative(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name         string
+		marketPrices []float64
+		want         []bool
+	}{
+		// Median 0.10, disabled below 0.05
+		{"odd day", []float64{0.10, 0.04, 0.12, 0.06, 0.10}, []bool{false, true, false, false, false}},
+		// Median (0.08 + 0.12) / 2 = 0.10, disabled below 0.05
+		{"even day", []float64{0.12, 0.03, 0.08, 0.20}, []bool{false, true, false, false}},
+		// Strict: exactly half the median stays enabled
+		{"at the relative threshold", []float64{0.10, 0.05, 0.10}, []bool{false, false, false}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			schedule := decisionSchedule(hourlyPrices(start, tt.marketPrices...), DecisionConfig{Strategy: "relative", RelativePercent: 50})
+
+			for i, entry := range schedule {
+				if entry.ShouldDisable != tt.want[i] {
+					t.Errorf("period %d (%g) ShouldDisable = %t, want %t", i, entry.EffectivePrice, entry.ShouldDisable, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigRelativeStrategy(t *testing.T) {
+	t.Setenv("SHELLY_CLIENT_IDS", "shelly-a")
+	t.Setenv("IOT_ENDPOINT", "default.iot.test")
+	t.Setenv("STRATEGY", "relative")
+
+	if _, err := loadConfig(); err == nil {
+		t.Error("STRATEGY=relative without RELATIVE_THRESHOLD_PERCENT loaded, want an error")
+	}
+
+	t.Setenv("RELATIVE_THRESHOLD_PERCENT", "40")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.Strategy != "relative" || cfg.RelativePercent != 40 {
+		t.Errorf("Strategy = %q, RelativePercent = %g, want relative at 40", cfg.Strategy, cfg.RelativePercent)
+	}
+}
+
+func TestNetExportRevenue(t *testing.T) {
+	tests := []struct {
+		name        string
+		marketPrice float64
+		fee         float64
+		want        float64
+	}{
+		{"cost reduces the revenue", 0.10, DEFAULT_FEED_IN_FEE, 0.087295},
+		{"cost turns a small positive price negative", 0.01, DEFAULT_FEED_IN_FEE, -0.002705},
+		{"cost deepens a negative price", -0.05, DEFAULT_FEED_IN_FEE, -0.062705},
+		{"bonus raises the revenue", -0.01, 0.02, 0.01},
+		{"no fee", 0.03, 0, 0.03},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NetExportRevenue(tt.marketPrice, tt.fee); math.Abs(got-tt.want) > 1e-12 {
+				t.Errorf("NetExportRevenue(%g, %g) = %g, want %g", tt.marketPrice, tt.fee, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputeScheduleUsesNetExportRevenue(t *testing.T) {
+	start := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	// Positive market prices that only the export cost pushes below zero
+	schedule := computeSchedule(hourlyPrices(start, 0.01, 0.02), DEFAULT_FEED_IN_FEE, 0, ThresholdMode{})
+
+	if !schedule[0].ShouldDisable || schedule[0].EffectivePrice != NetExportRevenue(0.01, DEFAULT_FEED_IN_FEE) {
+		t.Errorf("period 0 = %+v, want disabled at the net revenue", schedule[0])
+	}
+	if schedule[1].ShouldDisable {
+		t.Errorf("period 1 = %+v, want enabled while the net revenue stays positive", schedule[1])
+	}
+}
+
+func TestLoadConfigFeeComponents(t *testing.T) {
+	t.Setenv("SHELLY_CLIENT_IDS", "shelly-a")
+	t.Setenv("IOT_ENDPOINT", "default.iot.test")
+
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if cfg.FeedInFee != DEFAULT_FEED_IN_FEE {
+		t.Errorf("default FeedInFee = %g, want %g", cfg.FeedInFee, DEFAULT_FEED_IN_FEE)
+	}
+
+	// Every component is signed like the total, costs negative
+	t.Setenv("FEED_IN_FEE", "-0.01")
+	t.Setenv("ENERGY_TAX", "-0.02")
+	t.Setenv("SUPPLIER_MARKUP", "0.005")
+
+	cfg, err = loadConfig()
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if math.Abs(cfg.FeedInFee-(-0.025)) > 1e-12 {
+		t.Errorf("FeedInFee = %g, want the components summed to -0.025", cfg.FeedInFee)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// Prefixes of environment values resolved from a secret store at startup
+const (
+	SSM_PREFIX             = "ssm:"
+	SECRETS_MANAGER_PREFIX = "secretsmanager:"
+)
+
+// Subset of the SSM client used to read parameters
+type ParameterGetter interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+// Subset of the Secrets Manager client used to read secrets
+type SecretGetter interface {
+	GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error)
+}
+
+// Resolves ssm: and secretsmanager: references, each fetched once for the
+// lifetime of the process
+type SecretResolver struct {
+	Parameters ParameterGetter
+	Secrets    SecretGetter
+	cache      map[string]string
+}
+
+// Replace every environment value referencing a secret store with the
+// stored value, so loadConfig reads them like plain variables. The AWS
+// clients are only created when a reference is present
+func resolveSecretEnv(ctx context.Context) error {
+	var names []string
+
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		if strings.HasPrefix(value, SSM_PREFIX) || strings.HasPrefix(value, SECRETS_MANAGER_PREFIX) {
+			names = append(names, name)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("error loading AWS config: %w", err)
+	}
+
+	resolver := &SecretResolver{Parameters: ssm.NewFromConfig(cfg), Secrets: secretsmanager.NewFromConfig(cfg)}
+
+	return resolver.ResolveEnv(ctx, names)
+}
+
+// Replace the values of the named environment variables with what their
+// references resolve to
+func (r *SecretResolver) ResolveEnv(ctx context.Context, names []string) error {
+	for _, name := range names {
+		value, err := r.Resolve(ctx, os.Getenv(name))
+		if err != nil {
+			return fmt.Errorf("error resolving %s: %w", name, err)
+		}
+
+		err = os.Setenv(name, value)
+		if err != nil {
+			return fmt.Errorf("error setting %s: %w", name, err)
+		}
+		slog.Debug("Resolved configuration value from secret store", "name", name)
+	}
+
+	return nil
+}
+
+// Value of a reference: ssm:/path/to/parameter, decrypted for SecureStrings,
+// or secretsmanager:name, with an optional #key to pick a field of a JSON
+// secret. Other values are returned unchanged
+func (r *SecretResolver) Resolve(ctx context.Context, reference string) (string, error) {
+	if value, ok := r.cache[reference]; ok {
+		return value, nil
+	}
+
+	var value string
+	var err error
+
+	switch {
+	case strings.HasPrefix(reference, SSM_PREFIX):
+		value, err = r.parameter(ctx, strings.TrimPrefix(reference, SSM_PREFIX))
+	case strings.HasPrefix(reference, SECRETS_MANAGER_PREFIX):
+		value, err = r.secret(ctx, strings.TrimPrefix(reference, SECRETS_MANAGER_PREFIX))
+	default:
+		return reference, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if r.cache == nil {
+		r.cache = map[string]string{}
+	}
+	r.cache[reference] = value
+
+	return value, nil
+}
+
+func (r *SecretResolver) parameter(ctx context.Context, name string) (string, error) {
+	output, err := r.Parameters.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error reading SSM parameter %s: %w", name, err)
+	}
+
+	if output.Parameter == nil || output.Parameter.Value == nil {
+		return "", fmt.Errorf("SSM parameter %s has no value", name)
+	}
+
+	return *output.Parameter.Value, nil
+}
+
+func (r *SecretResolver) secret(ctx context.Context, reference string) (string, error) {
+	name, key, hasKey := strings.Cut(reference, "#")
+
+	output, err := r.Secrets.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+		SecretId: aws.String(name),
+	})
+	if err != nil {
+		return "", fmt.Errorf("error reading secret %s: %w", name, err)
+	}
+
+	if output.SecretString == nil {
+		return "", fmt.Errorf("secret %s has no string value", name)
+	}
+
+	if !hasKey {
+		return *output.SecretString, nil
+	}
+
+	var fields map[string]any
+
+	err = json.Unmarshal([]byte(*output.SecretString), &fields)
+	if err != nil {
+		return "", fmt.Errorf("secret %s is not a JSON object: %w", name, err)
+	}
+
+	field, ok := fields[key]
+	if !ok {
+		return "", fmt.Errorf("secret %s has no key %q", name, key)
+	}
+
+	if value, ok := field.(string); ok {
+		return value, nil
+	}
+
+	// Numbers and booleans as they appear in the JSON
+	encoded, err := json.Marshal(field)
+	if err != nil {
+		return "", fmt.Errorf("error encoding key %q of secret %s: %w", key, name, err)
+	}
+
+	return string(encoded), nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+)
+
+// SSM parameters by name, counting the reads
+type fakeSSM struct {
+	values map[string]string
+	calls  int
+}
+
+func (f *fakeSSM) GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	f.calls++
+
+	if !aws.ToBool(params.WithDecryption) {
+		return nil, errors.New("SecureString read without decryption")
+	}
+
+	value, ok := f.values[aws.ToString(params.Name)]
+	if !ok {
+		return nil, errors.New("ParameterNotFound")
+	}
+
+	return &ssm.GetParameterOutput{Parameter: &ssmtypes.Parameter{Value: aws.String(value)}}, nil
+}
+
+// Secrets Manager secrets by ID, counting the reads
+type fakeSecretsManager struct {
+	values map[string]string
+	calls  int
+}
+
+func (f *fakeSecretsManager) GetSecretValue(ctx context.Context, params *secretsmanager.GetSecretValueInput, optFns ...func(*secretsmanager.Options)) (*secretsmanager.GetSecretValueOutput, error) {
+	f.calls++
+
+	value, ok := f.values[aws.ToString(params.SecretId)]
+	if !ok {
+		return nil, errors.New("ResourceNotFoundException")
+	}
+
+	return &secretsmanager.GetSecretValueOutput{SecretString: aws.String(value)}, nil
+}
+
+func newFakeSecretResolver() (*SecretResolver, *fakeSSM, *fakeSecretsManager) {
+	parameters := &fakeSSM{values: map[string]string{"/drm/entsoe-token": "entsoe-secret"}}
+	secrets := &fakeSecretsManager{values: map[string]string{
+		"drm/shelly":   `{"authKey":"shelly-secret","port":8443,"enabled":true}`,
+		"drm/telegram": "telegram-secret",
+	}}
+
+	return &SecretResolver{Parameters: parameters, Secrets: secrets}, parameters, secrets
+}
+
+func TestSecretResolverResolve(t *testing.T) {
+	tests := []struct {
+		reference string
+		want      string
+		wantErr   string
+	}{
+		{reference: "plain-value", want: "plain-value"},
+		{reference: "ssm:/drm/entsoe-token", want: "entsoe-secret"},
+		{reference: "secretsmanager:drm/telegram", want: "telegram-secret"},
+		{reference: "secretsmanager:drm/shelly#authKey", want: "shelly-secret"},
+		{reference: "secretsmanager:drm/shelly#port", want: "8443"},
+		{reference: "secretsmanager:drm/shelly#enabled", want: "true"},
+		{reference: "ssm:/drm/missing", wantErr: "/drm/missing"},
+		{reference: "secretsmanager:drm/shelly#missing", wantErr: `no key "missing"`},
+		{reference: "secretsmanager:drm/telegram#key", wantErr: "not a JSON object"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.reference, func(t *testing.T) {
+			resolver, _, _ := newFakeSecretResolver()
+
+			value, err := resolver.Resolve(context.Background(), tt.reference)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve: %v", err)
+			}
+
+			if value != tt.want {
+				t.Errorf("Resolve(%q) = %q, want %q", tt.reference, value, tt.want)
+			}
+		})
+	}
+}
+
+func TestSecretResolverCaches(t *testing.T) {
+	resolver, parameters, secrets := newFakeSecretResolver()
+
+	for range 3 {
+		if _, err := resolver.Resolve(context.Background(), "ssm:/drm/entsoe-token"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := resolver.Resolve(context.Background(), "secretsmanager:drm/shelly#authKey"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if parameters.calls != 1 || secrets.calls != 1 {
+		t.Errorf("read SSM %d and Secrets Manager %d times, want each once", parameters.calls, secrets.calls)
+	}
+}
+
+func TestSecretResolverResolveEnv(t *testing.T) {
+	resolver, _, _ := newFakeSecretResolver()
+
+	t.Setenv("ENTSOE_TOKEN", "ssm:/drm/entsoe-token")
+	t.Setenv("SHELLY_CLOUD_AUTH_KEY", "secretsmanager:drm/shelly#authKey")
+
+	err := resolver.ResolveEnv(context.Background(), []string{"ENTSOE_TOKEN", "SHELLY_CLOUD_AUTH_KEY"})
+	if err != nil {
+		t.Fatalf("ResolveEnv: %v", err)
+	}
+
+	if os.Getenv("ENTSOE_TOKEN") != "entsoe-secret" || os.Getenv("SHELLY_CLOUD_AUTH_KEY") != "shelly-secret" {
+		t.Errorf("environment = %q and %q, want the resolved values", os.Getenv("ENTSOE_TOKEN"), os.Getenv("SHELLY_CLOUD_AUTH_KEY"))
+	}
+
+	t.Setenv("TELEGRAM_BOT_TOKEN", "secretsmanager:drm/missing")
+
+	err = resolver.ResolveEnv(context.Background(), []string{"TELEGRAM_BOT_TOKEN"})
+	if err == nil || !strings.Contains(err.Error(), "TELEGRAM_BOT_TOKEN") {
+		t.Errorf("error = %v, want one naming the variable", err)
+	}
+
+	// The environment can't hold a NUL byte
+	resolver.Secrets.(*fakeSecretsManager).values["drm/binary"] = "telegram\x00secret"
+	t.Setenv("TELEGRAM_BOT_TOKEN", "secretsmanager:drm/binary")
+
+	err = resolver.ResolveEnv(context.Background(), []string{"TELEGRAM_BOT_TOKEN"})
+	if err == nil || !strings.Contains(err.Error(), "error setting TELEGRAM_BOT_TOKEN") {
+		t.Errorf("error = %v, want the failed Setenv naming the variable", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iotdataplane"
+)
+
+// Subset of the IoT Data Plane client used to set the desired shadow state
+type ShadowUpdater interface {
+	UpdateThingShadow(ctx context.Context, params *iotdataplane.UpdateThingShadowInput, optFns ...func(*iotdataplane.Options)) (*iotdataplane.UpdateThingShadowOutput, error)
+}
+
+// Desired relay output written to the device shadow
+type ShadowUpdate struct {
+	State struct {
+		Desired struct {
+			Output bool `json:"output"`
+		} `json:"desired"`
+	} `json:"state"`
+}
+
+// Sets state.desired.output in the shadow of the thing named after each
+// client ID, for bridges that act on shadow deltas instead of a command topic
+type ShadowTransport struct {
+	Updater ShadowUpdater
+	Shadows ShadowReader
+	Config  Config
+}
+
+func newShadowTransport(ctx context.Context, cfg Config) (*ShadowTransport, error) {
+	iotClient, err := defaultIoTClient(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ShadowTransport{Updater: iotClient, Shadows: iotClient, Config: cfg}, nil
+}
+
+func (t *ShadowTransport) Send(ctx context.Context, clientID string, on bool) error {
+	payload, err := buildShadowUpdate(on)
+	if err != nil {
+		return err
+	}
+
+	input := &iotdataplane.UpdateThingShadowInput{
+		ThingName: aws.String(clientID),
+		Payload:   payload,
+	}
+
+	// The classic shadow unless SHADOW_NAME selects a named one
+	if t.Config.ShadowName != "" {
+		input.ShadowName = aws.String(t.Config.ShadowName)
+	}
+
+	err = withRetry(ctx, t.Config.PublishRetry, "update shadow of "+clientID, func() error {
+		_, err := t.Updater.UpdateThingShadow(ctx, input)
+		if err != nil {
+			return classifyPublishError(ctx, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error updating device shadow: %w", err)
+	}
+
+	slog.Info("Updated device shadow", "client_id", clientID, "shadow_name", t.Config.ShadowName, "payload", string(payload))
+
+	if t.Config.ConfirmTimeout <= 0 {
+		return nil
+	}
+
+	err = confirmShadowState(ctx, t.Shadows, clientID, t.Config.SwitchChannel, on, t.Config.ConfirmTimeout)
+	if err != nil {
+		return fmt.Errorf("error confirming command: %w", err)
+	}
+
+	slog.Info("Device confirmed switch output", "client_id", clientID, "output", on)
+
+	return nil
+}
+
+// Marshal the shadow update document, {"state":{"desired":{"output":true}}}
+func buildShadowUpdate(on bool) ([]byte, error) {
+	var update ShadowUpdate
+	update.State.Desired.Output = on
+
+	payload, err := json.Marshal(update)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling shadow update: %w", err)
+	}
+
+	return payload, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/iotdataplane"
+)
+
+// Records shadow updates, failing the first failures calls
+type fakeShadowUpdater struct {
+	updates  []*iotdataplane.UpdateThingShadowInput
+	failures int
+}
+
+func (f *fakeShadowUpdater) UpdateThingShadow(ctx context.Context, params *iotdataplane.UpdateThingShadowInput, optFns ...func(*iotdataplane.Options)) (*iotdataplane.UpdateThingShadowOutput, error) {
+	if f.failures > 0 {
+		f.failures--
+		return nil, errors.New("connection reset")
+	}
+
+	f.updates = append(f.updates, params)
+	return &iotdataplane.UpdateThingShadowOutput{}, nil
+}
+
+// Shadow reporting a fixed switch:0 output
+type fakeShadowReader struct {
+	output bool
+}
+
+func (f fakeShadowReader) GetThingShadow(ctx context.Context, params *iotdataplane.GetThingShadowInput, optFns ...func(*iotdataplane.Options)) (*iotdataplane.GetThingShadowOutput, error) {
+	payload := fmt.Sprintf(`{"state":{"reported":{"switch:0":{"output":%t}}}}`, f.output)
+	return &iotdataplane.GetThingShadowOutput{Payload: []byte(payload)}, nil
+}
+
+func TestBuildShadowUpdate(t *testing.T) {
+	for on, want := range map[bool]string{
+		true:  `{"state":{"desired":{"output":true}}}`,
+		false: `{"state":{"desired":{"output":false}}}`,
+	} {
+		payload, err := buildShadowUpdate(on)
+		if err != nil {
+			t.Fatalf("buildShadowUpdate(%t): %v", on, err)
+		}
+		if string(payload) != want {
+			t.Errorf("buildShadowUpdate(%t) = %s, want %s", on, payload, want)
+		}
+	}
+}
+
+func TestShadowTransportSend(t *testing.T) {
+	tests := []struct {
+		name       string
+		shadowName string
+		want       *string
+	}{
+		{name: "classic shadow", want: nil},
+		{name: "named shadow", shadowName: "relay", want: aws.String("relay")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			updater := &fakeShadowUpdater{}
+			transport := &ShadowTransport{Updater: updater, Config: Config{ShadowName: tt.shadowName, PublishRetry: testRetry}}
+
+			if err := transport.Send(context.Background(), "shelly-a", false); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+
+			if len(updater.updates) != 1 {
+				t.Fatalf("sent %d updates, want 1", len(updater.updates))
+			}
+
+			update := updater.updates[0]
+			if aws.ToString(update.ThingName) != "shelly-a" {
+				t.Errorf("ThingName = %q, want the client ID", aws.ToString(update.ThingName))
+			}
+			if aws.ToString(update.ShadowName) != aws.ToString(tt.want) || (update.ShadowName == nil) != (tt.want == nil) {
+				t.Errorf("ShadowName = %v, want %v", update.ShadowName, tt.want)
+			}
+			if string(update.Payload) != `{"state":{"desired":{"output":false}}}` {
+				t.Errorf("Payload = %s, want the desired output off", update.Payload)
+			}
+		})
+	}
+}
+
+func TestShadowTransportRetry(t *testing.T) {
+	updater := &fakeShadowUpdater{failures: 1}
+	transport := &ShadowTransport{Updater: updater, Config: Config{PublishRetry: testRetry}}
+
+	if err := transport.Send(context.Background(), "shelly-a", true); err != nil {
+		t.Fatalf("Send after one failure: %v", err)
+	}
+	if len(updater.updates) != 1 {
+		t.Errorf("sent %d updates, want the retry to land", len(updater.updates))
+	}
+
+	updater = &fakeShadowUpdater{failures: testRetry.MaxAttempts}
+	transport.Updater = updater
+
+	if err := transport.Send(context.Background(), "shelly-a", true); err == nil {
+		t.Error("Send succeeded with every attempt failing")
+	}
+}
+
+func TestShadowTransportConfirm(t *testing.T) {
+	cfg := Config{PublishRetry: testRetry, ConfirmTimeout: time.Millisecond}
+
+	transport := &ShadowTransport{Updater: &fakeShadowUpdater{}, Shadows: fakeShadowReader{output: true}, Config: cfg}
+	if err := transport.Send(context.Background(), "shelly-a", true); err != nil {
+		t.Errorf("Send with the output reported: %v", err)
+	}
+
+	transport = &ShadowTransport{Updater: &fakeShadowUpdater{}, Shadows: fakeShadowReader{output: true}, Config: cfg}
+	if err := transport.Send(context.Background(), "shelly-a", false); !errors.Is(err, ErrConfirmationTimeout) {
+		t.Errorf("Send with the old output still reported = %v, want ErrConfirmationTimeout", err)
+	}
+}
+
+func TestRunShadowMode(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+	iot := newFakeIoT()
+	cfg := runConfig(t, iot, dayPrices(t, now, -0.05), now, map[string]string{"CONTROL_MODE": "shadow", "SHADOW_NAME": "relay"})
+
+	result, err := Run(context.Background(), cfg)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !result.CommandSent {
+		t.Fatalf("result = %+v, want the command sent", result)
+	}
+
+	// The shadow goes through the configured IoT client, not a new SDK client
+	updates := iot.shadows()
+	if len(updates) != 1 || aws.ToString(updates[0].ThingName) != "shelly-a" || aws.ToString(updates[0].ShadowName) != "relay" {
+		t.Fatalf("shadow updates = %+v, want one to shelly-a's relay shadow", updates)
+	}
+	if string(updates[0].Payload) != `{"state":{"desired":{"output":true}}}` {
+		t.Errorf("Payload = %s, want the desired output on", updates[0].Payload)
+	}
+	if len(iot.endpoints) == 0 || iot.endpoints[0] != "default.iot.test" {
+		t.Errorf("clients for %v, want IOT_ENDPOINT", iot.endpoints)
+	}
+	if messages := iot.messages(); len(messages) != 0 {
+		t.Errorf("published %+v, want nothing on the command topic", messages)
+	}
+}
+
+func TestLoadConfigShadowMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "iot transport", env: map[string]string{}},
+		{name: "shelly cloud transport", env: map[string]string{"TRANSPORT": "shellycloud", "SHELLY_CLOUD_AUTH_KEY": "key", "SHELLY_CLOUD_URL": "https://shelly.test"}, wantErr: "requires TRANSPORT=iot"},
+		{name: "group topic", env: map[string]string{"GROUP_TOPIC": "shellies/command"}, wantErr: "GROUP_TOPIC"},
+		{name: "unknown mode", env: map[string]string{"CONTROL_MODE": "delta"}, wantErr: "must be topic or shadow"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("SHELLY_CLIENT_IDS", "shelly-a")
+			t.Setenv("IOT_ENDPOINT", "default.iot.test")
+			t.Setenv("CONTROL_MODE", "shadow")
+			t.Setenv("SHADOW_NAME", "relay")
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			cfg, err := loadConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one mentioning %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig: %v", err)
+			}
+
+			if cfg.ControlMode != "shadow" || cfg.ShadowName != "relay" {
+				t.Errorf("ControlMode = %q, ShadowName = %q, want shadow and relay", cfg.ControlMode, cfg.ShadowName)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Shelly Cloud relay control, for devices that aren't connected to IoT Core
+type ShellyCloudTransport struct {
+	URL     string
+	Client  *http.Client
+	AuthKey string
+	Channel int
+	Retry   RetryPolicy
+}
+
+// Response structure
+type ShellyCloudResponse struct {
+	IsOk   bool                       `json:"isok"`
+	Errors map[string]json.RawMessage `json:"errors"`
+}
+
+func (t *ShellyCloudTransport) Send(ctx context.Context, clientID string, on bool) error {
+	turn := "off"
+
+	if on {
+		turn = "on"
+	}
+
+	form := url.Values{}
+	form.Set("id", clientID)
+	form.Set("auth_key", t.AuthKey)
+	form.Set("channel", strconv.Itoa(t.Channel))
+	form.Set("turn", turn)
+
+	endpoint := strings.TrimSuffix(t.URL, "/") + "/device/relay/control"
+	body := form.Encode()
+
+	newRequest := func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	}
+
+	var response ShellyCloudResponse
+
+	// A 204 or an empty body has no isok to check
+	empty := true
+
+	decode := func(body io.Reader) error {
+		err := json.NewDecoder(body).Decode(&response)
+		if err == io.EOF {
+			return nil
+		}
+
+		empty = false
+		return err
+	}
+
+	err := doRequest(ctx, t.Client, t.Retry, "control relay via Shelly Cloud", "json", newRequest, decode)
+	if err != nil {
+		return err
+	}
+
+	if empty {
+		return nil
+	}
+
+	// Shelly Cloud reports failures with a 200 and isok set to false
+	if !response.IsOk {
+		var reasons []string
+		for name := range response.Errors {
+			reasons = append(reasons, name)
+		}
+		return fmt.Errorf("Shelly Cloud rejected the command: %s", strings.Join(reasons, ", "))
+	}
+
+	return nil
+}
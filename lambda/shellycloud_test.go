@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestShellyCloudTransportSend(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{name: "accepted", status: http.StatusOK, body: `{"isok": true}`},
+		{name: "rejected", status: http.StatusOK, body: `{"isok": false, "errors": {"device_offline": "Device is offline"}}`, wantErr: "rejected the command: device_offline"},
+		{name: "no content", status: http.StatusNoContent},
+		{name: "empty body", status: http.StatusOK},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: "status code: 500"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var form url.Values
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if err := r.ParseForm(); err != nil {
+					t.Errorf("error parsing form: %v", err)
+				}
+				form = r.PostForm
+
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			t.Cleanup(server.Close)
+
+			transport := &ShellyCloudTransport{URL: server.URL + "/", Client: server.Client(), AuthKey: "key", Channel: 1, Retry: testRetry}
+
+			err := transport.Send(context.Background(), "shelly-a", true)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+
+			if form.Get("id") != "shelly-a" || form.Get("auth_key") != "key" || form.Get("channel") != "1" || form.Get("turn") != "on" {
+				t.Errorf("form = %v, want shelly-a's channel 1 turned on", form)
+			}
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sns"
+	"github.com/aws/aws-sdk-go-v2/service/sns/types"
+)
+
+// Publish the decision to SNS, with a shouldDisable attribute for subscription filters
+func publishDecision(ctx context.Context, topicArn string, result HandlerResult) error {
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("error loading AWS config: %w", err)
+	}
+
+	message, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("error marshaling decision: %w", err)
+	}
+
+	client := sns.NewFromConfig(cfg)
+
+	_, err = client.Publish(ctx, &sns.PublishInput{
+		TopicArn: aws.String(topicArn),
+		Message:  aws.String(string(message)),
+		MessageAttributes: map[string]types.MessageAttributeValue{
+			"shouldDisable": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(strconv.FormatBool(result.ShouldDisableSolar)),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error publishing decision to SNS: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Key of the single state item shared by all devices
+const STATE_KEY = "solar-controller"
+
+// Key of the command sequence counter, its own item because saveState
+// replaces the state item as a whole
+const SEQUENCE_KEY = "command-sequence"
+
+// Last command and circuit breaker state persisted between invocations
+type ControllerState struct {
+	SolarDisabled   bool
+	UpdatedAt       time.Time
+	ChangedAt       time.Time
+	FetchFailures   int
+	BreakerOpenedAt time.Time
+}
+
+func loadState(ctx context.Context, tableName string) (ControllerState, bool, error) {
+	client, err := newDynamoDBClient(ctx)
+	if err != nil {
+		return ControllerState{}, false, err
+	}
+
+	output, err := client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: STATE_KEY},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return ControllerState{}, false, fmt.Errorf("error reading state from DynamoDB: %w", err)
+	}
+
+	// No prior state stored yet
+	if output.Item == nil {
+		return ControllerState{}, false, nil
+	}
+
+	var state ControllerState
+
+	if value, ok := output.Item["solar_disabled"].(*types.AttributeValueMemberBOOL); ok {
+		state.SolarDisabled = value.Value
+	}
+
+	if value, ok := output.Item["updated_at"].(*types.AttributeValueMemberS); ok {
+		state.UpdatedAt, err = time.Parse(time.RFC3339, value.Value)
+		if err != nil {
+			return ControllerState{}, false, fmt.Errorf("error parsing stored updated_at: %w", err)
+		}
+	}
+
+	if value, ok := output.Item["changed_at"].(*types.AttributeValueMemberS); ok {
+		state.ChangedAt, err = time.Parse(time.RFC3339, value.Value)
+		if err != nil {
+			return ControllerState{}, false, fmt.Errorf("error parsing stored changed_at: %w", err)
+		}
+	}
+
+	if value, ok := output.Item["fetch_failures"].(*types.AttributeValueMemberN); ok {
+		state.FetchFailures, err = strconv.Atoi(value.Value)
+		if err != nil {
+			return ControllerState{}, false, fmt.Errorf("error parsing stored fetch_failures: %w", err)
+		}
+	}
+
+	if value, ok := output.Item["breaker_opened_at"].(*types.AttributeValueMemberS); ok {
+		state.BreakerOpenedAt, err = time.Parse(time.RFC3339, value.Value)
+		if err != nil {
+			return ControllerState{}, false, fmt.Errorf("error parsing stored breaker_opened_at: %w", err)
+		}
+	}
+
+	return state, true, nil
+}
+
+func saveState(ctx context.Context, tableName string, state ControllerState) error {
+	client, err := newDynamoDBClient(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(tableName),
+		Item: map[string]types.AttributeValue{
+			"id":                &types.AttributeValueMemberS{Value: STATE_KEY},
+			"solar_disabled":    &types.AttributeValueMemberBOOL{Value: state.SolarDisabled},
+			"updated_at":        &types.AttributeValueMemberS{Value: state.UpdatedAt.UTC().Format(time.RFC3339)},
+			"changed_at":        &types.AttributeValueMemberS{Value: state.ChangedAt.UTC().Format(time.RFC3339)},
+			"fetch_failures":    &types.AttributeValueMemberN{Value: strconv.Itoa(state.FetchFailures)},
+			"breaker_opened_at": &types.AttributeValueMemberS{Value: state.BreakerOpenedAt.UTC().Format(time.RFC3339)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error writing state to DynamoDB: %w", err)
+	}
+
+	return nil
+}
+
+// Atomically increment the command sequence and return the new value, 1 for
+// the first command
+func nextSequence(ctx context.Context, tableName string) (int64, error) {
+	client, err := newDynamoDBClient(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	output, err := client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(tableName),
+		Key: map[string]types.AttributeValue{
+			"id": &types.AttributeValueMemberS{Value: SEQUENCE_KEY},
+		},
+		UpdateExpression: aws.String("ADD #sequence :one"),
+		ExpressionAttributeNames: map[string]string{
+			"#sequence": "sequence",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":one": &types.AttributeValueMemberN{Value: "1"},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error incrementing command sequence in DynamoDB: %w", err)
+	}
+
+	value, ok := output.Attributes["sequence"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, fmt.Errorf("error reading command sequence: attribute missing from update result")
+	}
+
+	sequence, err := strconv.ParseInt(value.Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing stored sequence: %w", err)
+	}
+
+	return sequence, nil
+}
+
+func newDynamoDBClient(ctx context.Context) (*dynamodb.Client, error) {
+	dynamoDBClientMu.Lock()
+	defer dynamoDBClientMu.Unlock()
+
+	if dynamoDBClient != nil {
+		return dynamoDBClient, nil
+	}
+
+	cfg, err := loadAWSConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error loading AWS config: %w", err)
+	}
+
+	dynamoDBClient = dynamodb.NewFromConfig(cfg)
+	return dynamoDBClient, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Topic receiving the controller status, {clientId} is replaced per device
+const STATUS_TOPIC_TEMPLATE = CLIENT_ID_PLACEHOLDER + "/status/controller"
+
+// Topic receiving error notices with PUBLISH_ERRORS
+const ERROR_TOPIC_TEMPLATE = CLIENT_ID_PLACEHOLDER + "/status/error"
+
+// Notice of a failed run
+type ControllerError struct {
+	Error     string `json:"error"`
+	Type      string `json:"type"`
+	Source    string `json:"source"`
+	Timestamp string `json:"timestamp"`
+}
+
+func reportError(ctx context.Context, cfg Config, cause error, now time.Time) error {
+	iotClient, err := defaultIoTClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	return publishError(ctx, iotClient, cfg, cause, now)
+}
+
+// Publish an error notice for cause to every device, collecting failures
+func publishError(ctx context.Context, publisher Publisher, cfg Config, cause error, now time.Time) error {
+	payload, err := json.Marshal(ControllerError{
+		Error:     cause.Error(),
+		Type:      errorType(cause),
+		Source:    COMMAND_SOURCE,
+		Timestamp: now.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling error notice: %w", err)
+	}
+
+	var errs []error
+
+	for _, shellyClientId := range cfg.ShellyClientIds {
+		topic := strings.ReplaceAll(ERROR_TOPIC_TEMPLATE, CLIENT_ID_PLACEHOLDER, shellyClientId)
+
+		devicePublisher := publisher
+		if _, ok := findIoTTarget(cfg.IotTargets, shellyClientId); ok {
+			client, err := deviceIoTClient(ctx, cfg, nil, shellyClientId)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("device %s: %w", shellyClientId, err))
+				continue
+			}
+			devicePublisher = client
+		}
+
+		if devicePublisher == nil {
+			errs = append(errs, fmt.Errorf("device %s: IOT_ENDPOINT environment variable must be set", shellyClientId))
+			continue
+		}
+
+		err = publishPayload(ctx, devicePublisher, cfg, topic, payload)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("device %s: %w", shellyClientId, err))
+			continue
+		}
+
+		slog.Info("Published error notice", "topic", topic, "error_type", errorType(cause))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Status published next to the command, explaining the relay's state
+type ControllerStatus struct {
+	EffectivePrice     float64 `json:"effectivePrice"`
+	DecisionPrice      float64 `json:"decisionPrice"`
+	ShouldDisableSolar bool    `json:"shouldDisableSolar"`
+	CommandSent        bool    `json:"commandSent"`
+	Reason             string  `json:"reason"`
+	Timestamp          string  `json:"timestamp"`
+}
+
+// Publish the status of this run to every device, collecting failures
+func publishStatus(ctx context.Context, cfg Config, result HandlerResult, reason string) error {
+	payload, err := json.Marshal(ControllerStatus{
+		EffectivePrice:     result.EffectivePrice,
+		DecisionPrice:      result.DecisionPrice,
+		ShouldDisableSolar: result.ShouldDisableSolar,
+		CommandSent:        result.CommandSent,
+		Reason:             reason,
+		Timestamp:          result.Timestamp.UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		return fmt.Errorf("error marshaling controller status: %w", err)
+	}
+
+	iotClient, err := defaultIoTClient(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for _, shellyClientId := range cfg.ShellyClientIds {
+		topic := strings.ReplaceAll(STATUS_TOPIC_TEMPLATE, CLIENT_ID_PLACEHOLDER, shellyClientId)
+
+		client, err := deviceIoTClient(ctx, cfg, iotClient, shellyClientId)
+		if err == nil {
+			err = publishPayload(ctx, client, cfg, topic, payload)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("device %s: %w", shellyClientId, err))
+			continue
+		}
+
+		slog.Info("Published controller status", "topic", topic)
+	}
+
+	return errors.Join(errs...)
+}
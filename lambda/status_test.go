@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRunPublishesErrorNotice(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T, iot *fakeIoT) Config
+		wantErr    error
+		wantType   string
+		wantNotice bool
+	}{
+		{
+			name: "fetch failure",
+			setup: func(t *testing.T, iot *fakeIoT) Config {
+				server := newTLSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusInternalServerError)
+				}))
+				return runConfig(t, iot, nil, now, map[string]string{
+					"PUBLISH_ERRORS":    "true",
+					"FRANK_ENERGIE_URL": server.URL,
+					"CA_BUNDLE_PATH":    os.Getenv("CA_BUNDLE_PATH"),
+				})
+			},
+			wantErr:    ErrFetch,
+			wantType:   "FetchError",
+			wantNotice: true,
+		},
+		{
+			name: "config failure",
+			setup: func(t *testing.T, iot *fakeIoT) Config {
+				cfg := runConfig(t, iot, nil, now, map[string]string{"PUBLISH_ERRORS": "true"})
+				cfg.PriceProvider = "tibber"
+				return cfg
+			},
+			wantErr:    ErrConfig,
+			wantType:   "ConfigError",
+			wantNotice: true,
+		},
+		{
+			name: "publish failure",
+			setup: func(t *testing.T, iot *fakeIoT) Config {
+				iot.fail["shelly-a/command/switch:0"] = errors.New("access denied")
+				return runConfig(t, iot, dayPrices(t, now, -0.05), now, map[string]string{"PUBLISH_ERRORS": "true"})
+			},
+			wantErr: ErrPublish,
+		},
+		{
+			name: "notices off",
+			setup: func(t *testing.T, iot *fakeIoT) Config {
+				cfg := runConfig(t, iot, nil, now, nil)
+				cfg.PriceProvider = "tibber"
+				return cfg
+			},
+			wantErr: ErrConfig,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iot := newFakeIoT()
+			cfg := tt.setup(t, iot)
+
+			_, err := Run(context.Background(), cfg)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+
+			var notices []publishedMessage
+			for _, message := range iot.messages() {
+				if message.Topic == "shelly-a/status/error" {
+					notices = append(notices, message)
+				}
+			}
+
+			if !tt.wantNotice {
+				if len(notices) != 0 {
+					t.Errorf("published %+v, want no error notice", notices)
+				}
+				return
+			}
+
+			if len(notices) != 1 {
+				t.Fatalf("published %d error notices, want 1", len(notices))
+			}
+
+			var notice ControllerError
+			if err := json.Unmarshal(notices[0].Payload, &notice); err != nil {
+				t.Fatalf("notice %s is not a ControllerError: %v", notices[0].Payload, err)
+			}
+			if notice.Type != tt.wantType || notice.Error != err.Error() || notice.Source != COMMAND_SOURCE || notice.Timestamp != now.Format(time.RFC3339) {
+				t.Errorf("notice = %+v, want a %s for %q at %s", notice, tt.wantType, err, now.Format(time.RFC3339))
+			}
+		})
+	}
+}
+
+func TestRunErrorNoticeDryRun(t *testing.T) {
+	iot := newFakeIoT()
+	cfg := runConfig(t, iot, nil, time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC), map[string]string{"PUBLISH_ERRORS": "true", "DRY_RUN": "true"})
+	cfg.PriceProvider = "tibber"
+
+	if _, err := Run(context.Background(), cfg); !errors.Is(err, ErrConfig) {
+		t.Fatalf("error = %v, want ErrConfig", err)
+	}
+	if messages := iot.messages(); len(messages) != 0 {
+		t.Errorf("dry run published %+v, want nothing", messages)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Persistence shared by hysteresis, MIN_STATE_DURATION, SKIP_UNCHANGED, the
+// circuit breaker, manual overrides, idempotency keys and command sequence
+// numbers
+type StateStore interface {
+	GetState(ctx context.Context) (ControllerState, bool, error)
+	PutState(ctx context.Context, state ControllerState) error
+	GetOverride(ctx context.Context, now time.Time) (Override, bool, error)
+	ClaimKey(ctx context.Context, key string, now time.Time, ttl time.Duration) (bool, error)
+	ReleaseKey(ctx context.Context, key string) error
+	NextSequence(ctx context.Context) (int64, error)
+}
+
+// Process-wide memory store, so a long-lived HTTP deployment keeps its state
+// between requests
+var sharedMemoryStateStore = NewMemoryStateStore()
+
+// Select the store configured by STATE_STORE
+func newStateStore(cfg Config) (StateStore, error) {
+	switch cfg.StateStoreKind {
+	case "dynamodb":
+		return &DynamoDBStateStore{TableName: cfg.StateTable}, nil
+	case "memory":
+		return sharedMemoryStateStore, nil
+	case "none":
+		return NopStateStore{}, nil
+	default:
+		return nil, fmt.Errorf("unknown state store %q", cfg.StateStoreKind)
+	}
+}
+
+// All state in the single STATE_TABLE
+type DynamoDBStateStore struct {
+	TableName string
+}
+
+func (s *DynamoDBStateStore) GetState(ctx context.Context) (ControllerState, bool, error) {
+	return loadState(ctx, s.TableName)
+}
+
+func (s *DynamoDBStateStore) PutState(ctx context.Context, state ControllerState) error {
+	return saveState(ctx, s.TableName, state)
+}
+
+func (s *DynamoDBStateStore) GetOverride(ctx context.Context, now time.Time) (Override, bool, error) {
+	return loadOverride(ctx, s.TableName, now)
+}
+
+func (s *DynamoDBStateStore) ClaimKey(ctx context.Context, key string, now time.Time, ttl time.Duration) (bool, error) {
+	return claimIdempotencyKey(ctx, s.TableName, key, now.Add(ttl))
+}
+
+func (s *DynamoDBStateStore) ReleaseKey(ctx context.Context, key string) error {
+	return releaseIdempotencyKey(ctx, s.TableName, key)
+}
+
+func (s *DynamoDBStateStore) NextSequence(ctx context.Context) (int64, error) {
+	return nextSequence(ctx, s.TableName)
+}
+
+// State held in the process, lost on restart. Manual overrides are set in the
+// DynamoDB state table, so this store never has one
+type MemoryStateStore struct {
+	mu       sync.Mutex
+	state    *ControllerState
+	keys     map[string]time.Time
+	sequence int64
+}
+
+func NewMemoryStateStore() *MemoryStateStore {
+	return &MemoryStateStore{keys: map[string]time.Time{}}
+}
+
+func (s *MemoryStateStore) GetState(ctx context.Context) (ControllerState, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == nil {
+		return ControllerState{}, false, nil
+	}
+
+	return *s.state, true, nil
+}
+
+func (s *MemoryStateStore) PutState(ctx context.Context, state ControllerState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.state = &state
+	return nil
+}
+
+func (s *MemoryStateStore) GetOverride(ctx context.Context, now time.Time) (Override, bool, error) {
+	return Override{}, false, nil
+}
+
+func (s *MemoryStateStore) ClaimKey(ctx context.Context, key string, now time.Time, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if expiresAt, ok := s.keys[key]; ok && now.Before(expiresAt) {
+		return false, nil
+	}
+
+	s.keys[key] = now.Add(ttl)
+	return true, nil
+}
+
+func (s *MemoryStateStore) ReleaseKey(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, key)
+	return nil
+}
+
+func (s *MemoryStateStore) NextSequence(ctx context.Context) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sequence++
+	return s.sequence, nil
+}
+
+// Stateless deployments: nothing is stored, every key can be claimed and
+// commands carry no sequence number
+type NopStateStore struct{}
+
+func (NopStateStore) GetState(ctx context.Context) (ControllerState, bool, error) {
+	return ControllerState{}, false, nil
+}
+
+func (NopStateStore) PutState(ctx context.Context, state ControllerState) error {
+	return nil
+}
+
+func (NopStateStore) GetOverride(ctx context.Context, now time.Time) (Override, bool, error) {
+	return Override{}, false, nil
+}
+
+func (NopStateStore) ClaimKey(ctx context.Context, key string, now time.Time, ttl time.Duration) (bool, error) {
+	return true, nil
+}
+
+func (NopStateStore) ReleaseKey(ctx context.Context, key string) error {
+	return nil
+}
+
+func (NopStateStore) NextSequence(ctx context.Context) (int64, error) {
+	return 0, nil
+}
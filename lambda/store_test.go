@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMemoryStateStoreClaimKey(t *testing.T) {
+	store := NewMemoryStateStore()
+	now := time.Date(2024, 1, 2, 13, 0, 0, 0, time.UTC)
+
+	claims := []struct {
+		name string
+		now  time.Time
+		want bool
+	}{
+		{"first claim", now, true},
+		{"duplicate within the TTL", now.Add(59 * time.Minute), false},
+		{"claim after the TTL", now.Add(time.Hour), true},
+	}
+
+	for _, claim := range claims {
+		claimed, err := store.ClaimKey(context.Background(), "idempotency#test", claim.now, time.Hour)
+		if err != nil {
+			t.Fatalf("%s: ClaimKey: %v", claim.name, err)
+		}
+
+		if claimed != claim.want {
+			t.Errorf("%s: claimed = %t, want %t", claim.name, claimed, claim.want)
+		}
+	}
+}
+
+// Behaviour every persisting StateStore shares
+func TestStateStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) StateStore{
+		"memory": func(t *testing.T) StateStore { return NewMemoryStateStore() },
+		"dynamodb": func(t *testing.T) StateStore {
+			newFakeDynamoDB(t)
+			return &DynamoDBStateStore{TableName: "state"}
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := newStore(t)
+			now := time.Date(2024, 1, 2, 13, 0, 0, 0, time.UTC)
+
+			if _, found, err := store.GetState(ctx); err != nil || found {
+				t.Fatalf("GetState on an empty store = found %t, %v, want nothing stored", found, err)
+			}
+
+			want := ControllerState{SolarDisabled: true, UpdatedAt: now, ChangedAt: now.Add(-time.Hour), FetchFailures: 2}
+			if err := store.PutState(ctx, want); err != nil {
+				t.Fatalf("PutState: %v", err)
+			}
+
+			got, found, err := store.GetState(ctx)
+			if err != nil || !found {
+				t.Fatalf("GetState after PutState = found %t, %v", found, err)
+			}
+			if got.SolarDisabled != want.SolarDisabled || !got.UpdatedAt.Equal(want.UpdatedAt) || !got.ChangedAt.Equal(want.ChangedAt) || got.FetchFailures != want.FetchFailures {
+				t.Errorf("GetState = %+v, want %+v", got, want)
+			}
+
+			if _, active, err := store.GetOverride(ctx, now); err != nil || active {
+				t.Errorf("GetOverride without one = active %t, %v, want inactive", active, err)
+			}
+
+			for _, want := range []bool{true, false} {
+				claimed, err := store.ClaimKey(ctx, "idempotency#test", now, time.Hour)
+				if err != nil || claimed != want {
+					t.Fatalf("ClaimKey = %t, %v, want %t", claimed, err, want)
+				}
+			}
+
+			if err := store.ReleaseKey(ctx, "idempotency#test"); err != nil {
+				t.Fatalf("ReleaseKey: %v", err)
+			}
+			if claimed, err := store.ClaimKey(ctx, "idempotency#test", now, time.Hour); err != nil || !claimed {
+				t.Errorf("ClaimKey after ReleaseKey = %t, %v, want claimed", claimed, err)
+			}
+
+			for want := int64(1); want <= 2; want++ {
+				sequence, err := store.NextSequence(ctx)
+				if err != nil || sequence != want {
+					t.Errorf("NextSequence = %d, %v, want %d", sequence, err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDynamoDBStateStoreOverride(t *testing.T) {
+	dynamo := newFakeDynamoDB(t)
+	store := &DynamoDBStateStore{TableName: "state"}
+	expiresAt := time.Date(2024, 1, 2, 14, 0, 0, 0, time.UTC)
+
+	dynamo.putItem(fakeItem{
+		"id":             {"S": OVERRIDE_KEY},
+		"solar_disabled": {"BOOL": true},
+		"expires_at":     {"N": strconv.FormatInt(expiresAt.Unix(), 10)},
+	})
+
+	override, active, err := store.GetOverride(context.Background(), expiresAt.Add(-time.Minute))
+	if err != nil || !active || !override.SolarDisabled {
+		t.Errorf("GetOverride before expiry = %+v, active %t, %v, want an active disable", override, active, err)
+	}
+
+	// DynamoDB removes expired items lazily, so the store checks the expiry
+	if _, active, err := store.GetOverride(context.Background(), expiresAt); err != nil || active {
+		t.Errorf("GetOverride at expiry = active %t, %v, want inactive", active, err)
+	}
+}
+
+func TestNopStateStore(t *testing.T) {
+	ctx := context.Background()
+	store := NopStateStore{}
+	now := time.Date(2024, 1, 2, 13, 0, 0, 0, time.UTC)
+
+	if err := store.PutState(ctx, ControllerState{SolarDisabled: true}); err != nil {
+		t.Fatalf("PutState: %v", err)
+	}
+	if _, found, err := store.GetState(ctx); err != nil || found {
+		t.Errorf("GetState = found %t, %v, want nothing kept", found, err)
+	}
+
+	for range 2 {
+		if claimed, err := store.ClaimKey(ctx, "idempotency#test", now, time.Hour); err != nil || !claimed {
+			t.Errorf("ClaimKey = %t, %v, want every claim to succeed", claimed, err)
+		}
+	}
+
+	if sequence, err := store.NextSequence(ctx); err != nil || sequence != 0 {
+		t.Errorf("NextSequence = %d, %v, want no sequence", sequence, err)
+	}
+}
+
+func TestNewStateStore(t *testing.T) {
+	tests := []struct {
+		kind    string
+		table   string
+		want    StateStore
+		wantErr bool
+	}{
+		{kind: "none", want: NopStateStore{}},
+		{kind: "memory", want: sharedMemoryStateStore},
+		{kind: "dynamodb", table: "state", want: &DynamoDBStateStore{TableName: "state"}},
+		{kind: "redis", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			store, err := newStateStore(Config{StateStoreKind: tt.kind, StateTable: tt.table})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("newStateStore(%q) = %v, want an error", tt.kind, store)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newStateStore(%q): %v", tt.kind, err)
+			}
+
+			if dynamo, ok := tt.want.(*DynamoDBStateStore); ok {
+				got, ok := store.(*DynamoDBStateStore)
+				if !ok || got.TableName != dynamo.TableName {
+					t.Errorf("newStateStore(%q) = %#v, want %#v", tt.kind, store, tt.want)
+				}
+				return
+			}
+			if store != tt.want {
+				t.Errorf("newStateStore(%q) = %#v, want %#v", tt.kind, store, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewDynamoDBClientIsShared(t *testing.T) {
+	isolateAWS(t)
+
+	first, err := newDynamoDBClient(context.Background())
+	if err != nil {
+		t.Fatalf("newDynamoDBClient: %v", err)
+	}
+
+	second, err := newDynamoDBClient(context.Background())
+	if err != nil {
+		t.Fatalf("newDynamoDBClient: %v", err)
+	}
+
+	if first != second {
+		t.Error("newDynamoDBClient built a new client, want the cached one")
+	}
+}
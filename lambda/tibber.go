@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const TIBBER_API_URL = "https://api.tibber.com/v1-beta/gql"
+
+// Tibber prices for the home's current subscription
+type TibberProvider struct {
+	URL    string
+	Client *http.Client
+	Token  string
+	HomeId string
+	Retry  RetryPolicy
+}
+
+// Response structures
+type TibberPricesResponse struct {
+	Data struct {
+		Viewer struct {
+			Homes []struct {
+				Id                  string `json:"id"`
+				CurrentSubscription struct {
+					PriceInfo struct {
+						Today    []TibberPrice `json:"today"`
+						Tomorrow []TibberPrice `json:"tomorrow"`
+					} `json:"priceInfo"`
+				} `json:"currentSubscription"`
+			} `json:"homes"`
+		} `json:"viewer"`
+	} `json:"data"`
+	Errors []GraphQLError `json:"errors"`
+}
+
+type TibberPrice struct {
+	Energy   float64 `json:"energy"`
+	StartsAt string  `json:"startsAt"`
+}
+
+func (p *TibberProvider) FetchPrices(ctx context.Context, date string) ([]ElectricityPrice, error) {
+	// Tibber only exposes today's and tomorrow's prices
+	query := `query TibberPrices {
+		viewer {
+			homes {
+				id
+				currentSubscription {
+					priceInfo {
+						today { energy startsAt }
+						tomorrow { energy startsAt }
+					}
+				}
+			}
+		}
+	}`
+
+	reqBody := GraphQLRequest{
+		Query:         query,
+		Variables:     map[string]interface{}{},
+		OperationName: "TibberPrices",
+	}
+
+	headers := map[string]string{
+		"Authorization": "Bearer " + p.Token,
+	}
+
+	var response TibberPricesResponse
+
+	err := postGraphQL(ctx, p.Client, p.URL, headers, reqBody, p.Retry, &response)
+	if err != nil {
+		return nil, err
+	}
+
+	err = graphQLError(response.Errors)
+	if err != nil {
+		return nil, err
+	}
+
+	// Use the configured home, or the first one on the account
+	for _, home := range response.Data.Viewer.Homes {
+		if p.HomeId != "" && home.Id != p.HomeId {
+			continue
+		}
+
+		priceInfo := home.CurrentSubscription.PriceInfo
+		return mapTibberPrices(append(priceInfo.Today, priceInfo.Tomorrow...), date)
+	}
+
+	return nil, fmt.Errorf("no Tibber home found (home id: %q)", p.HomeId)
+}
+
+// Map Tibber's start-only periods onto from/till periods for the given date
+func mapTibberPrices(tibberPrices []TibberPrice, date string) ([]ElectricityPrice, error) {
+	type period struct {
+		start  time.Time
+		energy float64
+	}
+
+	periods := make([]period, 0, len(tibberPrices))
+
+	for _, price := range tibberPrices {
+		start, err := time.Parse(time.RFC3339, price.StartsAt)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing Tibber startsAt %q: %w", price.StartsAt, err)
+		}
+
+		periods = append(periods, period{start: start, energy: price.Energy})
+	}
+
+	sort.Slice(periods, func(i, j int) bool {
+		return periods[i].start.Before(periods[j].start)
+	})
+
+	var prices []ElectricityPrice
+
+	for i, current := range periods {
+		// startsAt carries the home's local offset, so its date is the price day
+		if current.start.Format("2006-01-02") != date {
+			continue
+		}
+
+		// Each period ends where the next one starts; the last one is assumed
+		// to be as long as the one before it
+		length := time.Hour
+		if i+1 < len(periods) {
+			length = periods[i+1].start.Sub(current.start)
+		} else if i > 0 {
+			length = current.start.Sub(periods[i-1].start)
+		}
+
+		prices = append(prices, ElectricityPrice{
+			From:        current.start.UTC().Format(time.RFC3339),
+			Till:        current.start.Add(length).UTC().Format(time.RFC3339),
+			MarketPrice: current.energy,
+			PerUnit:     PRICE_UNIT,
+		})
+	}
+
+	return prices, nil
+}
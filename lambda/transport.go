@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// Upper bound for PUBLISH_JITTER_MS, well within a Lambda timeout
+const MAX_PUBLISH_JITTER = 10 * time.Second
+
+// Delivery mechanism for relay commands, decoupled from the decision
+type Transport interface {
+	Send(ctx context.Context, clientID string, on bool) error
+}
+
+// Context sent along with a command: why it was sent and the run's sequence
+// number from the state store, 0 when none was reserved
+type CommandMeta struct {
+	Reason   string
+	Sequence int64
+}
+
+// Build the transport selected by TRANSPORT
+func newTransport(ctx context.Context, cfg Config, meta CommandMeta) (Transport, error) {
+	switch cfg.Transport {
+	case "iot":
+		if cfg.ControlMode == "shadow" {
+			return newShadowTransport(ctx, cfg)
+		}
+		return newIoTCoreTransport(ctx, cfg, meta)
+	case "shellycloud":
+		return &ShellyCloudTransport{
+			URL:     cfg.ShellyCloudURL,
+			Client:  newHTTPClient(cfg),
+			AuthKey: cfg.ShellyCloudAuthKey,
+			Channel: cfg.SwitchChannel,
+			Retry:   cfg.FetchRetry,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", cfg.Transport)
+	}
+}
+
+// Switch the relay on every device, collecting failures instead of aborting.
+// deviceDecisions holds the decisions of the devices with their own threshold
+// and is nil when every device follows a fallback or override
+func sendCommand(ctx context.Context, cfg Config, shouldDisable bool, deviceDecisions map[string]bool, meta CommandMeta) error {
+	if len(cfg.ShellyClientIds) == 0 {
+		return fmt.Errorf("SHELLY_CLIENT_IDS (or SHELLY_CLIENT_ID) environment variable must be set")
+	}
+
+	// Don't let every controller hit the broker at the top of the hour
+	if !cfg.DryRun {
+		err := sleepJitter(ctx, cfg.PublishJitter)
+		if err != nil {
+			return fmt.Errorf("error waiting for publish jitter: %w", err)
+		}
+	}
+
+	// One publish to the shared group topic instead of one per device
+	if cfg.GroupTopic != "" {
+		on := relayOn(shouldDisable, cfg.InvertCommand)
+		command := relayCommand(on)
+
+		slog.Info("Resolved relay command", "should_disable", shouldDisable, "invert_command", cfg.InvertCommand, "command", command)
+
+		if cfg.DryRun {
+			slog.Info("Dry run: would send command", "command", command, "topic", cfg.GroupTopic, "transport", cfg.Transport)
+			return nil
+		}
+
+		iotTransport, err := newIoTCoreTransport(ctx, cfg, meta)
+		if err != nil {
+			return err
+		}
+
+		err = iotTransport.SendGroup(ctx, cfg.GroupTopic, cfg.ShellyClientIds, on)
+		if err != nil {
+			slog.Error("Failed to send group command", "command", command, "topic", cfg.GroupTopic, "error", err)
+			return fmt.Errorf("error sending command to group topic %s: %w", cfg.GroupTopic, err)
+		}
+
+		slog.Info("Successfully sent group command", "command", command, "topic", cfg.GroupTopic)
+		return nil
+	}
+
+	var transport Transport
+
+	if !cfg.DryRun {
+		var err error
+
+		transport, err = newTransport(ctx, cfg, meta)
+		if err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+
+	for _, shellyClientId := range cfg.ShellyClientIds {
+		deviceDisable, invert := resolveDevice(cfg, shellyClientId, shouldDisable, deviceDecisions)
+		on := relayOn(deviceDisable, invert)
+		command := relayCommand(on)
+
+		slog.Info("Resolved relay command", "client_id", shellyClientId, "should_disable", deviceDisable, "invert_command", invert, "command", command)
+
+		if cfg.DryRun {
+			slog.Info("Dry run: would send command", "command", command, "client_id", shellyClientId, "transport", cfg.Transport)
+			continue
+		}
+
+		err := transport.Send(ctx, shellyClientId, on)
+		if err != nil {
+			slog.Error("Failed to send command", "command", command, "client_id", shellyClientId, "error", err)
+			errs = append(errs, fmt.Errorf("error sending command to device %s: %w", shellyClientId, err))
+			continue
+		}
+
+		slog.Info("Successfully sent command", "command", command, "client_id", shellyClientId)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Whether any DEVICE_CONFIG entry decides on its own threshold
+func hasDeviceThresholds(cfg Config) bool {
+	for _, device := range cfg.Devices {
+		if device.Threshold != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Apply a device's own decision and polarity from DEVICE_CONFIG, falling back
+// to the global decision and INVERT_COMMAND
+func resolveDevice(cfg Config, clientId string, shouldDisable bool, deviceDecisions map[string]bool) (bool, bool) {
+	invert := cfg.InvertCommand
+
+	device, ok := cfg.Devices[clientId]
+	if !ok {
+		return shouldDisable, invert
+	}
+
+	if device.Invert != nil {
+		invert = *device.Invert
+	}
+
+	if decision, ok := deviceDecisions[clientId]; ok {
+		shouldDisable = decision
+	}
+
+	return shouldDisable, invert
+}
+
+func relayCommand(on bool) string {
+	if on {
+		return "on"
+	}
+
+	return "off"
+}
+
+// The relay disables the inverter when it is on, unless the wiring is inverted
+func relayOn(shouldDisable bool, invert bool) bool {
+	return shouldDisable != invert
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelayOn(t *testing.T) {
+	tests := []struct {
+		shouldDisable bool
+		invert        bool
+		want          string
+	}{
+		{true, false, "on"},
+		{false, false, "off"},
+		{true, true, "off"},
+		{false, true, "on"},
+	}
+
+	for _, tt := range tests {
+		if got := relayCommand(relayOn(tt.shouldDisable, tt.invert)); got != tt.want {
+			t.Errorf("shouldDisable %t, invert %t: command %q, want %q", tt.shouldDisable, tt.invert, got, tt.want)
+		}
+	}
+}
+
+func TestSendCommandInvert(t *testing.T) {
+	tests := []struct {
+		name          string
+		invert        bool
+		shouldDisable bool
+		want          string
+	}{
+		{"normally open disables with on", false, true, "on"},
+		{"normally open enables with off", false, false, "off"},
+		{"normally closed disables with off", true, true, "off"},
+		{"normally closed enables with on", true, false, "on"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			iot := newFakeIoT()
+			cfg := fakeIoTConfig(iot, "shelly-a")
+			cfg.InvertCommand = tt.invert
+
+			err := sendCommand(context.Background(), cfg, tt.shouldDisable, nil, CommandMeta{})
+			if err != nil {
+				t.Fatalf("sendCommand: %v", err)
+			}
+
+			messages := iot.messages()
+			if len(messages) != 1 || decodeCommand(t, messages[0]).Command != tt.want {
+				t.Errorf("published %+v, want one %q command", messages, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveDevicePolarity(t *testing.T) {
+	cfg := Config{
+		InvertCommand: true,
+		Devices:       map[string]DeviceConfig{"shelly-b": {Invert: boolPtr(false)}},
+	}
+
+	if _, invert := resolveDevice(cfg, "shelly-a", true, nil); !invert {
+		t.Error("shelly-a without device config ignores INVERT_COMMAND")
+	}
+	if _, invert := resolveDevice(cfg, "shelly-b", true, nil); invert {
+		t.Error("shelly-b's own polarity doesn't override INVERT_COMMAND")
+	}
+}
+
+func TestResolveDeviceDecision(t *testing.T) {
+	cfg := Config{Devices: map[string]DeviceConfig{"shelly-b": {Threshold: new(float64)}}}
+	decisions := map[string]bool{"shelly-b": false}
+
+	if disable, _ := resolveDevice(cfg, "shelly-a", true, decisions); !disable {
+		t.Error("shelly-a without device config doesn't follow the global decision")
+	}
+	if disable, _ := resolveDevice(cfg, "shelly-b", true, decisions); disable {
+		t.Error("shelly-b doesn't follow its own decision")
+	}
+	if disable, _ := resolveDevice(cfg, "shelly-b", true, nil); !disable {
+		t.Error("shelly-b doesn't follow a fallback without device decisions")
+	}
+}
+
+func TestRunDeviceThresholds(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+
+	// With the default fee, 0.02 nets about 0.007, above the global threshold
+	tests := []struct {
+		name string
+		env  map[string]string
+		soc  string
+		want map[string]string
+	}{
+		{
+			name: "own threshold disables the device",
+			env:  map[string]string{"DEVICE_CONFIG": `{"shelly-b": {"threshold": 0.05}}`},
+			want: map[string]string{"shelly-a/command/switch:0": "off", "shelly-b/command/switch:0": "on"},
+		},
+		{
+			name: "battery gate keeps the device enabled",
+			env:  map[string]string{"DEVICE_CONFIG": `{"shelly-b": {"threshold": 0.05}}`},
+			soc:  `{"soc": 40}`,
+			want: map[string]string{"shelly-a/command/switch:0": "off", "shelly-b/command/switch:0": "off"},
+		},
+		{
+			name: "hysteresis holds the device enabled",
+			env:  map[string]string{"DEVICE_CONFIG": `{"shelly-b": {"threshold": 0.01}}`, "SWITCH_HYSTERESIS": "0.005"},
+			want: map[string]string{"shelly-a/command/switch:0": "off", "shelly-b/command/switch:0": "off"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isolateAWS(t)
+
+			prices := marketPricesBody(t, dayPrices(t, now, 0.02))
+
+			// The https-only URLs share one trusted server
+			mux := http.NewServeMux()
+			mux.HandleFunc("/soc", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(tt.soc))
+			})
+			mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(prices))
+			})
+			server := newTLSServer(t, mux)
+
+			env := map[string]string{
+				"FRANK_ENERGIE_URL": server.URL,
+				"SHELLY_CLIENT_IDS": "shelly-a,shelly-b",
+				"CA_BUNDLE_PATH":    os.Getenv("CA_BUNDLE_PATH"),
+			}
+			if tt.soc != "" {
+				env["BATTERY_SOC_URL"] = server.URL + "/soc"
+			}
+			for name, value := range tt.env {
+				env[name] = value
+			}
+
+			iot := newFakeIoT()
+			cfg := runConfig(t, iot, nil, now, env)
+
+			result, err := Run(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if result.ShouldDisableSolar {
+				t.Fatalf("result = %+v, want the global decision to keep solar enabled", result)
+			}
+
+			messages := iot.messages()
+			if len(messages) != len(tt.want) {
+				t.Fatalf("published %d messages, want %d", len(messages), len(tt.want))
+			}
+			for _, message := range messages {
+				if command := decodeCommand(t, message).Command; command != tt.want[message.Topic] {
+					t.Errorf("%s: command %q, want %q", message.Topic, command, tt.want[message.Topic])
+				}
+			}
+		})
+	}
+}
+
+func TestSendCommandGroupTopic(t *testing.T) {
+	iot := newFakeIoT()
+	cfg := fakeIoTConfig(iot, "shelly-a", "shelly-b", "shelly-c")
+	cfg.GroupTopic = "solar/group/command"
+
+	err := sendCommand(context.Background(), cfg, true, nil, CommandMeta{Sequence: 9})
+	if err != nil {
+		t.Fatalf("sendCommand: %v", err)
+	}
+
+	messages := iot.messages()
+	if len(messages) != 1 || messages[0].Topic != "solar/group/command" {
+		t.Fatalf("published %+v, want a single message to the group topic", messages)
+	}
+
+	if command := decodeCommand(t, messages[0]); command.Command != "on" || command.Sequence != 9 {
+		t.Errorf("command = %+v, want on with sequence 9", command)
+	}
+}
+
+func TestSendCommandGroupTopicFailure(t *testing.T) {
+	iot := newFakeIoT()
+	iot.fail["solar/group/command"] = errors.New("access denied")
+	cfg := fakeIoTConfig(iot, "shelly-a", "shelly-b")
+	cfg.GroupTopic = "solar/group/command"
+
+	err := sendCommand(context.Background(), cfg, false, nil, CommandMeta{})
+	if err == nil || !strings.Contains(err.Error(), "solar/group/command") {
+		t.Fatalf("error = %v, want one naming the group topic", err)
+	}
+
+	// No fallback to per-device publishes
+	if messages := iot.messages(); len(messages) != 0 {
+		t.Errorf("published %+v, want nothing", messages)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// Header carrying the HMAC-SHA256 of the body, as "sha256=<hex>"
+const WEBHOOK_SIGNATURE_HEADER = "X-Signature-256"
+
+// POST the result as JSON to the webhook, signed with the secret when set
+func postWebhook(ctx context.Context, client *http.Client, webhookURL string, secret string, result HandlerResult) error {
+	body, err := json.Marshal(result)
+	if err != nil {
+		return fmt.Errorf("error marshaling webhook body: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error creating webhook request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if secret != "" {
+		req.Header.Set(WEBHOOK_SIGNATURE_HEADER, "sha256="+signWebhook(secret, body))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// Home Assistant webhook IDs in the URL act as credentials
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("error calling webhook: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status code: %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// Hex HMAC-SHA256 of the body, for receivers to verify the sender
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Request received by a webhook server
+type webhookRequest struct {
+	Method      string
+	ContentType string
+	Signature   string
+	Body        []byte
+}
+
+// Webhook answering with status, recording the requests it receives
+func newWebhookServer(t *testing.T, status int) (*httptest.Server, func() []webhookRequest) {
+	t.Helper()
+
+	var mu sync.Mutex
+	var requests []webhookRequest
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		mu.Lock()
+		requests = append(requests, webhookRequest{
+			Method:      r.Method,
+			ContentType: r.Header.Get("Content-Type"),
+			Signature:   r.Header.Get(WEBHOOK_SIGNATURE_HEADER),
+			Body:        body,
+		})
+		mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+
+	return server, func() []webhookRequest {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return append([]webhookRequest(nil), requests...)
+	}
+}
+
+func TestPostWebhook(t *testing.T) {
+	server, requests := newWebhookServer(t, http.StatusOK)
+	result := HandlerResult{ShouldDisableSolar: true, CommandSent: true, EffectivePrice: -0.05}
+
+	err := postWebhook(context.Background(), server.Client(), server.URL, "secret", result)
+	if err != nil {
+		t.Fatalf("postWebhook: %v", err)
+	}
+
+	received := requests()
+	if len(received) != 1 {
+		t.Fatalf("received %d requests, want 1", len(received))
+	}
+
+	request := received[0]
+	if request.Method != "POST" || request.ContentType != "application/json" {
+		t.Errorf("request = %s with %q, want a JSON POST", request.Method, request.ContentType)
+	}
+
+	var body HandlerResult
+	if err := json.Unmarshal(request.Body, &body); err != nil {
+		t.Fatalf("body %s is not a HandlerResult: %v", request.Body, err)
+	}
+	if !body.ShouldDisableSolar || body.EffectivePrice != -0.05 {
+		t.Errorf("body = %+v, want the result", body)
+	}
+
+	// The receiver recomputes the HMAC over the raw body with the shared secret
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write(request.Body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); request.Signature != want {
+		t.Errorf("signature = %q, want %q", request.Signature, want)
+	}
+}
+
+func TestPostWebhookUnsigned(t *testing.T) {
+	server, requests := newWebhookServer(t, http.StatusOK)
+
+	if err := postWebhook(context.Background(), server.Client(), server.URL, "", HandlerResult{}); err != nil {
+		t.Fatalf("postWebhook: %v", err)
+	}
+
+	if received := requests(); len(received) != 1 || received[0].Signature != "" {
+		t.Errorf("received %+v, want one request without a signature", received)
+	}
+}
+
+func TestPostWebhookErrors(t *testing.T) {
+	server, _ := newWebhookServer(t, http.StatusInternalServerError)
+
+	err := postWebhook(context.Background(), server.Client(), server.URL, "", HandlerResult{})
+	if err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("error = %v, want the status code", err)
+	}
+
+	// The webhook ID in the URL is a credential and stays out of the error
+	server.Close()
+
+	err = postWebhook(context.Background(), server.Client(), server.URL+"/api/webhook/private-id", "", HandlerResult{})
+	if err == nil || strings.Contains(err.Error(), "private-id") {
+		t.Errorf("error = %v, want one without the webhook URL", err)
+	}
+}
+
+func TestRunWebhook(t *testing.T) {
+	now := time.Date(2024, 1, 2, 13, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		status int
+	}{
+		{"webhook accepts", http.StatusOK},
+		{"webhook fails without failing the run", http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, requests := newWebhookServer(t, tt.status)
+			cfg := runConfig(t, newFakeIoT(), dayPrices(t, now, -0.05), now, map[string]string{"WEBHOOK_URL": server.URL, "WEBHOOK_SECRET": "secret"})
+
+			result, err := Run(context.Background(), cfg)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if !result.CommandSent {
+				t.Fatalf("result = %+v, want the command sent", result)
+			}
+
+			received := requests()
+			if len(received) != 1 || received[0].Signature != "sha256="+signWebhook("secret", received[0].Body) {
+				t.Errorf("received %+v, want one signed request", received)
+			}
+		})
+	}
+}
+
+func TestLoadConfigWebhookURL(t *testing.T) {
+	t.Setenv("SHELLY_CLIENT_IDS", "shelly-a")
+	t.Setenv("IOT_ENDPOINT", "default.iot.test")
+
+	for url, valid := range map[string]bool{
+		"http://homeassistant.local:8123/api/webhook/id": true,
+		"https://example.test/hook":                      true,
+		"ftp://example.test/hook":                        false,
+		"homeassistant.local/api/webhook/id":             false,
+	} {
+		t.Setenv("WEBHOOK_URL", url)
+
+		_, err := loadConfig()
+		if valid && err != nil {
+			t.Errorf("WEBHOOK_URL=%s: %v", url, err)
+		}
+		if !valid && err == nil {
+			t.Errorf("WEBHOOK_URL=%s loaded, want an error", url)
+		}
+	}
+}
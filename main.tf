@@ -18,6 +18,12 @@ provider "aws" {
 
 locals {
   aws_iot_certificate_arn = "arn:aws:iot:eu-west-1:530676788171:cert/efdce7afb5992158251a3d25dd2fedefb4844f93b9b3be36e1afcd347858aafa"
+
+  # All Shelly devices controlled by the Lambda
+  client_ids = distinct(concat([var.client_id], var.additional_client_ids))
+
+  # Every device the Lambda publishes to, including those following the gas price
+  all_client_ids = distinct(concat(local.client_ids, var.gas_client_ids))
 }
 
 # IoT Core Policy for Shelly device
@@ -33,7 +39,7 @@ resource "aws_iot_policy" "shelly_device_policy" {
           "iot:Connect"
         ]
         Resource = [
-          "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:client/${var.client_id}"
+          for id in local.all_client_ids : "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:client/${id}"
         ]
       },
       {
@@ -41,20 +47,21 @@ resource "aws_iot_policy" "shelly_device_policy" {
         Action = [
           "iot:Subscribe"
         ]
-        Resource = [
-          "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/shellies/*",
-          "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/${var.client_id}/*"
-        ]
+        Resource = concat(
+          ["arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/shellies/*"],
+          [for id in local.all_client_ids : "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/${id}/*"],
+          var.group_topic == "" ? [] : ["arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/${var.group_topic}"]
+        )
       },
       {
         Effect = "Allow"
         Action = [
           "iot:Publish"
         ]
-        Resource = [
-          "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/shellies/announce",
-          "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/${var.client_id}/*"
-        ]
+        Resource = concat(
+          ["arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/shellies/announce"],
+          [for id in local.all_client_ids : "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/${id}/*"]
+        )
       }
     ]
   })
@@ -114,16 +121,278 @@ resource "aws_iam_policy" "lambda_iot_policy" {
       {
         Effect = "Allow"
         Action = [
-          "iot:Publish"
+          "iot:Publish",
+          "iot:RetainPublish"
+        ]
+        Resource = concat(
+          [for id in local.all_client_ids : "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/${replace(replace(var.topic_template, "{clientId}", id), "{channel}", var.switch_channel)}"],
+          [for id in local.client_ids : "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/${id}/status/controller"],
+          [for id in local.client_ids : "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/${id}/status/error"],
+          # Output limits with CONTROL_TYPE=curtail
+          lookup(var.lambda_environment, "CURTAIL_TOPIC", "") == "" ? [] : [for id in local.client_ids : "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/${replace(replace(var.lambda_environment["CURTAIL_TOPIC"], "{clientId}", id), "{channel}", var.switch_channel)}"],
+          var.group_topic == "" ? [] : ["arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/${var.group_topic}"]
+        )
+      },
+      {
+        Effect = "Allow"
+        # Updates are only used with CONTROL_MODE=shadow, named shadows live below the thing
+        Action = [
+          "iot:GetThingShadow",
+          "iot:UpdateThingShadow"
+        ]
+        Resource = concat(
+          [for id in local.all_client_ids : "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:thing/${id}"],
+          [for id in local.all_client_ids : "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:thing/${id}/*"]
+        )
+      }
+    ]
+  })
+}
+
+# DynamoDB table holding the controller state between invocations
+resource "aws_dynamodb_table" "controller_state" {
+  name         = "solar-controller-state"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "id"
+
+  attribute {
+    name = "id"
+    type = "S"
+  }
+
+  # Expires the idempotency keys, the state item itself has no expiry
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
+}
+
+# DynamoDB table caching a day's prices, expired at the end of the day
+resource "aws_dynamodb_table" "price_cache" {
+  name         = "solar-controller-price-cache"
+  billing_mode = "PAY_PER_REQUEST"
+  hash_key     = "id"
+
+  attribute {
+    name = "id"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
+}
+
+# IAM policy for Lambda to read and write the controller state
+resource "aws_iam_policy" "lambda_state_policy" {
+  name        = "solar-controller-lambda-state-policy"
+  description = "Policy for Lambda to persist state and cached prices in DynamoDB"
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect = "Allow"
+        Action = [
+          "dynamodb:GetItem",
+          "dynamodb:PutItem",
+          "dynamodb:DeleteItem",
+          "dynamodb:UpdateItem"
+        ]
+        Resource = [
+          aws_dynamodb_table.controller_state.arn,
+          aws_dynamodb_table.price_cache.arn
+        ]
+      }
+    ]
+  })
+}
+
+# Attach state policy to Lambda role
+resource "aws_iam_role_policy_attachment" "lambda_state_policy_attachment" {
+  role       = aws_iam_role.lambda_execution_role.name
+  policy_arn = aws_iam_policy.lambda_state_policy.arn
+}
+
+# IAM policy for Lambda to publish custom CloudWatch metrics
+resource "aws_iam_policy" "lambda_metrics_policy" {
+  name        = "solar-controller-lambda-metrics-policy"
+  description = "Policy for Lambda to publish CloudWatch metrics"
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect = "Allow"
+        Action = [
+          "cloudwatch:PutMetricData"
+        ]
+        Resource = "*"
+      }
+    ]
+  })
+}
+
+# Attach metrics policy to Lambda role
+resource "aws_iam_role_policy_attachment" "lambda_metrics_policy_attachment" {
+  role       = aws_iam_role.lambda_execution_role.name
+  policy_arn = aws_iam_policy.lambda_metrics_policy.arn
+}
+
+# IAM policy for Lambda to publish decisions to SNS
+resource "aws_iam_policy" "lambda_sns_policy" {
+  count       = var.decision_sns_topic_arn != "" ? 1 : 0
+  name        = "solar-controller-lambda-sns-policy"
+  description = "Policy for Lambda to publish decisions to SNS"
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect = "Allow"
+        Action = [
+          "sns:Publish"
+        ]
+        Resource = [
+          var.decision_sns_topic_arn
+        ]
+      }
+    ]
+  })
+}
+
+# Attach SNS policy to Lambda role
+resource "aws_iam_role_policy_attachment" "lambda_sns_policy_attachment" {
+  count      = var.decision_sns_topic_arn != "" ? 1 : 0
+  role       = aws_iam_role.lambda_execution_role.name
+  policy_arn = aws_iam_policy.lambda_sns_policy[0].arn
+}
+
+# IAM policy for Lambda to resolve ssm: and secretsmanager: configuration values
+resource "aws_iam_policy" "lambda_secrets_policy" {
+  count       = length(var.secret_arns) > 0 ? 1 : 0
+  name        = "solar-controller-lambda-secrets-policy"
+  description = "Policy for Lambda to read configuration secrets from SSM and Secrets Manager"
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect = "Allow"
+        Action = [
+          "ssm:GetParameter",
+          "secretsmanager:GetSecretValue"
+        ]
+        Resource = var.secret_arns
+      }
+    ]
+  })
+}
+
+# Attach secrets policy to Lambda role
+resource "aws_iam_role_policy_attachment" "lambda_secrets_policy_attachment" {
+  count      = length(var.secret_arns) > 0 ? 1 : 0
+  role       = aws_iam_role.lambda_execution_role.name
+  policy_arn = aws_iam_policy.lambda_secrets_policy[0].arn
+}
+
+# IAM policy for Lambda to assume the roles of IoT endpoints in other accounts
+resource "aws_iam_policy" "lambda_iot_targets_policy" {
+  count       = length(var.iot_target_role_arns) > 0 ? 1 : 0
+  name        = "solar-controller-lambda-iot-targets-policy"
+  description = "Policy for Lambda to assume roles publishing to IoT endpoints in other accounts"
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect = "Allow"
+        Action = [
+          "sts:AssumeRole"
+        ]
+        Resource = var.iot_target_role_arns
+      }
+    ]
+  })
+}
+
+# Attach IoT targets policy to Lambda role
+resource "aws_iam_role_policy_attachment" "lambda_iot_targets_policy_attachment" {
+  count      = length(var.iot_target_role_arns) > 0 ? 1 : 0
+  role       = aws_iam_role.lambda_execution_role.name
+  policy_arn = aws_iam_policy.lambda_iot_targets_policy[0].arn
+}
+
+# IAM policy for Lambda to put state transition events on EventBridge
+resource "aws_iam_policy" "lambda_events_policy" {
+  count       = var.transition_event_bus_arn != "" ? 1 : 0
+  name        = "solar-controller-lambda-events-policy"
+  description = "Policy for Lambda to put state transition events on EventBridge"
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect = "Allow"
+        Action = [
+          "events:PutEvents"
         ]
         Resource = [
-          "arn:aws:iot:${var.aws_region}:${data.aws_caller_identity.current.account_id}:topic/${var.client_id}/command/switch:0"
+          var.transition_event_bus_arn
         ]
       }
     ]
   })
 }
 
+# Attach EventBridge policy to Lambda role
+resource "aws_iam_role_policy_attachment" "lambda_events_policy_attachment" {
+  count      = var.transition_event_bus_arn != "" ? 1 : 0
+  role       = aws_iam_role.lambda_execution_role.name
+  policy_arn = aws_iam_policy.lambda_events_policy[0].arn
+}
+
+# IAM policy for Lambda to append to the decision log in S3
+resource "aws_iam_policy" "lambda_decision_log_policy" {
+  count       = var.decision_log_bucket != "" ? 1 : 0
+  name        = "solar-controller-lambda-decision-log-policy"
+  description = "Policy for Lambda to write the decision log to S3"
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect = "Allow"
+        Action = [
+          "s3:GetObject",
+          "s3:PutObject"
+        ]
+        Resource = [
+          "arn:aws:s3:::${var.decision_log_bucket}/decisions/*"
+        ]
+      },
+      {
+        # Lets GetObject report a missing object as NoSuchKey instead of AccessDenied
+        Effect = "Allow"
+        Action = [
+          "s3:ListBucket"
+        ]
+        Resource = [
+          "arn:aws:s3:::${var.decision_log_bucket}"
+        ]
+      }
+    ]
+  })
+}
+
+# Attach decision log policy to Lambda role
+resource "aws_iam_role_policy_attachment" "lambda_decision_log_policy_attachment" {
+  count      = var.decision_log_bucket != "" ? 1 : 0
+  role       = aws_iam_role.lambda_execution_role.name
+  policy_arn = aws_iam_policy.lambda_decision_log_policy[0].arn
+}
+
 # Attach IoT policy to Lambda role
 resource "aws_iam_role_policy_attachment" "lambda_iot_policy_attachment" {
   role       = aws_iam_role.lambda_execution_role.name
@@ -139,14 +408,14 @@ resource "aws_iam_role_policy_attachment" "lambda_basic_execution" {
 # Build the Go binary for ARM64 and create deployment package
 resource "null_resource" "build_lambda" {
   triggers = {
-    source_code_hash = filemd5("${path.module}/lambda/main.go")
+    source_code_hash = sha1(join("", [for f in sort(fileset("${path.module}/lambda", "*.go")) : filemd5("${path.module}/lambda/${f}")]))
   }
 
   provisioner "local-exec" {
     command = <<-EOT
       mkdir -p ${path.module}/lambda/dist
       cd ${path.module}/lambda
-      GOOS=linux GOARCH=arm64 go build -o dist/bootstrap main.go
+      GOOS=linux GOARCH=arm64 go build -o dist/bootstrap .
     EOT
   }
 }
@@ -173,10 +442,20 @@ resource "aws_lambda_function" "solar_controller" {
   source_code_hash = data.archive_file.lambda_zip.output_base64sha256
 
   environment {
-    variables = {
-      IOT_ENDPOINT     = data.aws_iot_endpoint.endpoint.endpoint_address
-      SHELLY_CLIENT_ID = var.client_id
-    }
+    # Stock Shelly firmware only understands the plain "on"/"off" payload
+    variables = merge({ LEGACY_PAYLOAD = "true" }, var.lambda_environment, {
+      IOT_ENDPOINT           = data.aws_iot_endpoint.endpoint.endpoint_address
+      SHELLY_CLIENT_IDS      = join(",", local.client_ids)
+      STATE_TABLE            = aws_dynamodb_table.controller_state.name
+      PRICE_CACHE_TABLE      = aws_dynamodb_table.price_cache.name
+      TOPIC_TEMPLATE         = var.topic_template
+      GROUP_TOPIC            = var.group_topic
+      GAS_CLIENT_IDS         = join(",", var.gas_client_ids)
+      DECISION_SNS_TOPIC_ARN = var.decision_sns_topic_arn
+      DECISION_LOG_BUCKET    = var.decision_log_bucket
+      TRANSITION_EVENT_BUS   = var.transition_event_bus_arn
+      SWITCH_CHANNEL         = tostring(var.switch_channel)
+    })
   }
 
   depends_on = [data.archive_file.lambda_zip]
@@ -7,4 +7,70 @@ variable "aws_region" {
 variable "client_id" {
   description = "Client ID for the Shelly device"
   type        = string
+}
+
+variable "additional_client_ids" {
+  description = "Client IDs of additional Shelly devices controlled alongside client_id"
+  type        = list(string)
+  default     = []
+}
+
+variable "topic_template" {
+  description = "MQTT command topic, with {clientId} replaced by each device's client ID and {channel} by switch_channel"
+  type        = string
+  default     = "{clientId}/command/switch:{channel}"
+}
+
+variable "switch_channel" {
+  description = "Relay channel on the Shelly device to control"
+  type        = number
+  default     = 0
+}
+
+variable "group_topic" {
+  description = "Optional MQTT topic all devices subscribe to; when set, one command is published there instead of one per device"
+  type        = string
+  default     = ""
+}
+
+variable "gas_client_ids" {
+  description = "Client IDs of Shelly devices switched on the gas price instead of the electricity decision"
+  type        = list(string)
+  default     = []
+}
+
+variable "decision_sns_topic_arn" {
+  description = "ARN of an SNS topic receiving every decision, empty to disable"
+  type        = string
+  default     = ""
+}
+
+variable "decision_log_bucket" {
+  description = "Name of an existing S3 bucket receiving a daily log of every decision, empty to disable"
+  type        = string
+  default     = ""
+}
+
+variable "secret_arns" {
+  description = "ARNs of SSM parameters and Secrets Manager secrets referenced by ssm: or secretsmanager: values in lambda_environment"
+  type        = list(string)
+  default     = []
+}
+
+variable "iot_target_role_arns" {
+  description = "ARNs of roles in other accounts the Lambda may assume to publish to IOT_TARGETS endpoints"
+  type        = list(string)
+  default     = []
+}
+
+variable "transition_event_bus_arn" {
+  description = "ARN of an existing EventBridge bus receiving an event on every solar state change, empty to disable"
+  type        = string
+  default     = ""
+}
+
+variable "lambda_environment" {
+  description = "Additional environment variables for the Lambda function (e.g. FEED_IN_FEE)"
+  type        = map(string)
+  default     = {}
 }
\ No newline at end of file